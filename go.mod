@@ -5,13 +5,18 @@ go 1.22
 toolchain go1.22.5
 
 require (
+	github.com/fsnotify/fsnotify v1.7.0
+	github.com/miekg/pkcs11 v1.1.1
 	github.com/spf13/pflag v1.0.6
 	go.aporeto.io/addedeffect v1.82.0
 	go.aporeto.io/tg v1.50.2-0.20240726190142-d7d9b061a4ea
+	golang.org/x/net v0.27.0
+	golang.org/x/term v0.22.0
+	gopkg.in/yaml.v3 v3.0.1
+	software.sslmate.com/src/go-pkcs12 v0.5.0
 )
 
 require (
-	github.com/fsnotify/fsnotify v1.7.0 // indirect
 	github.com/hashicorp/hcl v1.0.0 // indirect
 	github.com/magiconair/properties v1.8.7 // indirect
 	github.com/mitchellh/mapstructure v1.5.0 // indirect
@@ -24,9 +29,9 @@ require (
 	github.com/spf13/viper v1.19.0 // indirect
 	github.com/subosito/gotenv v1.6.0 // indirect
 	go.uber.org/multierr v1.11.0 // indirect
+	golang.org/x/crypto v0.25.0 // indirect
 	golang.org/x/exp v0.0.0-20240719175910-8a7402abbf56 // indirect
 	golang.org/x/sys v0.22.0 // indirect
 	golang.org/x/text v0.16.0 // indirect
 	gopkg.in/ini.v1 v1.67.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,230 @@
+// Copyright 2024 Ajabep
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package access restricts who can use the proxy
+package access
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/ajabep/unmtlsproxy/internal/log"
+)
+
+var ErrInvalidPreamble = errors.New("invalid preamble")
+
+// Time left to the clients to send the preamble
+const preambleTimeout = 10 * time.Second
+
+// Filter allows or denies the clients depending on their IP address.
+type Filter struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// NewFilter returns a filter denying the addresses in one of the `deny`
+// prefixes, then, if `allow` is not empty, the ones not in any of the `allow`
+// prefixes.
+func NewFilter(allow, deny []netip.Prefix) *Filter {
+	return &Filter{
+		allow: allow,
+		deny:  deny,
+	}
+}
+
+// IsEmpty returns if the filter allows everyone.
+func (f *Filter) IsEmpty() bool {
+	return len(f.allow) == 0 && len(f.deny) == 0
+}
+
+// Allowed returns if the client address is allowed. Non-IP addresses, such as
+// Unix sockets, are always allowed.
+func (f *Filter) Allowed(addr net.Addr) bool {
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return true
+	}
+	ip := addrPort.Addr().Unmap()
+
+	for _, prefix := range f.deny {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, prefix := range f.allow {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Listener returns a listener closing, as soon as they are accepted, the
+// connections of the clients which are not allowed.
+func (f *Filter) Listener(l net.Listener) net.Listener {
+	if f.IsEmpty() {
+		return l
+	}
+	return &filteredListener{Listener: l, filter: f}
+}
+
+type filteredListener struct {
+	net.Listener
+	filter *Filter
+}
+
+func (l *filteredListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.filter.Allowed(conn.RemoteAddr()) {
+			return conn, nil
+		}
+		log.Warn("Rejected a connection from a denied address", "client", conn.RemoteAddr())
+		_ = conn.Close()
+	}
+}
+
+// Authenticator checks the credentials sent by the HTTP clients.
+type Authenticator struct {
+	basic   map[string]string
+	bearers []string
+}
+
+// NewAuthenticator returns an authenticator accepting the given Basic
+// credentials, user to password, and the given bearer tokens.
+func NewAuthenticator(basic map[string]string, bearers []string) *Authenticator {
+	return &Authenticator{
+		basic:   basic,
+		bearers: bearers,
+	}
+}
+
+// IsEmpty returns if the authenticator accepts everyone.
+func (a *Authenticator) IsEmpty() bool {
+	return len(a.basic) == 0 && len(a.bearers) == 0
+}
+
+// authenticated returns if the Authorization, or Proxy-Authorization, header
+// holds valid credentials.
+func (a *Authenticator) authenticated(authorization string) bool {
+	scheme, credentials, found := strings.Cut(authorization, " ")
+	if !found {
+		return false
+	}
+	credentials = strings.TrimSpace(credentials)
+
+	if strings.EqualFold(scheme, "Basic") {
+		decoded, err := base64.StdEncoding.DecodeString(credentials)
+		if err != nil {
+			return false
+		}
+		user, password, found := strings.Cut(string(decoded), ":")
+		return found && a.CheckBasic(user, password)
+	}
+
+	if !strings.EqualFold(scheme, "Bearer") {
+		return false
+	}
+	valid := false
+	for _, bearer := range a.bearers {
+		// Compare with all the tokens, to not leak which one matched
+		if equal(credentials, bearer) {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// CheckBasic returns if the Basic credentials are valid. It is also meant to
+// check the credentials of other protocols, such as SOCKS5.
+func (a *Authenticator) CheckBasic(user, password string) bool {
+	expected, has := a.basic[user]
+	return has && equal(password, expected)
+}
+
+// Handler returns a handler answering 401 to the requests without valid
+// credentials. The credentials are consumed: the Authorization header is not
+// forwarded to the backend.
+func (a *Authenticator) Handler(next http.Handler) http.Handler {
+	return a.handler(next, "Authorization", "WWW-Authenticate", http.StatusUnauthorized)
+}
+
+// ProxyHandler is the same as Handler, for the clients using the proxy as
+// such: the credentials are in the Proxy-Authorization header, and 407 is
+// answered. The Authorization header is left to the backend.
+func (a *Authenticator) ProxyHandler(next http.Handler) http.Handler {
+	return a.handler(next, "Proxy-Authorization", "Proxy-Authenticate", http.StatusProxyAuthRequired)
+}
+
+func (a *Authenticator) handler(next http.Handler, header, challengeHeader string, status int) http.Handler {
+	if a.IsEmpty() {
+		return next
+	}
+
+	challenge := []string{}
+	if len(a.basic) != 0 {
+		challenge = append(challenge, `Basic realm="unmtlsproxy", charset="UTF-8"`)
+	}
+	if len(a.bearers) != 0 {
+		challenge = append(challenge, `Bearer realm="unmtlsproxy"`)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !a.authenticated(req.Header.Get(header)) {
+			log.Warn("Rejected a request without valid credentials", "client", req.RemoteAddr, "method", req.Method, "url", req.URL)
+			for _, c := range challenge {
+				w.Header().Add(challengeHeader, c)
+			}
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		req.Header.Del(header)
+		next.ServeHTTP(w, req)
+	})
+}
+
+// CheckPreamble reads the shared secret, followed by a line feed, the client
+// has to send before its data. Nothing else is read.
+func CheckPreamble(conn net.Conn, secret string) error {
+	if err := conn.SetReadDeadline(time.Now().Add(preambleTimeout)); err != nil {
+		return err
+	}
+	preamble := make([]byte, len(secret)+1)
+	if _, err := io.ReadFull(conn, preamble); err != nil {
+		return errors.Join(ErrInvalidPreamble, err)
+	}
+	if !equal(string(preamble), secret+"\n") {
+		return ErrInvalidPreamble
+	}
+	return conn.SetReadDeadline(time.Time{})
+}
+
+// equal compares secrets in constant time. Hashing them first also hides their
+// length.
+func equal(a, b string) bool {
+	ha := sha256.Sum256([]byte(a))
+	hb := sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
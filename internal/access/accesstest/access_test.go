@@ -0,0 +1,174 @@
+package accesstest
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/ajabep/unmtlsproxy/internal/access"
+)
+
+func TestFilter(t *testing.T) {
+	allow := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("::1/128")}
+	deny := []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")}
+
+	testcases := []struct {
+		filter  *access.Filter
+		addr    net.Addr
+		allowed bool
+	}{
+		{access.NewFilter(nil, nil), &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}, true},
+		{access.NewFilter(allow, deny), &net.TCPAddr{IP: net.ParseIP("10.2.3.4")}, true},
+		{access.NewFilter(allow, deny), &net.TCPAddr{IP: net.ParseIP("::ffff:10.2.3.4")}, true},
+		{access.NewFilter(allow, deny), &net.TCPAddr{IP: net.ParseIP("::1")}, true},
+		{access.NewFilter(allow, deny), &net.TCPAddr{IP: net.ParseIP("10.1.2.3")}, false},
+		{access.NewFilter(allow, deny), &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}, false},
+		{access.NewFilter(nil, deny), &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}, true},
+		{access.NewFilter(nil, deny), &net.TCPAddr{IP: net.ParseIP("10.1.2.3")}, false},
+		{access.NewFilter(allow, deny), &net.UnixAddr{Name: "/run/unmtlsproxy.sock", Net: "unix"}, true},
+	}
+	for _, testcase := range testcases {
+		if allowed := testcase.filter.Allowed(testcase.addr); allowed != testcase.allowed {
+			t.Errorf("%s: expected allowed=%t, got %t", testcase.addr, testcase.allowed, allowed)
+		}
+	}
+}
+
+func TestFilterListener(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter := access.NewFilter(nil, []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")})
+	listener = filter.Listener(listener)
+	defer listener.Close()
+
+	go func() {
+		_, _ = listener.Accept()
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("The denied connection has not been closed: %v", err)
+	}
+}
+
+func TestAuthenticator(t *testing.T) {
+	authenticator := access.NewAuthenticator(map[string]string{"blahaj": "hugs"}, []string{"s3cr3t"})
+	handler := authenticator.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "" {
+			t.Errorf("The Authorization header has been forwarded")
+		}
+	}))
+
+	testcases := []struct {
+		name          string
+		authorization string
+		status        int
+	}{
+		{"no credentials", "", http.StatusUnauthorized},
+		{"valid basic", "Basic YmxhaGFqOmh1Z3M=", http.StatusOK},
+		{"invalid basic", "Basic YmxhaGFqOmJpdGVz", http.StatusUnauthorized},
+		{"valid bearer", "Bearer s3cr3t", http.StatusOK},
+		{"valid bearer, lower case scheme", "bearer s3cr3t", http.StatusOK},
+		{"invalid bearer", "Bearer s3cr3", http.StatusUnauthorized},
+		{"unknown scheme", "Digest s3cr3t", http.StatusUnauthorized},
+	}
+	for _, testcase := range testcases {
+		req := httptest.NewRequest(http.MethodGet, "http://proxy.example/", nil)
+		if testcase.authorization != "" {
+			req.Header.Set("Authorization", testcase.authorization)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != testcase.status {
+			t.Errorf("%s: expected status %d, got %d", testcase.name, testcase.status, rec.Code)
+		}
+		if rec.Code == http.StatusUnauthorized && len(rec.Header().Values("WWW-Authenticate")) != 2 {
+			t.Errorf("%s: missing challenges: %v", testcase.name, rec.Header().Values("WWW-Authenticate"))
+		}
+	}
+}
+
+func TestProxyAuthenticator(t *testing.T) {
+	authenticator := access.NewAuthenticator(map[string]string{"blahaj": "hugs"}, []string{"s3cr3t"})
+	handler := authenticator.ProxyHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Proxy-Authorization") != "" {
+			t.Errorf("The Proxy-Authorization header has been forwarded")
+		}
+		if req.Header.Get("Authorization") != "Basic b3RoZXI6dXNlcg==" {
+			t.Errorf("The Authorization header has not been forwarded")
+		}
+	}))
+
+	testcases := []struct {
+		name          string
+		authorization string
+		status        int
+	}{
+		{"no credentials", "", http.StatusProxyAuthRequired},
+		{"valid basic", "Basic YmxhaGFqOmh1Z3M=", http.StatusOK},
+		{"invalid basic", "Basic YmxhaGFqOmJpdGVz", http.StatusProxyAuthRequired},
+		{"invalid base64", "Basic YmxhaGFqOmh1Z3M", http.StatusProxyAuthRequired},
+		{"valid bearer", "Bearer s3cr3t", http.StatusOK},
+		{"valid bearer, lower case scheme", "bearer s3cr3t", http.StatusOK},
+		{"invalid bearer", "Bearer s3cr3", http.StatusProxyAuthRequired},
+		{"unknown scheme", "Digest s3cr3t", http.StatusProxyAuthRequired},
+	}
+	for _, testcase := range testcases {
+		req := httptest.NewRequest(http.MethodGet, "http://backend.example/", nil)
+		// The credentials of the backend are not the ones of the proxy
+		req.Header.Set("Authorization", "Basic b3RoZXI6dXNlcg==")
+		if testcase.authorization != "" {
+			req.Header.Set("Proxy-Authorization", testcase.authorization)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != testcase.status {
+			t.Errorf("%s: expected status %d, got %d", testcase.name, testcase.status, rec.Code)
+		}
+		if rec.Code == http.StatusProxyAuthRequired && len(rec.Header().Values("Proxy-Authenticate")) != 2 {
+			t.Errorf("%s: missing challenges: %v", testcase.name, rec.Header().Values("Proxy-Authenticate"))
+		}
+	}
+}
+
+func TestCheckPreamble(t *testing.T) {
+	testcases := []struct {
+		sent     string
+		expected error
+	}{
+		{"s3cr3t\nPING", nil},
+		{"s3cr3T\nPING", access.ErrInvalidPreamble},
+		{"s3cr3t PING", access.ErrInvalidPreamble},
+		{"s3c", access.ErrInvalidPreamble},
+	}
+	for _, testcase := range testcases {
+		server, client := net.Pipe()
+		go func() {
+			_, _ = client.Write([]byte(testcase.sent))
+			_ = client.Close()
+		}()
+
+		err := access.CheckPreamble(server, "s3cr3t")
+		if !errors.Is(err, testcase.expected) {
+			t.Errorf("%q: expected error %v, got %v", testcase.sent, testcase.expected, err)
+		}
+		if err == nil {
+			// The data following the preamble is left untouched
+			data, _ := io.ReadAll(server)
+			if string(data) != "PING" {
+				t.Errorf("%q: unexpected data after the preamble: %q", testcase.sent, data)
+			}
+		}
+		_ = server.Close()
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2024 Ajabep
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configuration
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+var (
+	ErrNonLoopbackListen      = errors.New("listening on a non-loopback address exposes the backend, without mTLS, to anyone reaching this address. Restrict it with `allow-cidr`, `auth-basic`, `auth-bearer` or `tcp-preamble`, and use `i-know-what-i-am-doing` to confirm")
+	ErrInvalidCIDR            = errors.New("invalid CIDR. Use `address/bits` or `address`")
+	ErrInvalidBasicAuthFormat = errors.New("invalid Basic credentials format. Use `user:password`")
+	ErrAuthInTCPMode          = errors.New("options `auth-basic` and `auth-bearer` are only valid in HTTP and forward modes, and `auth-basic` in socks5 mode. Use `tcp-preamble` in TCP mode")
+	ErrAuthProxyHeaderMode    = errors.New("option `auth-proxy-header` is only valid in HTTP mode. The forward mode always uses the Proxy-Authorization header")
+	ErrPreambleInHTTPMode     = errors.New("option `tcp-preamble` is only valid in TCP mode. Use `auth-basic` or `auth-bearer` in the other modes")
+)
+
+// isLoopback returns if the listening hostname only accepts local clients.
+func isLoopback(hostname string) bool {
+	if strings.EqualFold(hostname, "localhost") {
+		return true
+	}
+	ip, err := netip.ParseAddr(hostname)
+	return err == nil && ip.Unmap().IsLoopback()
+}
+
+func parseCIDRs(values []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, value := range slices.DeleteFunc(values, isEmpty) {
+		if ip, err := netip.ParseAddr(value); err == nil {
+			ip = ip.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidCIDR, value)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// parseAccess parses the options restricting who can use the proxy.
+func (c *Configuration) parseAccess() error {
+	var err error
+	if c.ParsedAllowCIDRs, err = parseCIDRs(c.AllowCIDRs); err != nil {
+		return err
+	}
+	if c.ParsedDenyCIDRs, err = parseCIDRs(c.DenyCIDRs); err != nil {
+		return err
+	}
+
+	c.AuthBearers = slices.DeleteFunc(c.AuthBearers, isEmpty)
+	c.ParsedBasicAuth = map[string]string{}
+	for _, value := range slices.DeleteFunc(c.AuthBasic, isEmpty) {
+		user, password, found := strings.Cut(value, ":")
+		if !found || user == "" || password == "" {
+			return ErrInvalidBasicAuthFormat
+		}
+		c.ParsedBasicAuth[user] = password
+	}
+
+	if (c.Mode == "tcp" && len(c.ParsedBasicAuth) != 0) || (!c.isHTTP() && len(c.AuthBearers) != 0) {
+		return ErrAuthInTCPMode
+	}
+	if c.AuthProxyHeader && c.Mode != "http" {
+		return ErrAuthProxyHeaderMode
+	}
+	if c.Mode != "tcp" && c.TCPPreamble != "" {
+		return ErrPreambleInHTTPMode
+	}
+
+	// Unix sockets are only reachable from this host
+	if !c.ParsedListen.IsUnix() && !isLoopback(c.ParsedListen.Hostname) && !c.IKnowWhatIAmDoing {
+		return fmt.Errorf("%w: %s", ErrNonLoopbackListen, c.ParsedListen)
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+// Copyright 2024 Ajabep
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configuration
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/ajabep/unmtlsproxy/internal/log"
+	"github.com/ajabep/unmtlsproxy/internal/pkcs11key"
+	"go.aporeto.io/tg/tglib"
+)
+
+const (
+	certificateDirCertSuffix = ".crt.pem"
+	certificateDirKeySuffix  = ".key.pem"
+)
+
+// withLeaf makes sure the leaf of the certificate is parsed, to be able to
+// describe it in the logs without parsing it on every handshake.
+func withLeaf(tc tls.Certificate) (tls.Certificate, error) {
+	if tc.Leaf != nil || len(tc.Certificate) == 0 {
+		return tc, nil
+	}
+	leaf, err := x509.ParseCertificate(tc.Certificate[0])
+	if err != nil {
+		return tc, err
+	}
+	tc.Leaf = leaf
+	return tc, nil
+}
+
+// loadServerCAPool reads the CAs used to verify the server certificate, if
+// any.
+func (c *Configuration) loadServerCAPool() (*x509.CertPool, error) {
+	if !c.ServerCAVerify {
+		return nil, nil
+	}
+	return loadCAPool(c.SystemRoots, c.ServerCAPoolPath)
+}
+
+// loadCAPool reads the system CAs, if requested, and the CAs of the file, if
+// any.
+func loadCAPool(systemRoots bool, path string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if systemRoots {
+		log.Debug("Reading the system CAs")
+		var err error
+		if pool, err = x509.SystemCertPool(); err != nil {
+			return nil, err
+		}
+	}
+
+	if path != "" {
+		log.Debug("Reading the server CA", "serverCAPoolPath", path)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		// A file being written is not an empty set of CAs
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%w: %s", ErrNoCertificateInFile, path)
+		}
+	}
+	return pool, nil
+}
+
+// loadClientCertificates reads all the client certificates, and the named
+// ones. The password of the PKCS#12 bundle is prompted only if allowed.
+func (c *Configuration) loadClientCertificates(prompt bool) ([]tls.Certificate, map[string]tls.Certificate, error) {
+	var certificates []tls.Certificate
+
+	for i, certPath := range c.ClientCertificatePaths {
+		keyPath := c.ClientCertificateKeyPaths[i]
+		log.Debug("Reading the client certificate and keys", "ClientCertificatePath", certPath, "ClientCertificateKeyPath", pkcs11key.Redact(keyPath))
+		tc, err := loadPEMCertificate(certPath, keyPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		certificates = append(certificates, tc)
+	}
+
+	if c.ClientCertificateDir != "" {
+		log.Debug("Reading the client certificate directory", "ClientCertificateDir", c.ClientCertificateDir)
+		tcs, err := loadCertificateDir(c.ClientCertificateDir)
+		if err != nil {
+			return nil, nil, err
+		}
+		certificates = append(certificates, tcs...)
+	}
+
+	if c.ClientCertificateP12Path != "" {
+		log.Debug("Reading the client PKCS#12 bundle", "ClientCertificateP12Path", c.ClientCertificateP12Path)
+		tc, err := c.loadP12Certificate(prompt)
+		if err != nil {
+			return nil, nil, err
+		}
+		certificates = append(certificates, tc)
+	}
+
+	named := make(map[string]tls.Certificate, len(c.namedIdentities))
+	for _, id := range c.namedIdentities {
+		log.Debug("Reading the named client certificate and keys", "identity", id.name, "ClientCertificatePath", id.certPath, "ClientCertificateKeyPath", pkcs11key.Redact(id.keyPath))
+		tc, err := loadPEMCertificate(id.certPath, id.keyPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot load the identity %s: %w", id.name, err)
+		}
+		named[id.name] = tc
+		// Named identities are also candidates when no identity is requested
+		certificates = append(certificates, tc)
+	}
+
+	if len(certificates) == 0 {
+		return nil, nil, ErrMissingClientCertificate
+	}
+	log.Debug("Loaded the client certificates", "count", len(certificates))
+
+	return certificates, named, nil
+}
+
+// loadPEMCertificate reads a PEM certificate, with its chain, and its PEM key.
+// The key can also be a PKCS#11 URI.
+func loadPEMCertificate(certPath, keyPath string) (tls.Certificate, error) {
+	if pkcs11key.IsURI(keyPath) {
+		return loadPKCS11Certificate(certPath, keyPath)
+	}
+
+	certs, key, err := tglib.ReadCertificatePEMs(certPath, keyPath, "")
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	tc, err := tglib.ToTLSCertificates(certs, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return withLeaf(tc)
+}
+
+// loadPKCS11Certificate reads a PEM certificate, with its chain, whose key is
+// held by a PKCS#11 token.
+func loadPKCS11Certificate(certPath, keyURI string) (tls.Certificate, error) {
+	data, err := os.ReadFile(certPath)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	tc := tls.Certificate{}
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			tc.Certificate = append(tc.Certificate, block.Bytes)
+		}
+	}
+	if len(tc.Certificate) == 0 {
+		return tls.Certificate{}, fmt.Errorf("%w: %s", ErrNoCertificateInFile, certPath)
+	}
+	if tc, err = withLeaf(tc); err != nil {
+		return tls.Certificate{}, err
+	}
+
+	log.Debug("Loading the PKCS#11 client key", "ClientCertificatePath", certPath)
+	if tc.PrivateKey, err = pkcs11key.NewSigner(keyURI, tc.Leaf.PublicKey); err != nil {
+		return tls.Certificate{}, err
+	}
+	return tc, nil
+}
+
+// loadCertificateDir reads every `<name>.crt.pem` certificate of a directory,
+// with its `<name>.key.pem` key.
+func loadCertificateDir(dir string) ([]tls.Certificate, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), certificateDirCertSuffix) {
+			continue
+		}
+		names = append(names, strings.TrimSuffix(entry.Name(), certificateDirCertSuffix))
+	}
+	sort.Strings(names)
+
+	if len(names) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrEmptyClientCertificateDir, dir)
+	}
+
+	certificates := make([]tls.Certificate, 0, len(names))
+	for _, name := range names {
+		certPath := filepath.Join(dir, name+certificateDirCertSuffix)
+		keyPath := filepath.Join(dir, name+certificateDirKeySuffix)
+		log.Debug("Reading a client certificate from the directory", "ClientCertificatePath", certPath, "ClientCertificateKeyPath", pkcs11key.Redact(keyPath))
+		tc, err := loadPEMCertificate(certPath, keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load the client certificate %s: %w", certPath, err)
+		}
+		certificates = append(certificates, tc)
+	}
+	return certificates, nil
+}
+
+// namedIdentity is a client certificate selectable by its name.
+type namedIdentity struct {
+	name     string
+	certPath string
+	keyPath  string
+}
+
+// parseIdentities parses the `name=cert,key` named identities. Since the
+// values may have been split on commas, a value without `=` is the
+// continuation of the previous one.
+func parseIdentities(values []string) ([]namedIdentity, error) {
+	var names []string
+	var paths [][]string
+
+	for _, value := range values {
+		name, path, found := strings.Cut(value, "=")
+		if !found {
+			if len(paths) == 0 {
+				return nil, fmt.Errorf("%w: %s", ErrInvalidIdentityFormat, value)
+			}
+			paths[len(paths)-1] = append(paths[len(paths)-1], value)
+			continue
+		}
+		names = append(names, name)
+		paths = append(paths, strings.Split(path, ","))
+	}
+
+	identities := make([]namedIdentity, 0, len(names))
+	for i, name := range names {
+		if name == "" || len(paths[i]) != 2 || paths[i][0] == "" || paths[i][1] == "" {
+			return nil, fmt.Errorf("%w: %s=%s", ErrInvalidIdentityFormat, name, strings.Join(paths[i], ","))
+		}
+		if slices.Contains(names[:i], name) {
+			return nil, fmt.Errorf("%w: %s", ErrDuplicatedIdentity, name)
+		}
+		identities = append(identities, namedIdentity{
+			name:     name,
+			certPath: paths[i][0],
+			keyPath:  paths[i][1],
+		})
+	}
+	return identities, nil
+}
@@ -15,60 +15,227 @@ package configuration
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"log/slog"
+	"net/netip"
 	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/ajabep/unmtlsproxy/internal/log"
+	"github.com/ajabep/unmtlsproxy/internal/mint"
+	"github.com/ajabep/unmtlsproxy/internal/pkcs11key"
+	"github.com/ajabep/unmtlsproxy/internal/scope"
+	"github.com/ajabep/unmtlsproxy/internal/upstream"
+	"github.com/ajabep/unmtlsproxy/internal/verify"
 	"go.aporeto.io/addedeffect/lombric"
-	"go.aporeto.io/tg/tglib"
 )
 
 type Addr struct {
 	Hostname string
 	Port     uint16
+	// UnixPath is the path of the Unix socket, or its name prefixed by `@`
+	// for an abstract socket. Hostname and Port are unused when it is set.
+	UnixPath string
 }
 
 func (a Addr) String() string {
+	if a.IsUnix() {
+		return unixListenPrefix + a.UnixPath
+	}
 	return fmt.Sprintf("%s:%d", a.Hostname, a.Port)
 }
 
+// IsUnix returns if the address is a Unix socket.
+func (a Addr) IsUnix() bool {
+	return a.UnixPath != ""
+}
+
+// IsAbstract returns if the address is a Linux abstract Unix socket.
+func (a Addr) IsAbstract() bool {
+	return strings.HasPrefix(a.UnixPath, "@")
+}
+
+// Network returns the network of the address, as expected by `net.Listen`.
+func (a Addr) Network() string {
+	if a.IsUnix() {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// Address returns the address, as expected by `net.Listen`.
+func (a Addr) Address() string {
+	if a.IsUnix() {
+		return a.UnixPath
+	}
+	return a.String()
+}
+
 // Configuration hold the service configuration.
 type Configuration struct {
-	BackendAddress           string `mapstructure:"backend"                desc:"destination host. Format: host:port"                                                                                           required:"true"`
-	ServerCAPoolPath         string `mapstructure:"server-ca"              desc:"Path the CAs used to verify server certificate. If not set, does not verify the server certificate."                           default:""`
-	ListenAddress            string `mapstructure:"listen"                 desc:"Listening address"                                                                                                             default:":443"`
-	ClientCertificateKeyPath string `mapstructure:"cert-key"               desc:"Path to the client certificate key"                                                                                            required:"true"`
-	ClientCertificatePath    string `mapstructure:"cert"                   desc:"Path to the client certificate"                                                                                                required:"true"`
-	Mode                     string `mapstructure:"mode"                   desc:"Proxy mode"                                                                                                                    default:"tcp" allowed:"tcp,http"`
-	LogLevel                 string `mapstructure:"log-level"              desc:"Log level"                                                                                                                     default:"info" allowed:"debug,info"`
-	UnsafeKeyLogPath         string `mapstructure:"unsafe-key-log-path"    desc:"[UNSAFE] Path of the file where session keys are dumped. Useful for debugging"                                                 default:""`
-	DisableSocketReusing     bool   `mapstructure:"disable-socket-reusing" desc:"Disable the TLS socket reusing. Useful for debugging the HTTP mode. Not valid with the TCP mode (1 TCP socket = 1 TLS socket)" default:"false"`
+	BackendAddress                   string        `mapstructure:"backend"                desc:"destination host. Format: host:port. Not used in forward and socks5 modes"`
+	ServerCAPoolPath                 string        `mapstructure:"server-ca"              desc:"Path the CAs used to verify server certificate. If not set, and without --system-roots, does not verify the server certificate."                                                                                                                        default:""`
+	SystemRoots                      bool          `mapstructure:"system-roots"           desc:"Verify the server certificate with the system CAs, in addition to the --server-ca ones"                                                                                                                                                                 default:"false"`
+	SNI                              string        `mapstructure:"sni"                    desc:"Server name sent in the TLS handshake. Defaults to the backend hostname"                                                                                                                                                                                default:""`
+	VerifyHostname                   string        `mapstructure:"verify-hostname"        desc:"Name the server certificate has to be valid for. Defaults to the SNI option, else to the host of the backend, IP addresses included. Requires a verified server certificate"                                                                            default:""`
+	PinnedSPKIs                      []string      `mapstructure:"pin-spki"               desc:"Pinned server public key, as sha256/<base64 of the SHA-256 of the SPKI>. Repeatable. Also works without verifying the server certificate"`
+	UpstreamProxy                    string        `mapstructure:"upstream-proxy"         desc:"Proxy the connections to the backends go through: http://[user:password@]host:port, with CONNECT tunnels, https://, socks5:// or socks5h://. If not set, the HTTP and forward modes use the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables" default:""`
+	ListenAddress                    string        `mapstructure:"listen"                 desc:"Listening address, as host:port, unix:/path or unix:@abstract-name. Listening on a non-loopback address requires --i-know-what-i-am-doing"                                                                                                              default:"127.0.0.1:443"`
+	ListenUnixMode                   string        `mapstructure:"listen-unix-mode"       desc:"Permissions of the Unix socket file, in octal. Defaults to 0600"                                                                                                                                                                                        default:""`
+	ListenUnixOwner                  string        `mapstructure:"listen-unix-owner"      desc:"Owner of the Unix socket file, as user[:group], by name or ID"                                                                                                                                                                                          default:""`
+	ListenCertificatePath            string        `mapstructure:"listen-cert"            desc:"Path to the PEM certificate, with its chain, presented to the clients of the proxy. Enables TLS on the listening side"                                                                                                                                  default:""`
+	ListenKeyPath                    string        `mapstructure:"listen-key"             desc:"Path to the PEM key of --listen-cert"                                                                                                                                                                                                                   default:""`
+	ListenAutoTLS                    bool          `mapstructure:"listen-auto-tls"        desc:"Enable TLS on the listening side, with a certificate issued on the fly for each server name requested by the clients"                                                                                                                                   default:"false"`
+	ListenCACertificatePath          string        `mapstructure:"listen-ca-cert"         desc:"Path to the PEM certificate of the CA issuing the --listen-auto-tls certificates. If not set, a CA is generated at startup"                                                                                                                             default:""`
+	ListenCAKeyPath                  string        `mapstructure:"listen-ca-key"          desc:"Path to the PEM key of --listen-ca-cert"                                                                                                                                                                                                                default:""`
+	ListenCAExportPath               string        `mapstructure:"listen-ca-export"       desc:"Path where the PEM certificate of the --listen-auto-tls CA is written, to be trusted by the clients"                                                                                                                                                    default:""`
+	AllowCIDRs                       []string      `mapstructure:"allow-cidr"             desc:"Only accept the clients from this CIDR, or address. Repeatable"`
+	DenyCIDRs                        []string      `mapstructure:"deny-cidr"              desc:"Reject the clients from this CIDR, or address, even if allowed by --allow-cidr. Repeatable"`
+	AuthBasic                        []string      `mapstructure:"auth-basic"             desc:"In HTTP mode, only accept the requests with these Basic credentials. Format: user:password. Repeatable. The Authorization header is not forwarded, unless --auth-proxy-header is set"`
+	AuthBearers                      []string      `mapstructure:"auth-bearer"            desc:"In HTTP mode, only accept the requests with this bearer token. Repeatable. The Authorization header is not forwarded, unless --auth-proxy-header is set"`
+	AuthProxyHeader                  bool          `mapstructure:"auth-proxy-header"      desc:"In HTTP mode, take the --auth-basic and --auth-bearer credentials from the Proxy-Authorization header, and answer 407, to leave the Authorization header to the backend. Always the case in forward mode"                                               default:"false"`
+	TCPPreamble                      string        `mapstructure:"tcp-preamble"           desc:"In TCP mode, only accept the clients sending this secret, followed by a line feed, before their data. It is not forwarded"                                                                                                                              default:""`
+	TCPErrorStyle                    string        `mapstructure:"tcp-error-style"        desc:"In TCP mode, how the clients are told the backend is unreachable: close the connection, reset it, or answer an error in the protocol of the backend: http (502 response), postgres (ErrorResponse) or smtp (421 reply). The error is logged"            default:"close" allowed:"close,reset,http,postgres,smtp"`
+	MaxConnections                   int           `mapstructure:"max-connections"        desc:"In TCP and socks5 modes, maximum number of connections handled at once. 0 for no limit"                                                                                                                                                                 default:"0"`
+	MaxConnectionsPolicy             string        `mapstructure:"max-connections-policy" desc:"In TCP and socks5 modes, handling of the connections over --max-connections: queue leaves them in the listen backlog until a connection ends, reject closes them at once"                                                                               default:"queue" allowed:"queue,reject"`
+	IKnowWhatIAmDoing                bool          `mapstructure:"i-know-what-i-am-doing" desc:"Confirm that listening on a non-loopback address, thus exposing the backend without mTLS, is intended"                                                                                                                                                  default:"false"`
+	ClientCertificateKeyPaths        []string      `mapstructure:"cert-key"               desc:"Path to the client certificate key, or PKCS#11 URI of the key (RFC 7512, with module-path). Repeat it, with --cert, to use several client certificates"`
+	ClientCertificatePaths           []string      `mapstructure:"cert"                   desc:"Path to the client certificate. Repeat it, with --cert-key, to use several client certificates"`
+	ClientCertificateDir             string        `mapstructure:"cert-dir"               desc:"Path to a directory of client certificates, as <name>.crt.pem files with their <name>.key.pem keys"                                                                                                                                                     default:""`
+	ClientCertificateP12Path         string        `mapstructure:"cert-p12"               desc:"Path to a PKCS#12 bundle holding the client certificate, its key and its chain"                                                                                                                                                                         default:""`
+	ClientCertificateP12PasswordEnv  string        `mapstructure:"cert-p12-password-env"  desc:"Name of the environment variable holding the password of the PKCS#12 bundle"                                                                                                                                                                            default:""`
+	ClientCertificateP12PasswordFile string        `mapstructure:"cert-p12-password-file" desc:"Path to a file holding the password of the PKCS#12 bundle. If no password source is set, it is prompted when needed"                                                                                                                                    default:""`
+	Identities                       []string      `mapstructure:"identity"               desc:"Named client certificate, selectable per request in HTTP mode with the identity header. Format: name=cert,key. Repeatable"`
+	IdentityHeader                   string        `mapstructure:"identity-header"        desc:"Header used, in HTTP mode, to select a named client certificate. It is never sent to the backend"                                                                                                                                                       default:"X-Unmtls-Identity"`
+	NoForwardedHeaders               bool          `mapstructure:"no-forwarded-headers"   desc:"In HTTP mode, do not send the X-Forwarded-For, X-Forwarded-Host, X-Forwarded-Proto and Forwarded headers to the backend"                                                                                                                                default:"false"`
+	RewriteURLs                      bool          `mapstructure:"rewrite-urls"           desc:"In HTTP mode, rewrite the backend URLs of the Location, Content-Location and Refresh headers to the proxy ones, and scope the cookies to the proxy"                                                                                                     default:"false"`
+	RewriteBodies                    bool          `mapstructure:"rewrite-bodies"         desc:"In HTTP mode, also rewrite the backend URLs of the HTML and JSON bodies. Requires --rewrite-urls"                                                                                                                                                       default:"false"`
+	RewriteBodyMaxSize               int           `mapstructure:"rewrite-body-max-size"  desc:"Size, in bytes, above which the bodies are not rewritten"                                                                                                                                                                                               default:"10485760"`
+	HAROutPath                       string        `mapstructure:"har-out"                desc:"In HTTP and forward modes, path of the HAR file where the exchanges with the backends are written, on shutdown. On SIGUSR1 (Unix only), and every --har-max-entries exchanges, the capture is rotated to a numbered file next to it"                    default:""`
+	HARBodyMaxSize                   int           `mapstructure:"har-body-max-size"      desc:"Size, in bytes, above which the bodies are truncated in the HAR capture"                                                                                                                                                                                default:"1048576"`
+	HARMaxEntries                    int           `mapstructure:"har-max-entries"        desc:"Number of exchanges after which the HAR capture is rotated, the capture being kept in memory until then. 0 to only rotate it on SIGUSR1 (Unix only)"                                                                                                    default:"1000"`
+	RoutesPath                       string        `mapstructure:"routes"                 desc:"In HTTP mode, path to a YAML file of routes sending the requests to other backends, by Host header and path prefix. The requests matching no route go to --backend"                                                                                     default:""`
+	Scope                            []string      `mapstructure:"scope"                  desc:"In forward and socks5 modes, destinations the proxy can connect to: host, *.domain, *, IP address or CIDR, optionally followed by :port. Repeatable"`
+	DestinationIdentities            []string      `mapstructure:"dest-identity"          desc:"In forward and socks5 modes, named client certificate used for the destinations matching the pattern, in the --scope format. Format: pattern=name. Repeatable. The first match is used"`
+	ForwardIntercept                 bool          `mapstructure:"forward-intercept"      desc:"In forward mode, intercept the CONNECT tunnels: their TLS is terminated with certificates issued by the --listen-ca-cert CA, or a generated one, and their requests get the client certificates. Otherwise, the tunnels are passed through"             default:"false"`
+	H2C                              bool          `mapstructure:"h2c"                    desc:"In HTTP mode, also accept cleartext HTTP/2 (h2c) on the listener, with prior knowledge or Upgrade. Useful for gRPC clients"                                                                                                                             default:"false"`
+	Mode                             string        `mapstructure:"mode"                   desc:"Proxy mode. The forward mode is an HTTP proxy, and the socks5 mode a SOCKS5 proxy, connecting to the --scope destinations"                                                                                                                              default:"tcp" allowed:"tcp,http,forward,socks5"`
+	LogLevel                         string        `mapstructure:"log-level"              desc:"Log level"                                                                                                                                                                                                                                              default:"info" allowed:"debug,info"`
+	UnsafeKeyLogPath                 string        `mapstructure:"unsafe-key-log-path"    desc:"[UNSAFE] Path of the file where session keys are dumped. Useful for debugging"                                                                                                                                                                          default:""`
+	TLSMinVersion                    string        `mapstructure:"tls-min-version"        desc:"Minimum TLS version used with the backend: 1.0, 1.1, 1.2 or 1.3. Defaults to the Go default"                                                                                                                                                            default:""`
+	TLSMaxVersion                    string        `mapstructure:"tls-max-version"        desc:"Maximum TLS version used with the backend: 1.0, 1.1, 1.2 or 1.3. Defaults to the Go default"                                                                                                                                                            default:""`
+	TLSCipherSuites                  []string      `mapstructure:"tls-cipher-suites"      desc:"TLS 1.0-1.2 cipher suites, by IANA name (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256), including insecure ones. Defaults to the Go default"`
+	TLSCurves                        []string      `mapstructure:"tls-curves"             desc:"Allowed key exchanges, whatever their order: X25519, CurveP256, CurveP384, CurveP521, and, depending on the Go version of the build, X25519MLKEM768, SecP256r1MLKEM768 and SecP384r1MLKEM1024. Defaults to the Go default"`
+	ALPN                             []string      `mapstructure:"alpn"                   desc:"ALPN protocols offered to the backend. In HTTP mode, only h2 and http/1.1 are supported, and HTTP/2 is used unless h2 is left out"`
+	TLSRenegotiation                 string        `mapstructure:"tls-renegotiation"      desc:"Renegotiation policy: never, once or freely"                                                                                                                                                                                                            default:"freely" allowed:"never,once,freely"`
+	ShutdownTimeout                  time.Duration `mapstructure:"shutdown-timeout"       desc:"On SIGINT or SIGTERM, time left to the active connections to end, before they are closed. A second signal closes them at once. The exit status is 2 if connections had to be closed"                                                                    default:"30s"`
+	DialTimeout                      time.Duration `mapstructure:"dial-timeout"           desc:"Time allowed to open the connections to the backends, including through the upstream proxy. 0 for no limit"                                                                                                                                             default:"30s"`
+	HandshakeTimeout                 time.Duration `mapstructure:"handshake-timeout"      desc:"Time allowed to the TLS handshakes with the backends and the clients, and to the SOCKS5 handshakes. In HTTP and forward modes, it also bounds the reading of the request headers. 0 for no limit"                                                       default:"10s"`
+	IdleTimeout                      time.Duration `mapstructure:"idle-timeout"           desc:"Time after which the connections without traffic are closed. 0 for no limit. In HTTP and forward modes, it applies to the kept-alive client connections, and to the backend connections kept for reuse, otherwise closed after 90s"                     default:"0"`
+	MaxConnLifetime                  time.Duration `mapstructure:"max-conn-lifetime"      desc:"In TCP and socks5 modes, time after which the connections are closed, whatever their traffic. 0 for no limit"                                                                                                                                           default:"0"`
+	Watch                            bool          `mapstructure:"watch"                  desc:"Reload the client certificates and the server CA when their files change. They are also reloaded on SIGHUP"                                                                                                                                             default:"false"`
+	DisableSocketReusing             bool          `mapstructure:"disable-socket-reusing" desc:"Disable the TLS socket reusing. Useful for debugging the HTTP mode. Not valid with the TCP mode (1 TCP socket = 1 TLS socket)"                                                                                                                          default:"false"`
 
 	ServerCAPool       *x509.CertPool
 	ClientCertificates []tls.Certificate
+	NamedCertificates  map[string]tls.Certificate
 	ServerCAVerify     bool
-	ParsedBackend      Addr
-	ParsedListen       Addr
+	ParsedPins         []verify.Pin
+
+	ParsedTLSMinVersion uint16
+	ParsedTLSMaxVersion uint16
+	ParsedCipherSuites  []uint16
+	ParsedCurves        []tls.CurveID
+	ParsedRenegotiation tls.RenegotiationSupport
+	ParsedBackend       Addr
+	ParsedListen        Addr
+	UpstreamDialer      upstream.Dialer
+
+	ParsedUnixMode os.FileMode
+	ParsedUnixUID  int
+	ParsedUnixGID  int
+
+	ParsedAllowCIDRs []netip.Prefix
+	ParsedDenyCIDRs  []netip.Prefix
+	ParsedBasicAuth  map[string]string
+
+	ListenCertificate *tls.Certificate
+	ListenAuthority   *mint.Authority
+
+	Routes []Route
+
+	ParsedScope                 *scope.Scope
+	ParsedDestinationIdentities []DestinationIdentity
+
+	namedIdentities     []namedIdentity
+	p12PromptedPassword string
 }
 
 // Prefix returns the configuration prefix.
 func (c *Configuration) Prefix() string { return "unmtlsproxy" }
 
-// PrintVersion prints the current version.
+// isHTTP returns if the proxy handles HTTP requests, instead of TCP streams.
+func (c *Configuration) isHTTP() bool {
+	return c.Mode == "http" || c.Mode == "forward"
+}
+
+// isDynamic returns if the backends are chosen by the clients, instead of
+// being configured.
+func (c *Configuration) isDynamic() bool {
+	return c.Mode == "forward" || c.Mode == "socks5"
+}
+
+// Timeouts returns the timeouts of the connections to the backends.
+func (c *Configuration) Timeouts() upstream.Timeouts {
+	return upstream.Timeouts{
+		Dial:      c.DialTimeout,
+		Handshake: c.HandshakeTimeout,
+		Idle:      c.IdleTimeout,
+	}
+}
+
+// Version is the current version.
 // TODO make the version number dynamic
+const Version = "1.2"
+
+// PrintVersion prints the current version.
 func (c *Configuration) PrintVersion() {
-	fmt.Printf("unmtlsproxy - %s\n", "1.2")
+	fmt.Printf("unmtlsproxy - %s\n", Version)
 }
 
 var (
-	ErrInvalidListenFormat         = errors.New("invalid listen format. Use `hostname:port`")
-	ErrInvalidPortTooLow           = errors.New("invalid listening port: too low")
-	ErrInvalidPortTooHigh          = errors.New("invalid listening port: too high")
-	ErrForbiddenDisableSocketUsing = errors.New("option 'disable-socket-reusing' is forbidden in TCP mode. Socket reusing cannot being enabled, option is useless")
+	ErrInvalidListenFormat          = errors.New("invalid listen format. Use `hostname:port`")
+	ErrInvalidPortTooLow            = errors.New("invalid listening port: too low")
+	ErrInvalidPortTooHigh           = errors.New("invalid listening port: too high")
+	ErrForbiddenDisableSocketUsing  = errors.New("option 'disable-socket-reusing' is forbidden in TCP mode. Socket reusing cannot being enabled, option is useless")
+	ErrMissingClientCertificate     = errors.New("no client certificate. Use `cert` and `cert-key`, `cert-dir` or `cert-p12`")
+	ErrMismatchingClientCertificate = errors.New("options `cert` and `cert-key` have to be repeated the same number of times")
+	ErrEmptyClientCertificateDir    = errors.New("no client certificate found in the directory")
+	ErrNoCertificateInFile          = errors.New("no certificate found in the file")
+	ErrInvalidPinFormat             = errors.New("invalid pin format. Use `sha256/<base64>`")
+	ErrVerifyHostnameWithoutCA      = errors.New("option `verify-hostname` requires verifying the server certificate. Use `server-ca` or `system-roots`")
+	ErrInvalidIdentityFormat        = errors.New("invalid identity format. Use `name=cert,key`")
+	ErrDuplicatedIdentity           = errors.New("identity defined several times")
+	ErrRewriteBodiesWithoutURLs     = errors.New("option `rewrite-bodies` requires `rewrite-urls`")
+	ErrRewriteInTCPMode             = errors.New("options `rewrite-urls` and `rewrite-bodies` are only valid in HTTP and forward modes")
+	ErrH2CInTCPMode                 = errors.New("option `h2c` is only valid in HTTP and forward modes")
+	ErrHARInTCPMode                 = errors.New("options `har-out`, `har-body-max-size` and `har-max-entries` are only valid in HTTP and forward modes")
+	ErrHAROutDirectory              = errors.New("the directory of the HAR file does not exist")
+	ErrInvalidHARLimits             = errors.New("options `har-body-max-size` and `har-max-entries` cannot be negative")
+	ErrNegativeShutdownTimeout      = errors.New("option `shutdown-timeout` cannot be negative")
+	ErrNegativeMaxConnections       = errors.New("option `max-connections` cannot be negative")
+	ErrMaxConnectionsInHTTPMode     = errors.New("option `max-connections` is only valid in TCP and socks5 modes")
+	ErrNegativeTimeout              = errors.New("options `dial-timeout`, `handshake-timeout`, `idle-timeout` and `max-conn-lifetime` cannot be negative")
+	ErrMaxConnLifetimeInHTTPMode    = errors.New("option `max-conn-lifetime` is only valid in TCP and socks5 modes")
+	ErrTCPErrorStyleInOtherModes    = errors.New("option `tcp-error-style` is only valid in TCP mode")
+	ErrInvalidUpstreamProxy         = errors.New("invalid upstream proxy URL. Use `scheme://[user:password@]host:port`")
 
 	fmtErrInvalidListeningPort     = "cannot parse the listening address: %w"
 	ErrInvalidListeningPortTooLow  = fmt.Errorf(fmtErrInvalidListeningPort, ErrInvalidPortTooLow)
@@ -79,6 +246,62 @@ var (
 	ErrInvalidBackendPortTooHigh = fmt.Errorf(fmtErrInvalidBackendPort, ErrInvalidPortTooHigh)
 )
 
+func isEmpty(s string) bool { return s == "" }
+
+func parsePin(rawPin string) (verify.Pin, error) {
+	var pin verify.Pin
+	encoded, found := strings.CutPrefix(rawPin, "sha256/")
+	if !found {
+		return pin, fmt.Errorf("%w: %s", ErrInvalidPinFormat, rawPin)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(decoded) != len(pin) {
+		return pin, fmt.Errorf("%w: %s", ErrInvalidPinFormat, rawPin)
+	}
+	copy(pin[:], decoded)
+	return pin, nil
+}
+
+// parseBackend parses a `host:port` backend address.
+func parseBackend(address string) (Addr, error) {
+	bckndUrl, err := url.Parse("tcp://" + address)
+	if err != nil {
+		return Addr{}, fmt.Errorf(fmtErrInvalidBackendPort, err)
+	}
+	if port := bckndUrl.Port(); port == "" {
+		return Addr{}, ErrInvalidListenFormat
+	} else if portInt, err := strconv.Atoi(port); err != nil {
+		return Addr{}, fmt.Errorf("invalid backend port format: %w", err)
+	} else if portInt <= 0 {
+		return Addr{}, ErrInvalidBackendPortTooLow
+	} else if portInt > 65535 {
+		return Addr{}, ErrInvalidBackendPortTooHigh
+	} else {
+		return Addr{
+			Hostname: bckndUrl.Hostname(),
+			Port:     uint16(portInt),
+		}, nil
+	}
+}
+
+// parseUpstreamProxy returns the dialer of the upstream proxy URL, or a direct
+// one if there is none. The URL is never part of the errors, since it can
+// hold credentials.
+func parseUpstreamProxy(rawURL string) (upstream.Dialer, error) {
+	if rawURL == "" {
+		return upstream.NewDialer(nil)
+	}
+	proxyURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, ErrInvalidUpstreamProxy
+	}
+	dialer, err := upstream.NewDialer(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidUpstreamProxy, err)
+	}
+	return dialer, nil
+}
+
 // NewConfiguration returns a new configuration.
 func NewConfiguration() (*Configuration, error) {
 	c := &Configuration{}
@@ -92,10 +315,13 @@ func NewConfiguration() (*Configuration, error) {
 
 	log.Debug("Parsing the listening address", "listeningAddr", c.ListenAddress)
 	listenUrl, err := url.Parse("http://" + c.ListenAddress)
-	if err != nil {
+	if strings.HasPrefix(c.ListenAddress, unixListenPrefix) {
+		if c.ParsedListen, err = parseUnixListen(c.ListenAddress); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
 		return nil, fmt.Errorf(fmtErrInvalidListeningPort, err)
-	}
-	if port := listenUrl.Port(); port == "" {
+	} else if port := listenUrl.Port(); port == "" {
 		return nil, ErrInvalidListenFormat
 	} else if portInt, err := strconv.Atoi(port); err != nil {
 		return nil, fmt.Errorf("invalid listening port format: %w", err)
@@ -110,57 +336,179 @@ func NewConfiguration() (*Configuration, error) {
 		}
 	}
 
-	log.Debug("Parsing the backend address", "backendAddr", c.ParsedBackend)
-	bckndUrl, err := url.Parse("tcp://" + c.BackendAddress)
-	if err != nil {
-		return nil, fmt.Errorf(fmtErrInvalidBackendPort, err)
+	log.Debug("Parsing the forward and SOCKS5 proxies options", "mode", c.Mode, "scope", c.Scope, "forwardIntercept", c.ForwardIntercept)
+	if err := c.parseForward(); err != nil {
+		return nil, err
 	}
-	if port := bckndUrl.Port(); port == "" {
-		return nil, ErrInvalidListenFormat
-	} else if portInt, err := strconv.Atoi(port); err != nil {
-		return nil, fmt.Errorf("invalid backend port format: %w", err)
-	} else if portInt <= 0 {
-		return nil, ErrInvalidBackendPortTooLow
-	} else if portInt > 65535 {
-		return nil, ErrInvalidBackendPortTooHigh
-	} else {
-		c.ParsedBackend = Addr{
-			Hostname: bckndUrl.Hostname(),
-			Port:     uint16(portInt),
+
+	if !c.isDynamic() {
+		log.Debug("Parsing the backend address", "backendAddr", c.BackendAddress)
+		if c.ParsedBackend, err = parseBackend(c.BackendAddress); err != nil {
+			return nil, err
 		}
 	}
 
+	log.Debug("Parsing the HAR capture options", "harOut", c.HAROutPath, "harBodyMaxSize", c.HARBodyMaxSize, "harMaxEntries", c.HARMaxEntries)
+	if !c.isHTTP() && c.HAROutPath != "" {
+		return nil, ErrHARInTCPMode
+	}
+	if c.HARBodyMaxSize < 0 || c.HARMaxEntries < 0 {
+		return nil, ErrInvalidHARLimits
+	}
+	if c.HAROutPath != "" {
+		// Better fail now than lose the capture on shutdown
+		dir := filepath.Dir(c.HAROutPath)
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("%w: %s", ErrHAROutDirectory, dir)
+		}
+	}
+
+	if c.ShutdownTimeout < 0 {
+		return nil, ErrNegativeShutdownTimeout
+	}
+
+	log.Debug("Parsing the connection timeouts", "dialTimeout", c.DialTimeout, "handshakeTimeout", c.HandshakeTimeout, "idleTimeout", c.IdleTimeout, "maxConnLifetime", c.MaxConnLifetime)
+	if c.DialTimeout < 0 || c.HandshakeTimeout < 0 || c.IdleTimeout < 0 || c.MaxConnLifetime < 0 {
+		return nil, ErrNegativeTimeout
+	}
+	if c.isHTTP() && c.MaxConnLifetime != 0 {
+		return nil, ErrMaxConnLifetimeInHTTPMode
+	}
+
+	log.Debug("Parsing the maximum number of connections", "maxConnections", c.MaxConnections, "maxConnectionsPolicy", c.MaxConnectionsPolicy)
+	if c.MaxConnections < 0 {
+		return nil, ErrNegativeMaxConnections
+	}
+	if c.isHTTP() && c.MaxConnections != 0 {
+		return nil, ErrMaxConnectionsInHTTPMode
+	}
+
+	log.Debug("Parsing the upstream proxy", "upstreamProxy", c.UpstreamProxy != "")
+	if c.UpstreamDialer, err = parseUpstreamProxy(c.UpstreamProxy); err != nil {
+		return nil, err
+	}
+
 	log.Debug("Parsing the disable socket reusing option", "mode", c.Mode, "disableSocketReusing", c.DisableSocketReusing)
-	if c.Mode == "tcp" {
+	if !c.isHTTP() {
 		if c.DisableSocketReusing {
 			return nil, ErrForbiddenDisableSocketUsing
 		}
 		c.DisableSocketReusing = true
 	}
 
-	log.Debug("Parsing the server CA", "serverCAPoolPath", c.ServerCAPoolPath, "serverCAVerify", c.ServerCAVerify)
-	c.ServerCAVerify = c.ServerCAPoolPath != ""
-	if c.ServerCAVerify {
-		data, err := os.ReadFile(c.ServerCAPoolPath)
+	log.Debug("Parsing the Unix socket options", "mode", c.ListenUnixMode, "owner", c.ListenUnixOwner)
+	if err := c.parseUnixOptions(); err != nil {
+		return nil, err
+	}
+
+	log.Debug("Parsing the access control options", "allowCIDRs", c.AllowCIDRs, "denyCIDRs", c.DenyCIDRs, "iKnowWhatIAmDoing", c.IKnowWhatIAmDoing)
+	if err := c.parseAccess(); err != nil {
+		return nil, err
+	}
+
+	log.Debug("Parsing the rewrite options", "rewriteURLs", c.RewriteURLs, "rewriteBodies", c.RewriteBodies, "rewriteBodyMaxSize", c.RewriteBodyMaxSize)
+	if c.RewriteBodies && !c.RewriteURLs {
+		return nil, ErrRewriteBodiesWithoutURLs
+	}
+	if !c.isHTTP() && c.RewriteURLs {
+		return nil, ErrRewriteInTCPMode
+	}
+
+	if !c.isHTTP() && c.H2C {
+		return nil, ErrH2CInTCPMode
+	}
+
+	if c.Mode != "tcp" && c.TCPErrorStyle != "close" {
+		return nil, ErrTCPErrorStyleInOtherModes
+	}
+
+	c.ServerCAVerify = c.ServerCAPoolPath != "" || c.SystemRoots
+	log.Debug("Parsed the verify status", "serverCAVerify", c.ServerCAVerify)
+	if c.VerifyHostname != "" && !c.ServerCAVerify {
+		return nil, ErrVerifyHostnameWithoutCA
+	}
+
+	log.Debug("Parsing the TLS parameters", "minVersion", c.TLSMinVersion, "maxVersion", c.TLSMaxVersion, "cipherSuites", c.TLSCipherSuites, "curves", c.TLSCurves, "alpn", c.ALPN, "renegotiation", c.TLSRenegotiation)
+	if err := c.parseTLSParameters(); err != nil {
+		return nil, err
+	}
+
+	log.Debug("Parsing the pinned public keys", "pins", c.PinnedSPKIs)
+	for _, rawPin := range slices.DeleteFunc(c.PinnedSPKIs, isEmpty) {
+		pin, err := parsePin(rawPin)
 		if err != nil {
 			return nil, err
 		}
-		c.ServerCAPool = x509.NewCertPool()
-		c.ServerCAPool.AppendCertsFromPEM(data)
+		c.ParsedPins = append(c.ParsedPins, pin)
 	}
-	log.Debug("Parsed the verify status", "serverCAVerify", c.ServerCAVerify)
 
-	log.Debug("Reading the client certificate and keys", "ClientCertificatePath", c.ClientCertificatePath, "ClientCertificateKeyPath", c.ClientCertificateKeyPath)
-	certs, key, err := tglib.ReadCertificatePEMs(c.ClientCertificatePath, c.ClientCertificateKeyPath, "")
-	if err != nil {
+	c.ClientCertificatePaths = slices.DeleteFunc(c.ClientCertificatePaths, isEmpty)
+	c.ClientCertificateKeyPaths = slices.DeleteFunc(c.ClientCertificateKeyPaths, isEmpty)
+	if len(c.ClientCertificatePaths) != len(c.ClientCertificateKeyPaths) {
+		return nil, ErrMismatchingClientCertificate
+	}
+
+	log.Debug("Parsing the named identities", "identities", c.Identities)
+	if c.namedIdentities, err = parseIdentities(c.Identities); err != nil {
 		return nil, err
 	}
 
-	tc, err := tglib.ToTLSCertificates(certs, key)
-	if err != nil {
+	log.Debug("Parsing the destination identities", "destinationIdentities", c.DestinationIdentities)
+	if err := c.parseDestinationIdentities(); err != nil {
+		return nil, err
+	}
+
+	if c.ServerCAPool, err = c.loadServerCAPool(); err != nil {
+		return nil, err
+	}
+	if c.ClientCertificates, c.NamedCertificates, err = c.loadClientCertificates(true); err != nil {
+		return nil, err
+	}
+
+	log.Debug("Parsing the routes", "routes", c.RoutesPath)
+	if err := c.loadRoutes(); err != nil {
+		return nil, err
+	}
+
+	log.Debug("Parsing the listening TLS options", "listenCert", c.ListenCertificatePath, "listenAutoTLS", c.ListenAutoTLS, "listenCACert", c.ListenCACertificatePath)
+	if err := c.loadListenTLS(); err != nil {
 		return nil, err
 	}
-	c.ClientCertificates = append(c.ClientCertificates, tc)
 
 	return c, nil
 }
+
+// ReloadCertificates reads again the client certificates and the server CAs,
+// to take into account a renewal. The configuration is left untouched.
+func (c *Configuration) ReloadCertificates() ([]tls.Certificate, map[string]tls.Certificate, *x509.CertPool, error) {
+	pool, err := c.loadServerCAPool()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	certificates, named, err := c.loadClientCertificates(false)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return certificates, named, pool, nil
+}
+
+// WatchedPaths returns the paths of the files holding the certificates, the
+// keys and the server CAs.
+func (c *Configuration) WatchedPaths() []string {
+	var paths []string
+	candidates := slices.Concat(c.ClientCertificatePaths, c.ClientCertificateKeyPaths)
+	candidates = append(candidates, c.ClientCertificateDir, c.ClientCertificateP12Path, c.ClientCertificateP12PasswordFile, c.ServerCAPoolPath)
+	for _, id := range c.namedIdentities {
+		candidates = append(candidates, id.certPath, id.keyPath)
+	}
+	for _, r := range c.Routes {
+		candidates = append(candidates, r.ClientCertificatePath, r.ClientCertificateKeyPath, r.ServerCAPoolPath)
+	}
+	for _, path := range candidates {
+		// PKCS#11 keys are not files
+		if path != "" && !pkcs11key.IsURI(path) {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
@@ -18,6 +18,7 @@ import (
 
 	"github.com/ajabep/unmtlsproxy/internal/configuration"
 	"github.com/spf13/pflag"
+	"software.sslmate.com/src/go-pkcs12"
 )
 
 func GenerateCertificate(certificatePath string, keyPath string) error {
@@ -78,6 +79,42 @@ func GenerateCertificate(certificatePath string, keyPath string) error {
 	return nil
 }
 
+// GenerateP12 generates a self-signed client certificate and stores it, with
+// its key, in a PKCS#12 bundle encrypted with AES (PBES2).
+func GenerateP12(p12Path string, password string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	tml := x509.Certificate{
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().AddDate(5, 0, 0),
+		SerialNumber: big.NewInt(123124),
+		Subject: pkix.Name{
+			CommonName:   "Hugging Department",
+			Organization: []string{"BlaHaj Corp."},
+		},
+		PublicKeyAlgorithm: x509.ECDSA,
+		SignatureAlgorithm: x509.ECDSAWithSHA256,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &tml, &tml, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+
+	data, err := pkcs12.Modern.Encode(key, cert, nil, password)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p12Path, data, 0600)
+}
+
 func SetupConfigurationEnv(args map[string]string) {
 	for k, v := range args {
 		k = strings.TrimPrefix(k, "--")
@@ -90,12 +127,21 @@ func SetupConfigurationEnv(args map[string]string) {
 	}
 }
 
+func ResetConfigurationEnv() {
+	for _, kv := range os.Environ() {
+		if k, _, _ := strings.Cut(kv, "="); strings.HasPrefix(k, "UNMTLSPROXY_") {
+			os.Unsetenv(k)
+		}
+	}
+}
+
 func ResetFlags() {
 	pflag.CommandLine = pflag.NewFlagSet(os.Args[0], pflag.ExitOnError)
 }
 
 func LoadNewConfiguration(args map[string]string) (*configuration.Configuration, error) {
 	ResetFlags()
+	ResetConfigurationEnv()
 	SetupConfigurationEnv(args)
 	return configuration.NewConfiguration()
 }
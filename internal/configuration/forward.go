@@ -0,0 +1,104 @@
+// Copyright 2024 Ajabep
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configuration
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/ajabep/unmtlsproxy/internal/scope"
+)
+
+var (
+	ErrMissingBackend              = errors.New("option `backend` is required, except in forward and socks5 modes")
+	ErrBackendInForwardMode        = errors.New("option `backend` is not used in forward and socks5 modes. Use `scope`")
+	ErrForwardWithoutScope         = errors.New("the forward and socks5 modes require `scope`, the destinations the proxy can connect to. Use `*` to allow any destination")
+	ErrForwardOptionsInBackendMode = errors.New("options `scope` and `dest-identity` are only valid in forward and socks5 modes, and `forward-intercept` in forward mode")
+	ErrServerNameInForwardMode     = errors.New("options `sni` and `verify-hostname` are not valid in forward and socks5 modes: the server name is the destination one")
+	ErrInvalidDestIdentityFormat   = errors.New("invalid destination identity format. Use `pattern=name`")
+	ErrUnknownDestIdentity         = errors.New("the identity of a destination has to be defined with `identity`")
+)
+
+// DestinationIdentity is the named client certificate used for the
+// destinations in its scope.
+type DestinationIdentity struct {
+	Scope    *scope.Scope
+	Identity string
+}
+
+// parseForward parses the options of the forward and SOCKS5 modes, where the
+// backend is chosen by the client, and makes sure the other modes have a
+// backend.
+func (c *Configuration) parseForward() error {
+	c.Scope = slices.DeleteFunc(c.Scope, isEmpty)
+	c.DestinationIdentities = slices.DeleteFunc(c.DestinationIdentities, isEmpty)
+
+	if !c.isDynamic() {
+		if len(c.Scope) != 0 || len(c.DestinationIdentities) != 0 || c.ForwardIntercept {
+			return ErrForwardOptionsInBackendMode
+		}
+		if c.BackendAddress == "" {
+			return ErrMissingBackend
+		}
+		return nil
+	}
+
+	if c.ForwardIntercept && c.Mode != "forward" {
+		return ErrForwardOptionsInBackendMode
+	}
+	if c.BackendAddress != "" {
+		return ErrBackendInForwardMode
+	}
+	if len(c.Scope) == 0 {
+		return ErrForwardWithoutScope
+	}
+	if c.SNI != "" || c.VerifyHostname != "" {
+		return ErrServerNameInForwardMode
+	}
+
+	var err error
+	c.ParsedScope, err = scope.Parse(c.Scope)
+	return err
+}
+
+// parseDestinationIdentities parses the `pattern=name` destination
+// identities. The named identities have to be parsed first.
+func (c *Configuration) parseDestinationIdentities() error {
+	for _, value := range c.DestinationIdentities {
+		pattern, name, found := strings.Cut(value, "=")
+		if !found || pattern == "" || name == "" {
+			return fmt.Errorf("%w: %s", ErrInvalidDestIdentityFormat, value)
+		}
+		if !slices.ContainsFunc(c.namedIdentities, func(id namedIdentity) bool { return id.name == name }) {
+			return fmt.Errorf("%w: %s", ErrUnknownDestIdentity, name)
+		}
+		s, err := scope.Parse([]string{pattern})
+		if err != nil {
+			return err
+		}
+		c.ParsedDestinationIdentities = append(c.ParsedDestinationIdentities, DestinationIdentity{Scope: s, Identity: name})
+	}
+	return nil
+}
+
+// DestinationIdentityOf returns the name of the client certificate to use for
+// the destination, or an empty string for the default ones.
+func (c *Configuration) DestinationIdentityOf(host string, port uint16) string {
+	for _, id := range c.ParsedDestinationIdentities {
+		if id.Scope.Allowed(host, port) {
+			return id.Identity
+		}
+	}
+	return ""
+}
@@ -0,0 +1,63 @@
+// Copyright 2024 Ajabep
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configuration
+
+import (
+	"errors"
+
+	"github.com/ajabep/unmtlsproxy/internal/mint"
+)
+
+var (
+	ErrMismatchingListenCertificate = errors.New("options `listen-cert` and `listen-key` have to be used together")
+	ErrMismatchingListenCA          = errors.New("options `listen-ca-cert` and `listen-ca-key` have to be used together")
+	ErrListenTLSSourceBoth          = errors.New("options `listen-cert` and `listen-auto-tls` are mutually exclusive")
+	ErrListenCAWithoutAutoTLS       = errors.New("options `listen-ca-cert`, `listen-ca-key` and `listen-ca-export` require `listen-auto-tls` or `forward-intercept`")
+)
+
+// loadListenTLS reads the certificate presented to the clients of the proxy,
+// or prepares the CA issuing them, also used to intercept the CONNECT
+// tunnels.
+func (c *Configuration) loadListenTLS() error {
+	if (c.ListenCertificatePath == "") != (c.ListenKeyPath == "") {
+		return ErrMismatchingListenCertificate
+	}
+	if (c.ListenCACertificatePath == "") != (c.ListenCAKeyPath == "") {
+		return ErrMismatchingListenCA
+	}
+	if c.ListenCertificatePath != "" && c.ListenAutoTLS {
+		return ErrListenTLSSourceBoth
+	}
+	if !c.ListenAutoTLS && !c.ForwardIntercept && (c.ListenCACertificatePath != "" || c.ListenCAExportPath != "") {
+		return ErrListenCAWithoutAutoTLS
+	}
+
+	if c.ListenCertificatePath != "" {
+		tc, err := loadPEMCertificate(c.ListenCertificatePath, c.ListenKeyPath)
+		if err != nil {
+			return err
+		}
+		c.ListenCertificate = &tc
+	}
+
+	if !c.ListenAutoTLS && !c.ForwardIntercept {
+		return nil
+	}
+
+	var err error
+	if c.ListenCACertificatePath != "" {
+		c.ListenAuthority, err = mint.LoadAuthority(c.ListenCACertificatePath, c.ListenCAKeyPath)
+	} else {
+		c.ListenAuthority, err = mint.NewAuthority()
+	}
+	return err
+}
@@ -0,0 +1,116 @@
+// Copyright 2024 Ajabep
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configuration
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ajabep/unmtlsproxy/internal/log"
+	"go.aporeto.io/tg/tglib"
+	"golang.org/x/term"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+var (
+	ErrP12PasswordEnvNotSet  = errors.New("the environment variable holding the PKCS#12 password is not set")
+	ErrP12PasswordSourceBoth = errors.New("options 'cert-p12-password-env' and 'cert-p12-password-file' are mutually exclusive")
+	ErrP12PasswordNoTerminal = errors.New("the PKCS#12 bundle is encrypted, but no password source is set and stdin is not a terminal")
+)
+
+// readP12Password returns the password of the PKCS#12 bundle, from the
+// environment or from a file. The boolean is false when no source is
+// configured, meaning that the password has to be prompted if needed.
+func (c *Configuration) readP12Password() (string, bool, error) {
+	if c.ClientCertificateP12PasswordEnv != "" && c.ClientCertificateP12PasswordFile != "" {
+		return "", false, ErrP12PasswordSourceBoth
+	}
+
+	if c.ClientCertificateP12PasswordEnv != "" {
+		password, has := os.LookupEnv(c.ClientCertificateP12PasswordEnv)
+		if !has {
+			return "", false, fmt.Errorf("%w: %s", ErrP12PasswordEnvNotSet, c.ClientCertificateP12PasswordEnv)
+		}
+		return password, true, nil
+	}
+
+	if c.ClientCertificateP12PasswordFile != "" {
+		data, err := os.ReadFile(c.ClientCertificateP12PasswordFile)
+		if err != nil {
+			return "", false, err
+		}
+		// Editors and `echo` usually add a trailing newline
+		return strings.TrimRight(string(data), "\r\n"), true, nil
+	}
+
+	return "", false, nil
+}
+
+// promptP12Password asks the password of the PKCS#12 bundle on the terminal.
+func promptP12Password(path string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", ErrP12PasswordNoTerminal
+	}
+
+	fmt.Fprintf(os.Stderr, "Password for %s: ", path)
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	return string(password), nil
+}
+
+// loadP12Certificate decodes a PKCS#12 bundle, including its chain, into a
+// TLS certificate. The decoding is done in memory: no key material is
+// written on the disk. A prompted password is kept, to be able to reload the
+// bundle without prompting it again.
+func (c *Configuration) loadP12Certificate(prompt bool) (tls.Certificate, error) {
+	data, err := os.ReadFile(c.ClientCertificateP12Path)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	password, hasSource, err := c.readP12Password()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if !hasSource {
+		password = c.p12PromptedPassword
+	}
+
+	key, cert, caCerts, err := pkcs12.DecodeChain(data, password)
+	if errors.Is(err, pkcs12.ErrIncorrectPassword) && !hasSource && prompt {
+		log.Debug("The PKCS#12 bundle is encrypted, prompting the password", "ClientCertificateP12Path", c.ClientCertificateP12Path)
+		if password, err = promptP12Password(c.ClientCertificateP12Path); err != nil {
+			return tls.Certificate{}, err
+		}
+		key, cert, caCerts, err = pkcs12.DecodeChain(data, password)
+		if err == nil {
+			c.p12PromptedPassword = password
+		}
+	}
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("cannot decode the PKCS#12 bundle: %w", err)
+	}
+
+	tc, err := tglib.ToTLSCertificates(append([]*x509.Certificate{cert}, caCerts...), key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return withLeaf(tc)
+}
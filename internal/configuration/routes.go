@@ -0,0 +1,207 @@
+// Copyright 2024 Ajabep
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configuration
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/ajabep/unmtlsproxy/internal/log"
+	"github.com/ajabep/unmtlsproxy/internal/pkcs11key"
+	"github.com/ajabep/unmtlsproxy/internal/verify"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrRoutesInTCPMode             = errors.New("option `routes` is only valid in HTTP mode")
+	ErrInvalidRoutesFile           = errors.New("invalid routes file")
+	ErrRouteWithoutBackend         = errors.New("a route requires a `backend`")
+	ErrRouteWithoutMatch           = errors.New("a route requires a `host`, a `path`, or both")
+	ErrInvalidRoutePath            = errors.New("the `path` of a route has to start with `/`")
+	ErrStripPrefixWithoutPath      = errors.New("option `strip-prefix` of a route requires a `path`")
+	ErrRouteCertificateWithoutKey  = errors.New("options `cert` and `cert-key` of a route have to be used together")
+	ErrRouteIdentityAndCertificate = errors.New("options `identity` and `cert` of a route cannot be used together")
+	ErrUnknownRouteIdentity        = errors.New("the identity of a route has to be defined with `identity`")
+)
+
+// Route sends the requests matching its host and its path prefix to another
+// backend than the default one, with its own client certificate and server
+// verification. Without their own, the routes use the global CAs, hostname to
+// verify and pins.
+type Route struct {
+	// Host matches the hostname of the Host header. A leading `*.` matches
+	// any subdomain.
+	Host string `yaml:"host"`
+	// PathPrefix matches the path, segment by segment.
+	PathPrefix  string `yaml:"path"`
+	StripPrefix bool   `yaml:"strip-prefix"`
+
+	BackendAddress           string   `yaml:"backend"`
+	ClientCertificatePath    string   `yaml:"cert"`
+	ClientCertificateKeyPath string   `yaml:"cert-key"`
+	Identity                 string   `yaml:"identity"`
+	ServerCAPoolPath         string   `yaml:"server-ca"`
+	SystemRoots              bool     `yaml:"system-roots"`
+	SNI                      string   `yaml:"sni"`
+	VerifyHostname           string   `yaml:"verify-hostname"`
+	PinnedSPKIs              []string `yaml:"pin-spki"`
+	TLSMinVersion            string   `yaml:"tls-min-version"`
+	TLSMaxVersion            string   `yaml:"tls-max-version"`
+
+	ParsedBackend Addr
+	// ClientCertificate is nil when the route uses the default client
+	// certificates, or a named identity.
+	ClientCertificate *tls.Certificate
+	// ServerCAVerify is set when the route has its own CAs. Otherwise, the
+	// default ones are used.
+	ServerCAVerify      bool
+	ServerCAPool        *x509.CertPool
+	ParsedPins          []verify.Pin
+	ParsedTLSMinVersion uint16
+	ParsedTLSMaxVersion uint16
+}
+
+type routesFile struct {
+	Routes []Route `yaml:"routes"`
+}
+
+// String describes the requests matched by the route.
+func (r *Route) String() string {
+	return r.Host + r.PathPrefix
+}
+
+// loadRoutes reads and validates the routes file.
+func (c *Configuration) loadRoutes() error {
+	if c.RoutesPath == "" {
+		return nil
+	}
+	if c.Mode != "http" {
+		return ErrRoutesInTCPMode
+	}
+
+	f, err := os.Open(c.RoutesPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var file routesFile
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidRoutesFile, err)
+	}
+
+	for i := range file.Routes {
+		if err := c.parseRoute(&file.Routes[i]); err != nil {
+			return fmt.Errorf("route %d: %w", i+1, err)
+		}
+		log.Debug("Parsed a route", "route", file.Routes[i].String(), "backend", file.Routes[i].ParsedBackend)
+	}
+	c.Routes = file.Routes
+	return nil
+}
+
+// parseRoute validates a route, and loads its certificates.
+func (c *Configuration) parseRoute(r *Route) error {
+	var err error
+
+	if r.BackendAddress == "" {
+		return ErrRouteWithoutBackend
+	}
+	if r.ParsedBackend, err = parseBackend(r.BackendAddress); err != nil {
+		return err
+	}
+
+	r.Host = strings.ToLower(r.Host)
+	if r.Host == "" && r.PathPrefix == "" {
+		return ErrRouteWithoutMatch
+	}
+	if r.PathPrefix != "" && !strings.HasPrefix(r.PathPrefix, "/") {
+		return fmt.Errorf("%w: %s", ErrInvalidRoutePath, r.PathPrefix)
+	}
+	if r.StripPrefix && r.PathPrefix == "" {
+		return ErrStripPrefixWithoutPath
+	}
+
+	if (r.ClientCertificatePath == "") != (r.ClientCertificateKeyPath == "") {
+		return ErrRouteCertificateWithoutKey
+	}
+	if r.Identity != "" {
+		if r.ClientCertificatePath != "" {
+			return ErrRouteIdentityAndCertificate
+		}
+		if !slices.ContainsFunc(c.namedIdentities, func(id namedIdentity) bool { return id.name == r.Identity }) {
+			return fmt.Errorf("%w: %s", ErrUnknownRouteIdentity, r.Identity)
+		}
+	}
+
+	r.ServerCAVerify = r.ServerCAPoolPath != "" || r.SystemRoots
+	if r.VerifyHostname != "" && !r.ServerCAVerify && !c.ServerCAVerify {
+		return ErrVerifyHostnameWithoutCA
+	}
+	for _, rawPin := range r.PinnedSPKIs {
+		pin, err := parsePin(rawPin)
+		if err != nil {
+			return err
+		}
+		r.ParsedPins = append(r.ParsedPins, pin)
+	}
+	// Without their own, the routes keep the global hostname and pins
+	if r.VerifyHostname == "" {
+		r.VerifyHostname = c.VerifyHostname
+	}
+	if len(r.ParsedPins) == 0 {
+		r.ParsedPins = c.ParsedPins
+	}
+
+	if r.ParsedTLSMinVersion, err = parseTLSVersion(r.TLSMinVersion); err != nil {
+		return err
+	}
+	if r.ParsedTLSMaxVersion, err = parseTLSVersion(r.TLSMaxVersion); err != nil {
+		return err
+	}
+	if r.ParsedTLSMinVersion != 0 && r.ParsedTLSMaxVersion != 0 && r.ParsedTLSMinVersion > r.ParsedTLSMaxVersion {
+		return ErrInvalidTLSVersionRange
+	}
+
+	r.ClientCertificate, r.ServerCAPool, err = r.ReloadCertificates()
+	return err
+}
+
+// ReloadCertificates reads again the client certificate and the server CAs
+// of the route, if it has its own ones.
+func (r *Route) ReloadCertificates() (*tls.Certificate, *x509.CertPool, error) {
+	var cert *tls.Certificate
+	if r.ClientCertificatePath != "" {
+		log.Debug("Reading the client certificate and keys of a route", "route", r.String(), "ClientCertificatePath", r.ClientCertificatePath, "ClientCertificateKeyPath", pkcs11key.Redact(r.ClientCertificateKeyPath))
+		tc, err := loadPEMCertificate(r.ClientCertificatePath, r.ClientCertificateKeyPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		cert = &tc
+	}
+
+	var pool *x509.CertPool
+	if r.ServerCAVerify {
+		var err error
+		if pool, err = loadCAPool(r.SystemRoots, r.ServerCAPoolPath); err != nil {
+			return nil, nil, err
+		}
+	}
+	return cert, pool, nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2024 Ajabep
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configuration
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+var (
+	ErrUnknownTLSVersion      = errors.New("unknown TLS version. Use 1.0, 1.1, 1.2 or 1.3")
+	ErrInvalidTLSVersionRange = errors.New("the minimum TLS version is higher than the maximum one")
+	ErrUnknownCipherSuite     = errors.New("unknown cipher suite")
+	ErrTLS13CipherSuite       = errors.New("TLS 1.3 cipher suites are not configurable")
+	ErrUnknownCurve           = errors.New("unknown curve")
+	ErrUnknownRenegotiation   = errors.New("unknown renegotiation policy. Use never, once or freely")
+	ErrALPNInHTTPMode         = errors.New("in HTTP and forward modes, the only supported ALPN protocols are `h2` and `http/1.1`")
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var renegotiations = map[string]tls.RenegotiationSupport{
+	"never":  tls.RenegotiateNever,
+	"once":   tls.RenegotiateOnceAsClient,
+	"freely": tls.RenegotiateFreelyAsClient,
+}
+
+// curves are the supported key exchanges. The post-quantum ones are added
+// depending on the Go version.
+var curves = []tls.CurveID{
+	tls.X25519,
+	tls.CurveP256,
+	tls.CurveP384,
+	tls.CurveP521,
+}
+
+// parseTLSVersion parses a TLS version. An empty version is the default one,
+// and is returned as 0.
+func parseTLSVersion(version string) (uint16, error) {
+	if version == "" {
+		return 0, nil
+	}
+	v, has := tlsVersions[version]
+	if !has {
+		return 0, fmt.Errorf("%w: %s", ErrUnknownTLSVersion, version)
+	}
+	return v, nil
+}
+
+// parseCipherSuites parses cipher suites from their IANA names, including the
+// insecure ones, useful against legacy servers.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	suites := slices.Concat(tls.CipherSuites(), tls.InsecureCipherSuites())
+
+	var ids []uint16
+	for _, name := range names {
+		idx := slices.IndexFunc(suites, func(cs *tls.CipherSuite) bool {
+			return strings.EqualFold(cs.Name, name)
+		})
+		if idx < 0 {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownCipherSuite, name)
+		}
+		cs := suites[idx]
+		if slices.Equal(cs.SupportedVersions, []uint16{tls.VersionTLS13}) {
+			return nil, fmt.Errorf("%w: %s", ErrTLS13CipherSuite, name)
+		}
+		ids = append(ids, cs.ID)
+	}
+	return ids, nil
+}
+
+// parseCurves parses key exchanges from their Go names, such as `X25519` or
+// `CurveP256`.
+func parseCurves(names []string) ([]tls.CurveID, error) {
+	var ids []tls.CurveID
+	for _, name := range names {
+		idx := slices.IndexFunc(curves, func(id tls.CurveID) bool {
+			return strings.EqualFold(id.String(), name)
+		})
+		if idx < 0 {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownCurve, name)
+		}
+		ids = append(ids, curves[idx])
+	}
+	return ids, nil
+}
+
+// parseTLSParameters validates and parses the TLS client parameters.
+func (c *Configuration) parseTLSParameters() error {
+	var err error
+
+	if c.ParsedTLSMinVersion, err = parseTLSVersion(c.TLSMinVersion); err != nil {
+		return err
+	}
+	if c.ParsedTLSMaxVersion, err = parseTLSVersion(c.TLSMaxVersion); err != nil {
+		return err
+	}
+	if c.ParsedTLSMinVersion != 0 && c.ParsedTLSMaxVersion != 0 && c.ParsedTLSMinVersion > c.ParsedTLSMaxVersion {
+		return ErrInvalidTLSVersionRange
+	}
+
+	if c.ParsedCipherSuites, err = parseCipherSuites(slices.DeleteFunc(c.TLSCipherSuites, isEmpty)); err != nil {
+		return err
+	}
+	if c.ParsedCurves, err = parseCurves(slices.DeleteFunc(c.TLSCurves, isEmpty)); err != nil {
+		return err
+	}
+
+	var has bool
+	if c.ParsedRenegotiation, has = renegotiations[c.TLSRenegotiation]; !has {
+		return fmt.Errorf("%w: %s", ErrUnknownRenegotiation, c.TLSRenegotiation)
+	}
+
+	c.ALPN = slices.DeleteFunc(c.ALPN, isEmpty)
+	if c.isHTTP() && slices.ContainsFunc(c.ALPN, func(proto string) bool { return proto != "h2" && proto != "http/1.1" }) {
+		return ErrALPNInHTTPMode
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2024 Ajabep
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configuration
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const (
+	unixListenPrefix = "unix:"
+	defaultUnixMode  = 0o600
+)
+
+var (
+	ErrAbstractSocketUnsupported = errors.New("abstract Unix sockets are only supported on Linux")
+	ErrUnixOptionsWithoutFile    = errors.New("options `listen-unix-mode` and `listen-unix-owner` require listening on a Unix socket file")
+	ErrInvalidUnixMode           = errors.New("invalid Unix socket mode. Use an octal mode, such as `0660`")
+	ErrUnknownUnixOwner          = errors.New("unknown Unix socket owner")
+)
+
+// parseUnixListen parses the `unix:/path` and `unix:@name` listening
+// addresses.
+func parseUnixListen(rawAddr string) (Addr, error) {
+	path := strings.TrimPrefix(rawAddr, unixListenPrefix)
+	if path == "" || path == "@" {
+		return Addr{}, ErrInvalidListenFormat
+	}
+	if strings.HasPrefix(path, "@") && runtime.GOOS != "linux" {
+		return Addr{}, ErrAbstractSocketUnsupported
+	}
+	return Addr{UnixPath: path}, nil
+}
+
+// parseUnixOwner parses `user[:group]`, as names or IDs. -1 means unchanged.
+func parseUnixOwner(owner string) (int, int, error) {
+	uid, gid := -1, -1
+	if owner == "" {
+		return uid, gid, nil
+	}
+
+	userName, groupName, _ := strings.Cut(owner, ":")
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			if u, err = user.LookupId(userName); err != nil {
+				return 0, 0, fmt.Errorf("%w: %s", ErrUnknownUnixOwner, userName)
+			}
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return 0, 0, fmt.Errorf("%w: %s", ErrUnknownUnixOwner, userName)
+		}
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupName); err != nil {
+				return 0, 0, fmt.Errorf("%w: %s", ErrUnknownUnixOwner, groupName)
+			}
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return 0, 0, fmt.Errorf("%w: %s", ErrUnknownUnixOwner, groupName)
+		}
+	}
+	return uid, gid, nil
+}
+
+// parseUnixOptions parses the mode and the owner of the Unix socket file.
+func (c *Configuration) parseUnixOptions() error {
+	c.ParsedUnixMode = defaultUnixMode
+	c.ParsedUnixUID, c.ParsedUnixGID = -1, -1
+	if c.ListenUnixMode == "" && c.ListenUnixOwner == "" {
+		return nil
+	}
+	if !c.ParsedListen.IsUnix() || c.ParsedListen.IsAbstract() {
+		return ErrUnixOptionsWithoutFile
+	}
+
+	if c.ListenUnixMode != "" {
+		mode, err := strconv.ParseUint(c.ListenUnixMode, 8, 32)
+		if err != nil || mode > 0o777 {
+			return fmt.Errorf("%w: %s", ErrInvalidUnixMode, c.ListenUnixMode)
+		}
+		c.ParsedUnixMode = os.FileMode(mode)
+	}
+
+	var err error
+	c.ParsedUnixUID, c.ParsedUnixGID, err = parseUnixOwner(c.ListenUnixOwner)
+	return err
+}
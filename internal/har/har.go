@@ -0,0 +1,267 @@
+// Copyright 2024 Ajabep
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package har records HTTP exchanges in HAR 1.2 files
+package har
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HAR is the root of a HAR file. See
+// http://www.softwareishard.com/blog/har-12-spec/
+type HAR struct {
+	Log Log `json:"log"`
+}
+
+type Log struct {
+	Version string  `json:"version"`
+	Creator Creator `json:"creator"`
+	Entries []Entry `json:"entries"`
+}
+
+type Creator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// Entry is an exchange with a backend. The fields prefixed by an underscore
+// are custom ones, allowed by the specification.
+type Entry struct {
+	StartedDateTime time.Time `json:"startedDateTime"`
+	// Time is the total time of the exchange, in milliseconds
+	Time            float64            `json:"time"`
+	Request         Request            `json:"request"`
+	Response        Response           `json:"response"`
+	Cache           struct{}           `json:"cache"`
+	Timings         Timings            `json:"timings"`
+	ServerIPAddress string             `json:"serverIPAddress,omitempty"`
+	Connection      string             `json:"connection,omitempty"`
+	Comment         string             `json:"comment,omitempty"`
+	TLS             *TLS               `json:"_tls,omitempty"`
+	ClientCert      *ClientCertificate `json:"_clientCertificate,omitempty"`
+}
+
+type Request struct {
+	Method      string      `json:"method"`
+	URL         string      `json:"url"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []Cookie    `json:"cookies"`
+	Headers     []NameValue `json:"headers"`
+	QueryString []NameValue `json:"queryString"`
+	PostData    *PostData   `json:"postData,omitempty"`
+	// HeadersSize is -1: the headers are not sent as is by the HTTP client
+	HeadersSize int64 `json:"headersSize"`
+	BodySize    int64 `json:"bodySize"`
+}
+
+type Response struct {
+	Status      int         `json:"status"`
+	StatusText  string      `json:"statusText"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []Cookie    `json:"cookies"`
+	Headers     []NameValue `json:"headers"`
+	Content     Content     `json:"content"`
+	RedirectURL string      `json:"redirectURL"`
+	HeadersSize int64       `json:"headersSize"`
+	BodySize    int64       `json:"bodySize"`
+	// Error is the reason why no response has been received
+	Error string `json:"_error,omitempty"`
+}
+
+type NameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type Cookie struct {
+	Name     string     `json:"name"`
+	Value    string     `json:"value"`
+	Path     string     `json:"path,omitempty"`
+	Domain   string     `json:"domain,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	HTTPOnly bool       `json:"httpOnly,omitempty"`
+	Secure   bool       `json:"secure,omitempty"`
+}
+
+type PostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	// Encoding is `base64` for the binary bodies
+	Encoding string `json:"_encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type Content struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	// Encoding is `base64` for the binary bodies
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// Timings are in milliseconds, -1 when they do not apply.
+type Timings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// TLS describes the TLS connection with the backend.
+type TLS struct {
+	Version            string   `json:"version"`
+	CipherSuite        string   `json:"cipherSuite"`
+	ServerName         string   `json:"serverName"`
+	NegotiatedProtocol string   `json:"negotiatedProtocol,omitempty"`
+	DidResume          bool     `json:"didResume"`
+	PeerCertificates   []string `json:"peerCertificates"`
+}
+
+// ClientCertificate describes the client certificate sent to the backend.
+type ClientCertificate struct {
+	Subject      string `json:"subject"`
+	Issuer       string `json:"issuer"`
+	SerialNumber string `json:"serialNumber"`
+	SHA256       string `json:"sha256"`
+}
+
+// Recorder keeps the entries in memory, until they are written.
+type Recorder struct {
+	path       string
+	maxEntries int
+	creator    Creator
+
+	mu        sync.Mutex
+	entries   []Entry
+	rotations int
+}
+
+// NewRecorder returns a recorder writing to the path. If maxEntries is not
+// 0, the entries are rotated when there are that many. The rotated files
+// are numbered after the ones already next to the path, to not overwrite
+// them.
+func NewRecorder(path string, maxEntries int, creator Creator) *Recorder {
+	return &Recorder{
+		path:       path,
+		maxEntries: maxEntries,
+		creator:    creator,
+		rotations:  lastRotation(path),
+	}
+}
+
+// Add records an entry. It returns the error of the rotation it triggered,
+// if any.
+func (r *Recorder) Add(entry Entry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, entry)
+	if r.maxEntries != 0 && len(r.entries) >= r.maxEntries {
+		return r.rotate()
+	}
+	return nil
+}
+
+// RotatedPath returns the path of the nth rotated file: the `.n` suffix is
+// inserted before the extension.
+func RotatedPath(path string, n int) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s.%d%s", strings.TrimSuffix(path, ext), n, ext)
+}
+
+// lastRotation returns the number of the last rotated file of the path, or 0
+// if there is none.
+func lastRotation(path string) int {
+	files, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return 0
+	}
+	ext := filepath.Ext(path)
+	prefix := strings.TrimSuffix(filepath.Base(path), ext) + "."
+	last := 0
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) || len(name) <= len(prefix)+len(ext) {
+			continue
+		}
+		n, err := strconv.Atoi(name[len(prefix) : len(name)-len(ext)])
+		if err == nil && n > last && filepath.Base(RotatedPath(path, n)) == name {
+			last = n
+		}
+	}
+	return last
+}
+
+// Rotate writes the entries to the next rotated file, and forgets them.
+func (r *Recorder) Rotate() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rotate()
+}
+
+func (r *Recorder) rotate() error {
+	if err := r.write(RotatedPath(r.path, r.rotations+1)); err != nil {
+		return err
+	}
+	r.rotations++
+	r.entries = nil
+	return nil
+}
+
+// Close writes the entries to the path. The recorder keeps them, thus can
+// still be used.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.write(r.path)
+}
+
+// write writes the entries to a temporary file, renamed to the path once
+// complete. The file is only readable by its owner, since it holds secrets.
+func (r *Recorder) write(path string) error {
+	entries := r.entries
+	if entries == nil {
+		entries = []Entry{}
+	}
+	content, err := json.MarshalIndent(HAR{Log: Log{
+		Version: "1.2",
+		Creator: r.creator,
+		Entries: entries,
+	}}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
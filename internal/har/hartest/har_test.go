@@ -0,0 +1,118 @@
+package hartest
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ajabep/unmtlsproxy/internal/har"
+)
+
+func readHAR(t *testing.T, path string) har.HAR {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Cannot read the HAR file: %s", err)
+	}
+	var h har.HAR
+	if err := json.Unmarshal(content, &h); err != nil {
+		t.Fatalf("Invalid HAR file: %s", err)
+	}
+	if h.Log.Version != "1.2" || h.Log.Creator.Name != "unmtlsproxy" {
+		t.Errorf("Unexpected HAR log: %+v", h.Log)
+	}
+	return h
+}
+
+func entry(url string) har.Entry {
+	return har.Entry{Request: har.Request{Method: "GET", URL: url}}
+}
+
+func TestRotatedPath(t *testing.T) {
+	testcases := []struct {
+		path     string
+		n        int
+		expected string
+	}{
+		{"capture.har", 1, "capture.1.har"},
+		{"/tmp/capture.har", 12, "/tmp/capture.12.har"},
+		{"capture", 2, "capture.2"},
+	}
+	for _, testcase := range testcases {
+		if rotated := har.RotatedPath(testcase.path, testcase.n); rotated != testcase.expected {
+			t.Errorf("%s, %d: expected %s, got %s", testcase.path, testcase.n, testcase.expected, rotated)
+		}
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.har")
+	recorder := har.NewRecorder(path, 2, har.Creator{Name: "unmtlsproxy", Version: "test"})
+
+	// Nothing recorded yet: the file is still valid
+	if err := recorder.Close(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if h := readHAR(t, path); h.Log.Entries == nil || len(h.Log.Entries) != 0 {
+		t.Errorf("Unexpected entries: %v", h.Log.Entries)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("The HAR file is readable by others: %s", info.Mode())
+	}
+
+	// The second entry triggers a rotation
+	for _, url := range []string{"https://a/1", "https://a/2", "https://a/3"} {
+		if err := recorder.Add(entry(url)); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	if h := readHAR(t, har.RotatedPath(path, 1)); len(h.Log.Entries) != 2 || h.Log.Entries[1].Request.URL != "https://a/2" {
+		t.Errorf("Unexpected rotated entries: %v", h.Log.Entries)
+	}
+
+	if err := recorder.Rotate(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if h := readHAR(t, har.RotatedPath(path, 2)); len(h.Log.Entries) != 1 || h.Log.Entries[0].Request.URL != "https://a/3" {
+		t.Errorf("Unexpected rotated entries: %v", h.Log.Entries)
+	}
+
+	if err := recorder.Add(entry("https://a/4")); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if h := readHAR(t, path); len(h.Log.Entries) != 1 || h.Log.Entries[0].Request.URL != "https://a/4" {
+		t.Errorf("Unexpected entries: %v", h.Log.Entries)
+	}
+}
+
+func TestRecorderKeepsPreviousRotations(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "capture.har")
+	// The rotated files of a previous run, and files which are not
+	for _, name := range []string{"capture.1.har", "capture.3.har", "capture.x.har", "capture.9.json", "other.7.har"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("previous"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recorder := har.NewRecorder(path, 0, har.Creator{Name: "unmtlsproxy", Version: "test"})
+	if err := recorder.Add(entry("https://a/1")); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := recorder.Rotate(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if h := readHAR(t, har.RotatedPath(path, 4)); len(h.Log.Entries) != 1 || h.Log.Entries[0].Request.URL != "https://a/1" {
+		t.Errorf("Unexpected rotated entries: %v", h.Log.Entries)
+	}
+	if content, err := os.ReadFile(har.RotatedPath(path, 3)); err != nil || string(content) != "previous" {
+		t.Errorf("The previous rotated file has been overwritten: %q, %v", content, err)
+	}
+}
@@ -0,0 +1,290 @@
+// Copyright 2024 Ajabep
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpproxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/ajabep/unmtlsproxy/internal/configuration"
+	"github.com/ajabep/unmtlsproxy/internal/log"
+	"github.com/ajabep/unmtlsproxy/internal/lru"
+	"github.com/ajabep/unmtlsproxy/internal/mint"
+	"github.com/ajabep/unmtlsproxy/internal/relay"
+	"github.com/ajabep/unmtlsproxy/internal/scope"
+	"github.com/ajabep/unmtlsproxy/internal/upstream"
+)
+
+var ErrInvalidDestination = errors.New("invalid destination")
+
+// The destinations come from the clients: only the handlers of the most
+// recently used ones are kept
+const maxBackendHandlers = 100
+
+// forwardDestination returns the destination of a forward proxy request. If
+// the destination is reached with TLS, the plaintext HTTP port is mapped to
+// the HTTPS one. The port is required for the CONNECT requests.
+func forwardDestination(hostport string, connect, withTLS bool) (configuration.Addr, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		if connect {
+			return configuration.Addr{}, fmt.Errorf("%w: %s", ErrInvalidDestination, hostport)
+		}
+		host, port = hostport, "80"
+	}
+	if host == "" {
+		return configuration.Addr{}, fmt.Errorf("%w: %s", ErrInvalidDestination, hostport)
+	}
+	if withTLS && port == "80" {
+		port = "443"
+	}
+	portInt, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || portInt == 0 {
+		return configuration.Addr{}, fmt.Errorf("%w: %s", ErrInvalidDestination, hostport)
+	}
+	return configuration.Addr{Hostname: host, Port: uint16(portInt)}, nil
+}
+
+// forwardProxy is an HTTP proxy sending the requests of its clients to their
+// HTTPS destination, with the client certificates.
+type forwardProxy struct {
+	scope     *scope.Scope
+	authority *mint.Authority
+	// dialer opens the passed through tunnels
+	dialer   upstream.Dialer
+	timeouts upstream.Timeouts
+	// makeBackendHandler returns the handler sending the requests to a
+	// destination. They are cached, to reuse their connections.
+	makeBackendHandler func(dest configuration.Addr) http.Handler
+
+	handlersMu sync.Mutex
+	handlers   *lru.Cache[configuration.Addr, http.Handler]
+}
+
+// newForwardProxy returns a forward proxy restricted to the scope. If the
+// authority is set, the CONNECT tunnels are intercepted with certificates it
+// issues; otherwise, they are passed through.
+func newForwardProxy(scope *scope.Scope, authority *mint.Authority, dialer upstream.Dialer, timeouts upstream.Timeouts, makeBackendHandler func(dest configuration.Addr) http.Handler) *forwardProxy {
+	return &forwardProxy{
+		scope:              scope,
+		authority:          authority,
+		dialer:             dialer,
+		timeouts:           timeouts,
+		makeBackendHandler: makeBackendHandler,
+		handlers:           lru.New(maxBackendHandlers, closeIdleConnections),
+	}
+}
+
+// closeIdleConnections closes the connections the dropped handler keeps for
+// reuse. The requests it is serving go on.
+func closeIdleConnections(dest configuration.Addr, handler http.Handler) {
+	if h, ok := handler.(interface{ CloseIdleConnections() }); ok {
+		log.Debug("Dropping the connections to a destination", "destination", dest)
+		h.CloseIdleConnections()
+	}
+}
+
+func (p *forwardProxy) backendHandler(dest configuration.Addr) http.Handler {
+	p.handlersMu.Lock()
+	defer p.handlersMu.Unlock()
+	if handler, has := p.handlers.Get(dest); has {
+		return handler
+	}
+	handler := p.makeBackendHandler(dest)
+	p.handlers.Add(dest, handler)
+	return handler
+}
+
+// allowed answers 403 if the destination is out of the scope.
+func (p *forwardProxy) allowed(w http.ResponseWriter, req *http.Request, dest configuration.Addr) bool {
+	if p.scope.Allowed(dest.Hostname, dest.Port) {
+		return true
+	}
+	log.Warn("Rejected a request to a destination out of the scope", "client", req.RemoteAddr, "method", req.Method, "destination", dest)
+	http.Error(w, "destination out of the scope: "+dest.String(), http.StatusForbidden)
+	return false
+}
+
+func (p *forwardProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodConnect {
+		p.handleConnect(w, req)
+		return
+	}
+
+	if !req.URL.IsAbs() {
+		log.Error("Received a request which is not a proxy one", "client", req.RemoteAddr, "url", req.URL)
+		http.Error(w, "not a proxy request: the URL has to be absolute", http.StatusBadRequest)
+		return
+	}
+	dest, err := forwardDestination(req.URL.Host, false, true)
+	if err != nil {
+		log.Error("Cannot parse the destination", "err", err, "url", req.URL)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !p.allowed(w, req, dest) {
+		return
+	}
+
+	log.Debug("Forwarding a request", "destination", dest, "url", req.URL)
+	p.backendHandler(dest).ServeHTTP(w, req)
+}
+
+// handleConnect opens the tunnel requested by the client, then either
+// intercepts it or passes it through.
+func (p *forwardProxy) handleConnect(w http.ResponseWriter, req *http.Request) {
+	dest, err := forwardDestination(req.Host, true, p.authority != nil)
+	if err != nil {
+		log.Error("Cannot parse the destination", "err", err, "host", req.Host)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !p.allowed(w, req, dest) {
+		return
+	}
+
+	var backend net.Conn
+	if p.authority == nil {
+		address := net.JoinHostPort(dest.Hostname, strconv.Itoa(int(dest.Port)))
+		backend, err = upstream.WithDialTimeout(p.dialer, p.timeouts.Dial).DialContext(req.Context(), "tcp", address)
+		if err != nil {
+			log.Error("Cannot connect to the destination", "err", err, "destination", dest)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer backend.Close()
+	}
+
+	conn, brw, release, err := hijack(w, req)
+	if err != nil {
+		log.Error("Cannot take over the client connection", "err", err, "destination", dest)
+		http.Error(w, "cannot open a tunnel: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer release()
+	defer conn.Close()
+
+	if _, err := io.WriteString(brw, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		log.Error("Cannot send the tunnel response to the client of the proxy", "err", err)
+		return
+	}
+	if err := brw.Flush(); err != nil {
+		log.Error("Cannot send the tunnel response to the client of the proxy", "err", err)
+		return
+	}
+	// Bytes already read by the HTTP server are in the buffered reader.
+	// Without them, the sockets are kept as is, for the kernel to copy the
+	// tunnel
+	if brw.Reader.Buffered() > 0 {
+		conn = &relay.BufferedConn{Conn: conn, Reader: brw.Reader}
+	}
+
+	if p.authority == nil {
+		log.Debug("Passing a tunnel through", "destination", dest)
+		err := relay.Pipe(req.Context(), conn, backend, p.timeouts.Idle)
+		log.Debug("Closing the tunnel", "destination", dest, "err", err)
+		return
+	}
+
+	log.Debug("Intercepting a tunnel", "destination", dest)
+	p.intercept(conn, dest)
+}
+
+// intercept terminates the TLS of the tunnel, and sends its requests to the
+// destination.
+func (p *forwardProxy) intercept(conn net.Conn, dest configuration.Addr) {
+	tlsConn := tls.Server(conn, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName == "" {
+				return p.authority.Issue(dest.Hostname)
+			}
+			return p.authority.GetCertificate(hello)
+		},
+		NextProtos: []string{"http/1.1"},
+	})
+
+	backendHandler := p.backendHandler(dest)
+	server := &http.Server{
+		// The requests are sent to the tunnel destination, whatever their
+		// Host header
+		Handler: backendHandler,
+		// It also bounds the TLS handshake with the client
+		ReadHeaderTimeout: p.timeouts.Handshake,
+		IdleTimeout:       p.timeouts.Idle,
+	}
+	listener := newOneConnListener(tlsConn)
+	if err := server.Serve(listener); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Error("Cannot serve the intercepted tunnel", "err", err, "destination", dest)
+	}
+	listener.wait()
+	log.Debug("Closing the intercepted tunnel", "destination", dest)
+}
+
+// oneConnListener is a listener accepting a single, already established,
+// connection. Its next Accept calls block until the connection is closed.
+type oneConnListener struct {
+	conn   net.Conn
+	once   sync.Once
+	closed chan struct{}
+	closer sync.Once
+}
+
+func newOneConnListener(conn net.Conn) *oneConnListener {
+	l := &oneConnListener{closed: make(chan struct{})}
+	l.conn = &notifyingConn{Conn: conn, closed: l.close}
+	return l
+}
+
+func (l *oneConnListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.once.Do(func() { conn = l.conn })
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *oneConnListener) close() {
+	l.closer.Do(func() { close(l.closed) })
+}
+
+func (l *oneConnListener) Close() error {
+	l.close()
+	return nil
+}
+
+func (l *oneConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// wait blocks until the connection is closed.
+func (l *oneConnListener) wait() {
+	<-l.closed
+}
+
+// notifyingConn calls a function when it is closed.
+type notifyingConn struct {
+	net.Conn
+	closed func()
+}
+
+func (c *notifyingConn) Close() error {
+	defer c.closed()
+	return c.Conn.Close()
+}
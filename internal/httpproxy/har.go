@@ -0,0 +1,383 @@
+// Copyright 2024 Ajabep
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ajabep/unmtlsproxy/internal/har"
+	"github.com/ajabep/unmtlsproxy/internal/log"
+	"github.com/ajabep/unmtlsproxy/internal/upstream"
+)
+
+// harRecorder records the exchanges with the backends.
+type harRecorder struct {
+	*har.Recorder
+	// bodyMaxSize is the size above which the bodies are truncated
+	bodyMaxSize int64
+}
+
+// captureKey is the context key of the capture of a request.
+type captureKey struct{}
+
+// certConn is a connection to a backend, knowing the client certificate sent
+// during its handshake.
+type certConn struct {
+	net.Conn
+	certificate atomic.Pointer[tls.Certificate]
+}
+
+// captureClientCertificates makes the transport connections remember their
+// client certificate, for the captures.
+func captureClientCertificates(transport *http.Transport, dialer upstream.Dialer) {
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		cc := &certConn{Conn: conn}
+		// The handshake context has the values of the dial one
+		if c, ok := ctx.Value(captureKey{}).(*capture); ok {
+			c.setDialed(cc)
+		}
+		return cc, nil
+	}
+
+	getClientCertificate := transport.TLSClientConfig.GetClientCertificate
+	if getClientCertificate == nil {
+		return
+	}
+	transport.TLSClientConfig = transport.TLSClientConfig.Clone()
+	transport.TLSClientConfig.GetClientCertificate = func(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		certificate, err := getClientCertificate(info)
+		if c, ok := info.Context().Value(captureKey{}).(*capture); ok && certificate != nil {
+			if cc := c.getDialed(); cc != nil {
+				cc.certificate.Store(certificate)
+			}
+		}
+		return certificate, err
+	}
+}
+
+// capturedBody keeps the first bytes of the body read through it.
+type capturedBody struct {
+	io.ReadCloser
+	maxSize int64
+
+	mu     sync.Mutex
+	buffer bytes.Buffer
+	size   int64
+}
+
+func (b *capturedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.size += int64(n)
+	if remaining := b.maxSize - int64(b.buffer.Len()); remaining > 0 {
+		b.buffer.Write(p[:min(int64(n), remaining)])
+	}
+	return n, err
+}
+
+// content returns the captured bytes, as UTF-8 text or in base64, and the
+// size of the body.
+func (b *capturedBody) content() (text, encoding string, size int64, truncated bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	data := b.buffer.Bytes()
+	if utf8.Valid(data) {
+		text = string(data)
+	} else {
+		text, encoding = base64.StdEncoding.EncodeToString(data), "base64"
+	}
+	return text, encoding, b.size, b.size > int64(b.buffer.Len())
+}
+
+// capture records an exchange with a backend.
+type capture struct {
+	recorder *harRecorder
+	started  time.Time
+
+	mu           sync.Mutex
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	gotConn      time.Time
+	wroteRequest time.Time
+	firstByte    time.Time
+	conn         net.Conn
+	// dialed is the connection dialed for this exchange, if any
+	dialed *certConn
+
+	requestBody    *capturedBody
+	responseBody   *capturedBody
+	responseHeader http.Header
+}
+
+func (r *harRecorder) newCapture() *capture {
+	return &capture{recorder: r, started: time.Now()}
+}
+
+func (c *capture) setDialed(cc *certConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dialed = cc
+}
+
+func (c *capture) getDialed() *certConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.dialed
+}
+
+// now sets the time to the current one.
+func (c *capture) now(t *time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	*t = time.Now()
+}
+
+// start instruments the request, before it is sent.
+func (c *capture) start(req *http.Request) *http.Request {
+	trace := &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { c.now(&c.dnsStart) },
+		DNSDone:           func(httptrace.DNSDoneInfo) { c.now(&c.dnsDone) },
+		ConnectStart:      func(string, string) { c.now(&c.connectStart) },
+		ConnectDone:       func(string, string, error) { c.now(&c.connectDone) },
+		TLSHandshakeStart: func() { c.now(&c.tlsStart) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { c.now(&c.tlsDone) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			c.now(&c.gotConn)
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.conn = info.Conn
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { c.now(&c.wroteRequest) },
+		GotFirstResponseByte: func() { c.now(&c.firstByte) },
+	}
+	ctx := httptrace.WithClientTrace(req.Context(), trace)
+	req = req.WithContext(context.WithValue(ctx, captureKey{}, c))
+	if req.Body != nil && req.Body != http.NoBody {
+		c.requestBody = &capturedBody{ReadCloser: req.Body, maxSize: c.recorder.bodyMaxSize}
+		req.Body = c.requestBody
+	}
+	return req
+}
+
+// gotResponse captures the response of the backend, before it is edited. The
+// body of a protocol switch is the switched stream: it is left as is, to be
+// written.
+func (c *capture) gotResponse(resp *http.Response) {
+	c.responseHeader = resp.Header.Clone()
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return
+	}
+	c.responseBody = &capturedBody{ReadCloser: resp.Body, maxSize: c.recorder.bodyMaxSize}
+	resp.Body = c.responseBody
+}
+
+// milliseconds returns the duration between the times, or -1 if one of them
+// is unknown.
+func milliseconds(from, to time.Time) float64 {
+	if from.IsZero() || to.IsZero() {
+		return -1
+	}
+	return float64(to.Sub(from).Microseconds()) / 1000
+}
+
+func nameValues(values map[string][]string) []har.NameValue {
+	list := []har.NameValue{}
+	for name, vv := range values {
+		for _, v := range vv {
+			list = append(list, har.NameValue{Name: name, Value: v})
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func harCookies(cookies []*http.Cookie) []har.Cookie {
+	list := []har.Cookie{}
+	for _, cookie := range cookies {
+		c := har.Cookie{
+			Name:     cookie.Name,
+			Value:    cookie.Value,
+			Path:     cookie.Path,
+			Domain:   cookie.Domain,
+			HTTPOnly: cookie.HttpOnly,
+			Secure:   cookie.Secure,
+		}
+		if !cookie.Expires.IsZero() {
+			c.Expires = &cookie.Expires
+		}
+		list = append(list, c)
+	}
+	return list
+}
+
+func harTLS(state *tls.ConnectionState) *har.TLS {
+	if state == nil {
+		return nil
+	}
+	peers := []string{}
+	for _, cert := range state.PeerCertificates {
+		peers = append(peers, cert.Subject.String())
+	}
+	return &har.TLS{
+		Version:            tls.VersionName(state.Version),
+		CipherSuite:        tls.CipherSuiteName(state.CipherSuite),
+		ServerName:         state.ServerName,
+		NegotiatedProtocol: state.NegotiatedProtocol,
+		DidResume:          state.DidResume,
+		PeerCertificates:   peers,
+	}
+}
+
+// harClientCertificate describes the client certificate sent on the
+// connection, if any.
+func harClientCertificate(conn net.Conn) *har.ClientCertificate {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	cc, ok := tlsConn.NetConn().(*certConn)
+	if !ok {
+		return nil
+	}
+	certificate := cc.certificate.Load()
+	if certificate == nil || len(certificate.Certificate) == 0 {
+		return nil
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return nil
+	}
+	fingerprint := sha256.Sum256(leaf.Raw)
+	return &har.ClientCertificate{
+		Subject:      leaf.Subject.String(),
+		Issuer:       leaf.Issuer.String(),
+		SerialNumber: leaf.SerialNumber.String(),
+		SHA256:       hex.EncodeToString(fingerprint[:]),
+	}
+}
+
+// finish records the exchange. The response is nil if the request failed.
+func (c *capture) finish(req *http.Request, resp *http.Response, err error) {
+	end := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := har.Entry{
+		StartedDateTime: c.started,
+		Request: har.Request{
+			Method:      req.Method,
+			URL:         req.URL.String(),
+			HTTPVersion: req.Proto,
+			Cookies:     harCookies(req.Cookies()),
+			Headers:     append([]har.NameValue{{Name: "Host", Value: req.Host}}, nameValues(req.Header)...),
+			QueryString: nameValues(req.URL.Query()),
+			HeadersSize: -1,
+		},
+		Response: har.Response{
+			Cookies:     []har.Cookie{},
+			Headers:     []har.NameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		ClientCert: harClientCertificate(c.conn),
+	}
+	if c.requestBody != nil {
+		text, encoding, size, truncated := c.requestBody.content()
+		entry.Request.BodySize = size
+		entry.Request.PostData = &har.PostData{MimeType: req.Header.Get("Content-Type"), Text: text, Encoding: encoding}
+		if truncated {
+			entry.Request.PostData.Comment = "truncated"
+		}
+	}
+	if c.conn != nil {
+		if host, _, err := net.SplitHostPort(c.conn.RemoteAddr().String()); err == nil {
+			entry.ServerIPAddress = host
+		}
+		if _, port, err := net.SplitHostPort(c.conn.LocalAddr().String()); err == nil {
+			entry.Connection = port
+		}
+	}
+
+	if resp == nil {
+		entry.Response.Error = err.Error()
+	} else {
+		entry.Request.HTTPVersion = resp.Proto
+		entry.TLS = harTLS(resp.TLS)
+		entry.Response.Status = resp.StatusCode
+		entry.Response.StatusText = http.StatusText(resp.StatusCode)
+		entry.Response.HTTPVersion = resp.Proto
+		entry.Response.Cookies = harCookies((&http.Response{Header: c.responseHeader}).Cookies())
+		entry.Response.Headers = nameValues(c.responseHeader)
+		entry.Response.RedirectURL = c.responseHeader.Get("Location")
+		entry.Response.Content.MimeType = c.responseHeader.Get("Content-Type")
+		if c.responseBody != nil {
+			text, encoding, size, truncated := c.responseBody.content()
+			entry.Response.BodySize = size
+			entry.Response.Content.Size = size
+			entry.Response.Content.Text = text
+			entry.Response.Content.Encoding = encoding
+			if truncated {
+				entry.Response.Content.Comment = "truncated"
+			}
+		}
+	}
+
+	// The connect time includes the TLS handshake
+	connectDone := c.connectDone
+	if !c.tlsDone.IsZero() {
+		connectDone = c.tlsDone
+	}
+	entry.Timings = har.Timings{
+		DNS:     milliseconds(c.dnsStart, c.dnsDone),
+		Connect: milliseconds(c.connectStart, connectDone),
+		SSL:     milliseconds(c.tlsStart, c.tlsDone),
+		Send:    max(milliseconds(c.gotConn, c.wroteRequest), 0),
+		Wait:    max(milliseconds(c.wroteRequest, c.firstByte), 0),
+		Receive: max(milliseconds(c.firstByte, end), 0),
+	}
+	entry.Timings.Blocked = milliseconds(c.started, c.gotConn)
+	if entry.Timings.Blocked != -1 {
+		entry.Timings.Blocked = max(entry.Timings.Blocked-max(entry.Timings.DNS, 0)-max(entry.Timings.Connect, 0), 0)
+	}
+	for _, t := range []float64{entry.Timings.Blocked, entry.Timings.DNS, entry.Timings.Connect, entry.Timings.Send, entry.Timings.Wait, entry.Timings.Receive} {
+		entry.Time += max(t, 0)
+	}
+
+	if err := c.recorder.Add(entry); err != nil {
+		log.Error("Cannot rotate the HAR file", "err", err)
+	}
+	log.Debug("Recorded an exchange", "url", entry.Request.URL, "status", entry.Response.Status)
+}
@@ -0,0 +1,121 @@
+// Copyright 2024 Ajabep
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpproxy
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// hopByHopHeaders are only meaningful for a single connection (RFC 9110,
+// section 7.6.1), or address the proxy itself.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHopHeaders removes the hop-by-hop headers, and the ones listed in
+// the Connection header.
+func removeHopByHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+// prepareRequestHeaders removes the hop-by-hop headers of the request, except
+// the ones required to switch protocols and to receive trailers.
+func prepareRequestHeaders(req *http.Request) {
+	upgrade := upgradeType(req.Header)
+	trailers := headerContainsToken(req.Header["Te"], "trailers")
+
+	removeHopByHopHeaders(req.Header)
+
+	if upgrade != "" {
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", upgrade)
+	}
+	if trailers {
+		req.Header.Set("Te", "trailers")
+	}
+}
+
+// addForwardedHeaders appends the client address, and the host and scheme it
+// used, to the X-Forwarded-* and the Forwarded (RFC 7239) headers. It has to
+// be called before rewriting the host of the request.
+func addForwardedHeaders(req *http.Request) {
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+
+	// Unix sockets clients have no address
+	var clientIP string
+	if addrPort, err := netip.ParseAddrPort(req.RemoteAddr); err == nil {
+		clientIP = addrPort.Addr().Unmap().String()
+	}
+
+	if clientIP != "" {
+		if prior := req.Header.Values("X-Forwarded-For"); len(prior) != 0 {
+			req.Header.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+clientIP)
+		} else {
+			req.Header.Set("X-Forwarded-For", clientIP)
+		}
+	}
+	req.Header.Set("X-Forwarded-Host", req.Host)
+	req.Header.Set("X-Forwarded-Proto", proto)
+
+	forwardedFor := "unknown"
+	if clientIP != "" {
+		forwardedFor = clientIP
+		if strings.Contains(clientIP, ":") {
+			forwardedFor = "[" + clientIP + "]"
+		}
+	}
+	element := "for=" + quoteForwarded(forwardedFor) + ";host=" + quoteForwarded(req.Host) + ";proto=" + proto
+	if prior := req.Header.Values("Forwarded"); len(prior) != 0 {
+		element = strings.Join(prior, ", ") + ", " + element
+	}
+	req.Header.Set("Forwarded", element)
+}
+
+// quoteForwarded quotes the value of a Forwarded parameter, if it is not a
+// token.
+func quoteForwarded(value string) string {
+	for _, r := range value {
+		if !isTokenChar(r) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+		}
+	}
+	if value == "" {
+		return `""`
+	}
+	return value
+}
+
+func isTokenChar(r rune) bool {
+	return r < 0x7f && r > 0x20 && !strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r)
+}
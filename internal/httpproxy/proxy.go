@@ -12,66 +12,203 @@
 package httpproxy
 
 import (
+	"context"
 	"crypto/tls"
-	"io"
-	"net"
+	"errors"
 	"net/http"
-	"os"
-	"os/signal"
+	"net/url"
+	"slices"
+	"sync"
 	"time"
 
+	"github.com/ajabep/unmtlsproxy/internal/access"
 	"github.com/ajabep/unmtlsproxy/internal/configuration"
+	"github.com/ajabep/unmtlsproxy/internal/har"
+	"github.com/ajabep/unmtlsproxy/internal/identity"
+	"github.com/ajabep/unmtlsproxy/internal/lifecycle"
+	"github.com/ajabep/unmtlsproxy/internal/listener"
 	"github.com/ajabep/unmtlsproxy/internal/log"
+	"github.com/ajabep/unmtlsproxy/internal/mint"
+	"github.com/ajabep/unmtlsproxy/internal/upstream"
+	"github.com/ajabep/unmtlsproxy/internal/verify"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
-func makeHandleHTTP(dest configuration.Addr, tlsConfig *tls.Config, reuseSockets bool) func(w http.ResponseWriter, req *http.Request) {
-	log.Debug("Parsing destination end", "destination", dest)
-	if dest.Port == 80 {
-		log.Fatal("Cannot use an HTTP backend")
-	}
-
-	rewriteHost := dest.String()
-	rewriteSchema := "https"
-	hostAttr := dest.Hostname
-	if dest.Port != 443 {
-		hostAttr = dest.String()
-	}
+// Time after which the backend connections kept for reuse are closed, if no
+// idle timeout is set
+const defaultIdleConnTimeout = 90 * time.Second
 
-	log.Debug("Building the TLS client configuration")
+func newTransport(tlsConfig *tls.Config, dialer upstream.Dialer, timeouts upstream.Timeouts, reuseSockets, attemptHTTP2, capture bool) *http.Transport {
 	maxIdleConns := 1
 	idleConnTimeout := 1 * time.Microsecond
 	disableKeepAlives := !reuseSockets
 	if reuseSockets {
 		maxIdleConns = 100
-		idleConnTimeout = 90 * time.Second
+		idleConnTimeout = defaultIdleConnTimeout
+		if timeouts.Idle > 0 {
+			idleConnTimeout = timeouts.Idle
+		}
 	}
 
 	// It establishes network connections as needed
-	// and caches them for reuse by subsequent calls. It uses HTTP proxies
-	// as directed by the environment variables HTTP_PROXY, HTTPS_PROXY
-	// and NO_PROXY (or the lowercase versions thereof).
-	var transport http.RoundTripper = &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
+	// and caches them for reuse by subsequent calls. Without upstream proxy,
+	// it uses HTTP proxies as directed by the environment variables
+	// HTTP_PROXY, HTTPS_PROXY and NO_PROXY (or the lowercase versions
+	// thereof).
+	proxy := http.ProxyFromEnvironment
+	if dialer != upstream.Direct {
+		proxy = nil
+	}
+	dialer = upstream.WithDialTimeout(dialer, timeouts.Dial)
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
 		TLSClientConfig:       tlsConfig,
 		MaxIdleConns:          maxIdleConns,
 		IdleConnTimeout:       idleConnTimeout,
-		TLSHandshakeTimeout:   10 * time.Second,
+		TLSHandshakeTimeout:   timeouts.Handshake,
 		ExpectContinueTimeout: 1 * time.Second,
 		DisableKeepAlives:     disableKeepAlives,
+		// A custom dialer and TLS configuration disable HTTP/2, unless forced
+		ForceAttemptHTTP2: attemptHTTP2,
+	}
+	if capture {
+		captureClientCertificates(transport, dialer)
+	}
+	return transport
+}
+
+// backendTransports are the transports using a client certificate. The
+// protocol switches only exist in HTTP/1.1: the requests asking for one have
+// their own transport, which never negotiates HTTP/2.
+type backendTransports struct {
+	main    *http.Transport
+	upgrade *http.Transport
+}
+
+func newBackendTransports(tlsConfig *tls.Config, dialer upstream.Dialer, timeouts upstream.Timeouts, reuseSockets, attemptHTTP2, capture bool) *backendTransports {
+	upgradeTLSConfig := tlsConfig.Clone()
+	upgradeTLSConfig.NextProtos = []string{"http/1.1"}
+	return &backendTransports{
+		main:    newTransport(tlsConfig, dialer, timeouts, reuseSockets, attemptHTTP2, capture),
+		upgrade: newTransport(upgradeTLSConfig, dialer, timeouts, reuseSockets, false, capture),
+	}
+}
+
+// forRequest returns the transport of the request.
+func (t *backendTransports) forRequest(req *http.Request) *http.Transport {
+	if upgradeType(req.Header) != "" {
+		return t.upgrade
+	}
+	return t.main
+}
+
+// closeIdleConnections closes the connections kept for reuse.
+func (t *backendTransports) closeIdleConnections() {
+	t.main.CloseIdleConnections()
+	t.upgrade.CloseIdleConnections()
+}
+
+// backendHandler sends the requests to a backend.
+type backendHandler struct {
+	http.HandlerFunc
+	closeIdleConnections func()
+}
+
+// CloseIdleConnections closes the backend connections kept for reuse. The
+// handler can still be used afterward.
+func (h *backendHandler) CloseIdleConnections() {
+	h.closeIdleConnections()
+}
+
+// backendHost returns the host of the backend, as in its URLs: without the
+// default port.
+func backendHost(dest configuration.Addr) string {
+	if dest.Port != 443 {
+		return dest.String()
 	}
+	return dest.Hostname
+}
+
+func makeHandleHTTP(dest configuration.Addr, tlsConfig *tls.Config, dialer upstream.Dialer, timeouts upstream.Timeouts, reuseSockets, attemptHTTP2 bool, store *identity.Store, identityHeader string, forwardedHeaders bool, rewriter *rewriter, recorder *harRecorder) *backendHandler {
+	log.Debug("Parsing destination end", "destination", dest)
+	if dest.Port == 80 {
+		log.Fatal("Cannot use an HTTP backend")
+	}
+
+	rewriteHost := dest.String()
+	rewriteSchema := "https"
+	hostAttr := backendHost(dest)
+
+	log.Debug("Building the TLS client configuration")
+	transports := newBackendTransports(tlsConfig, dialer, timeouts, reuseSockets, attemptHTTP2, recorder != nil)
+
+	// Each named identity has its own transport, thus its own connection
+	// pool: a TLS connection is bound to the client certificate used during
+	// its handshake. They are built on demand, since the named identities can
+	// change when the certificates are reloaded.
+	var identityTransportsMu sync.Mutex
+	identityTransports := map[string]*backendTransports{}
+	getIdentityTransports := func(name string) (*backendTransports, bool) {
+		if !store.Has(name) {
+			return nil, false
+		}
+
+		identityTransportsMu.Lock()
+		defer identityTransportsMu.Unlock()
+		if tr, has := identityTransports[name]; has {
+			return tr, true
+		}
 
-	return func(w http.ResponseWriter, req *http.Request) {
+		log.Debug("Building the TLS client configuration of a named identity", "identity", name)
+		identityTLSConfig := tlsConfig.Clone()
+		identityTLSConfig.GetClientCertificate = store.Named(name)
+		identityTransports[name] = newBackendTransports(identityTLSConfig, dialer, timeouts, reuseSockets, attemptHTTP2, recorder != nil)
+		return identityTransports[name], true
+	}
+
+	closeIdleConnections := func() {
+		transports.closeIdleConnections()
+		identityTransportsMu.Lock()
+		defer identityTransportsMu.Unlock()
+		for _, tr := range identityTransports {
+			tr.closeIdleConnections()
+		}
+	}
+
+	serve := func(w http.ResponseWriter, req *http.Request) {
 		log.Debug("Received a request", "req", req)
 
-		if !reuseSockets {
-			if tr, ok := transport.(*http.Transport); ok {
-				log.Debug("Closing old idle connections")
-				tr.CloseIdleConnections()
+		transports := transports
+		if name := req.Header.Get(identityHeader); name != "" {
+			var has bool
+			if transports, has = getIdentityTransports(name); !has {
+				log.Error("Unknown identity requested", "identity", name)
+				http.Error(w, "unknown identity: "+name, http.StatusBadRequest)
+				return
 			}
+			log.Debug("Using a named identity", "identity", name)
+		}
+		req.Header.Del(identityHeader)
+
+		prepareRequestHeaders(req)
+		if forwardedHeaders {
+			addForwardedHeaders(req)
+		}
+
+		if !reuseSockets {
+			log.Debug("Closing old idle connections")
+			transports.closeIdleConnections()
+		}
+
+		// The origin used by the client, to map the backend one to it
+		origin := &url.URL{Scheme: "http", Host: req.Host}
+		if req.TLS != nil {
+			origin.Scheme = "https"
+		}
+		if rewriter != nil {
+			rewriter.prepareRequest(req)
 		}
 
 		log.Debug("Edit the request", "req", req)
@@ -79,53 +216,184 @@ func makeHandleHTTP(dest configuration.Addr, tlsConfig *tls.Config, reuseSockets
 		req.URL.Scheme = rewriteSchema
 		req.Host = hostAttr
 
+		// Stop reading the backend response as soon as the client leaves
+		ctx, cancel := context.WithCancel(req.Context())
+		defer cancel()
+		req = req.WithContext(ctx)
+
+		var exchange *capture = nil
+		if recorder != nil {
+			exchange = recorder.newCapture()
+			req = exchange.start(req)
+		}
+
 		log.Debug("Sending the edited request", "req", req)
-		resp, err := transport.RoundTrip(req)
+		resp, err := transports.forRequest(req).RoundTrip(req)
 		if err != nil {
 			log.Error("Cannot RoundTrip a request", "err", err, "req", req)
+			if exchange != nil {
+				exchange.finish(req, nil, err)
+			}
 			http.Error(w, err.Error(), http.StatusServiceUnavailable)
 			return
 		}
 
 		defer resp.Body.Close()
+		if exchange != nil {
+			exchange.gotResponse(resp)
+			// Once the body has been sent to the client
+			defer exchange.finish(req, resp, nil)
+		}
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			handleUpgrade(w, req, resp)
+			return
+		}
+
 		log.Debug("Sending back the headers", "resp", resp)
+		removeHopByHopHeaders(resp.Header)
+		if rewriter != nil {
+			if err := rewriter.rewriteResponse(resp, origin); err != nil {
+				log.Error("Cannot rewrite the response", "err", err, "resp", resp)
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+		}
 		for k, vv := range resp.Header {
 			for _, v := range vv {
 				w.Header().Add(k, v)
 			}
 		}
+		announceTrailers(w, resp)
 
 		log.Debug("Sending HTTP code", "code", resp.StatusCode)
 		w.WriteHeader(resp.StatusCode)
 
-		log.Debug("Sending back the body")
-		if _, err = io.Copy(w, resp.Body); err != nil {
+		streamed := isStreamed(resp)
+		log.Debug("Sending back the body", "streamed", streamed)
+		if err = copyBody(w, resp.Body, streamed); err != nil {
+			// The status is already sent: the client can only see a truncated
+			// response
 			log.Error("Cannot send the response to the client of the proxy", "err", err, "resp", resp, "w", w)
-			http.Error(w, err.Error(), http.StatusServiceUnavailable)
 			return
 		}
+		copyTrailers(w, resp)
 	}
+	return &backendHandler{HandlerFunc: serve, closeIdleConnections: closeIdleConnections}
 }
 
-// Start starts the proxy
-func Start(cfg *configuration.Configuration, tlsConfig *tls.Config) {
-	server := &http.Server{
-		Addr:    cfg.ParsedListen.String(),
-		Handler: http.HandlerFunc(makeHandleHTTP(cfg.ParsedBackend, tlsConfig, !cfg.DisableSocketReusing)),
+// Start starts the proxy. The server certificates of the backends are
+// verified by the verifier, except for the routes, whose TLS configurations
+// are in the order of `cfg.Routes`. It blocks until the proxy is shut down,
+// and returns the exit status.
+func Start(cfg *configuration.Configuration, tlsConfig *tls.Config, verifier *verify.Verifier, routeTLSConfigs []*tls.Config, listenTLSConfig *tls.Config, store *identity.Store) int {
+	authenticator := access.NewAuthenticator(cfg.ParsedBasicAuth, cfg.AuthBearers)
+	authenticate := authenticator.Handler
+	if cfg.AuthProxyHeader {
+		authenticate = authenticator.ProxyHandler
+	}
+	// HTTP/2 is negotiated with the backend, unless the ALPN protocols leave it out
+	attemptHTTP2 := len(cfg.ALPN) == 0 || slices.Contains(cfg.ALPN, "h2")
+	var recorder *harRecorder = nil
+	if cfg.HAROutPath != "" {
+		recorder = &harRecorder{
+			Recorder:    har.NewRecorder(cfg.HAROutPath, cfg.HARMaxEntries, har.Creator{Name: "unmtlsproxy", Version: configuration.Version}),
+			bodyMaxSize: int64(cfg.HARBodyMaxSize),
+		}
+	}
+	// The prefix is the one stripped from the requests, if any
+	makeBackendHandler := func(dest configuration.Addr, prefix string, tlsConfig *tls.Config) http.Handler {
+		var rewriter *rewriter = nil
+		if cfg.RewriteURLs {
+			rewriter = newRewriter(backendHost(dest), prefix, cfg.RewriteBodies, int64(cfg.RewriteBodyMaxSize))
+		}
+		return makeHandleHTTP(dest, tlsConfig, cfg.UpstreamDialer, cfg.Timeouts(), !cfg.DisableSocketReusing, attemptHTTP2, store, cfg.IdentityHeader, !cfg.NoForwardedHeaders, rewriter, recorder)
+	}
+
+	var handler http.Handler
+	switch {
+	case cfg.Mode == "forward":
+		var authority *mint.Authority = nil
+		if cfg.ForwardIntercept {
+			authority = cfg.ListenAuthority
+		}
+		handler = authenticator.ProxyHandler(newForwardProxy(cfg.ParsedScope, authority, cfg.UpstreamDialer, cfg.Timeouts(), func(dest configuration.Addr) http.Handler {
+			destTLSConfig := verifier.Config(tlsConfig, dest.Hostname)
+			if name := cfg.DestinationIdentityOf(dest.Hostname, dest.Port); name != "" {
+				log.Debug("Using a named identity for the destination", "destination", dest, "identity", name)
+				destTLSConfig.GetClientCertificate = store.Named(name)
+			}
+			return makeBackendHandler(dest, "", destTLSConfig)
+		}))
+	case len(cfg.Routes) != 0:
+		handler = makeBackendHandler(cfg.ParsedBackend, "", verifier.Config(tlsConfig, cfg.ParsedBackend.Hostname))
+		routes := make([]route, len(cfg.Routes))
+		for i := range cfg.Routes {
+			prefix := ""
+			if cfg.Routes[i].StripPrefix {
+				prefix = cfg.Routes[i].PathPrefix
+			}
+			routes[i] = route{
+				Route:   &cfg.Routes[i],
+				handler: makeBackendHandler(cfg.Routes[i].ParsedBackend, prefix, routeTLSConfigs[i]),
+			}
+			log.Info("Added a route", "route", cfg.Routes[i].String(), "backend", cfg.Routes[i].ParsedBackend, "stripPrefix", cfg.Routes[i].StripPrefix)
+		}
+		handler = authenticate(makeRouter(routes, handler, !cfg.NoForwardedHeaders))
+	default:
+		handler = authenticate(makeBackendHandler(cfg.ParsedBackend, "", verifier.Config(tlsConfig, cfg.ParsedBackend.Hostname)))
+	}
+	if cfg.H2C {
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+	server := newServer(&http.Server{
+		Addr:      cfg.ParsedListen.String(),
+		Handler:   handler,
+		TLSConfig: listenTLSConfig,
+		// It also bounds the TLS handshakes with the clients
+		ReadHeaderTimeout: cfg.HandshakeTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	})
+
+	// Before serving: the umask of the Unix sockets is process wide, and no
+	// file is created meanwhile
+	log.Debug("Listening the port", "listening", cfg.ParsedListen)
+	l, err := listener.Listen(cfg)
+	if err != nil {
+		log.Fatal("Unable to start proxy", "err", err)
 	}
+	l = access.NewFilter(cfg.ParsedAllowCIDRs, cfg.ParsedDenyCIDRs).Listener(l)
 
 	go func() {
-		log.Debug("Listening the port", "listening", cfg.ParsedListen)
-		if err := server.ListenAndServe(); err != nil {
+		var err error
+		if listenTLSConfig != nil {
+			// The certificates are already in the TLS configuration
+			err = server.ServeTLS(l, "", "")
+		} else {
+			err = server.Serve(l)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Fatal("Unable to start proxy", "err", err)
 		}
 	}()
 
-	log.Info("MTLSProxy is ready", "mode", cfg.Mode, "listen", cfg.ParsedListen, "backend", cfg.ParsedBackend)
+	if cfg.Mode == "forward" {
+		log.Info("MTLSProxy is ready", "mode", cfg.Mode, "listen", cfg.ParsedListen, "scope", cfg.Scope, "intercept", cfg.ForwardIntercept, "listenTLS", listenTLSConfig != nil)
+	} else {
+		log.Info("MTLSProxy is ready", "mode", cfg.Mode, "listen", cfg.ParsedListen, "backend", cfg.ParsedBackend, "listenTLS", listenTLSConfig != nil)
+	}
+
+	if recorder != nil {
+		rotateOnSignal(recorder, cfg.HAROutPath)
+	}
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	status := lifecycle.Run(server, cfg.ShutdownTimeout)
 
-	<-c
-	log.Debug("Leaving!")
+	if recorder != nil {
+		if err := recorder.Close(); err != nil {
+			log.Error("Cannot write the HAR file", "err", err, "path", cfg.HAROutPath)
+		} else {
+			log.Info("Wrote the HAR file", "path", cfg.HAROutPath)
+		}
+	}
+	return status
 }
@@ -0,0 +1,253 @@
+// Copyright 2024 Ajabep
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpproxy
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/ajabep/unmtlsproxy/internal/log"
+)
+
+// rewriter maps the backend origin, found in the responses, to the origin
+// used by the client to reach the proxy. Otherwise, redirections and cookies
+// send the client straight to the mTLS backend.
+type rewriter struct {
+	// backendHost is the host of the backend, without the default port
+	backendHost     string
+	backendHostname string
+	backendPort     string
+	// prefix is the path prefix stripped from the requests by their route,
+	// to be put back in the URLs
+	prefix      string
+	bodies      bool
+	maxBodySize int64
+}
+
+func newRewriter(dest, prefix string, bodies bool, maxBodySize int64) *rewriter {
+	u := &url.URL{Host: dest}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	return &rewriter{
+		backendHost:     dest,
+		backendHostname: u.Hostname(),
+		backendPort:     port,
+		prefix:          strings.TrimSuffix(prefix, "/"),
+		bodies:          bodies,
+		maxBodySize:     maxBodySize,
+	}
+}
+
+// prepareRequest makes sure the response body can be rewritten: it cannot be
+// when it is compressed. The transport still asks for, and decompresses, gzip.
+func (r *rewriter) prepareRequest(req *http.Request) {
+	if r.bodies {
+		req.Header.Del("Accept-Encoding")
+	}
+}
+
+// isBackendHost returns if the host, with or without the default port, is
+// the backend one.
+func (r *rewriter) isBackendHost(host string) bool {
+	return strings.EqualFold(strings.TrimSuffix(host, ":443"), r.backendHost)
+}
+
+// rewriteURL maps an absolute URL of the backend to the proxy. Other URLs are
+// returned as is.
+func (r *rewriter) rewriteURL(rawURL string, origin *url.URL) string {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || !strings.EqualFold(u.Scheme, "https") || !r.isBackendHost(u.Host) {
+		return rawURL
+	}
+	u.Scheme = origin.Scheme
+	u.Host = origin.Host
+	if r.prefix != "" {
+		u.Path = r.prefix + "/" + strings.TrimPrefix(u.Path, "/")
+		if u.RawPath != "" {
+			u.RawPath = r.prefix + "/" + strings.TrimPrefix(u.RawPath, "/")
+		}
+	}
+	return u.String()
+}
+
+// rewriteRefresh maps the URL of a `Refresh: <delay>; url=<url>` header.
+func (r *rewriter) rewriteRefresh(value string, origin *url.URL) string {
+	delay, target, found := strings.Cut(value, ";")
+	if !found {
+		return value
+	}
+	name, rawURL, found := strings.Cut(strings.TrimSpace(target), "=")
+	if !found || !strings.EqualFold(strings.TrimSpace(name), "url") {
+		return value
+	}
+	quote := ""
+	if rawURL = strings.TrimSpace(rawURL); len(rawURL) > 1 && (rawURL[0] == '\'' || rawURL[0] == '"') && rawURL[len(rawURL)-1] == rawURL[0] {
+		quote = rawURL[:1]
+		rawURL = rawURL[1 : len(rawURL)-1]
+	}
+	return delay + "; url=" + quote + r.rewriteURL(rawURL, origin) + quote
+}
+
+// rewriteSetCookie scopes a cookie of the backend to the proxy: its domain is
+// removed when it matches the backend, and, on a plaintext listener, it is no
+// longer Secure, which would prevent the client from sending it back.
+func (r *rewriter) rewriteSetCookie(value string, origin *url.URL) string {
+	attributes := strings.Split(value, ";")
+	kept := attributes[:1]
+	plaintext := origin.Scheme == "http"
+
+	for _, attribute := range attributes[1:] {
+		name, attrValue, _ := strings.Cut(strings.TrimSpace(attribute), "=")
+		switch {
+		case strings.EqualFold(name, "Domain"):
+			domain := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(attrValue)), ".")
+			if domain == strings.ToLower(r.backendHostname) || strings.HasSuffix(strings.ToLower(r.backendHostname), "."+domain) {
+				continue
+			}
+		case plaintext && strings.EqualFold(name, "Secure"):
+			continue
+		case plaintext && strings.EqualFold(name, "SameSite") && strings.EqualFold(strings.TrimSpace(attrValue), "None"):
+			// Rejected by the browsers without Secure
+			continue
+		}
+		kept = append(kept, attribute)
+	}
+	return strings.Join(kept, ";")
+}
+
+// rewriteHeaders maps the backend URLs of the response headers.
+func (r *rewriter) rewriteHeaders(h http.Header, origin *url.URL) {
+	for _, name := range []string{"Location", "Content-Location"} {
+		if value := h.Get(name); value != "" {
+			h.Set(name, r.rewriteURL(value, origin))
+		}
+	}
+	if value := h.Get("Refresh"); value != "" {
+		h.Set("Refresh", r.rewriteRefresh(value, origin))
+	}
+	if values := h.Values("Set-Cookie"); len(values) != 0 {
+		h.Del("Set-Cookie")
+		for _, value := range values {
+			h.Add("Set-Cookie", r.rewriteSetCookie(value, origin))
+		}
+	}
+}
+
+// isRewritableBody returns if the response body is HTML or JSON.
+func isRewritableBody(resp *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "text/html" || mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// replaceOrigin replaces the backend origin, starting with the scheme, by the
+// proxy one. An origin is only the backend one when its port, if any, is the
+// backend one, and when it ends there: otherwise, it is the prefix of another
+// host.
+func (r *rewriter) replaceOrigin(body, scheme, proxyOrigin string) string {
+	backendOrigin := scheme + r.backendHostname
+	var rewritten strings.Builder
+	for {
+		i := strings.Index(body, backendOrigin)
+		if i < 0 {
+			rewritten.WriteString(body)
+			return rewritten.String()
+		}
+		end := i + len(backendOrigin)
+		port, rest := "443", body[end:]
+		if strings.HasPrefix(rest, ":") {
+			digits := len(rest[1:]) - len(strings.TrimLeft(rest[1:], "0123456789"))
+			port, rest = rest[1:1+digits], rest[1+digits:]
+		}
+		if port == r.backendPort && isOriginEnd(rest) {
+			rewritten.WriteString(body[:i])
+			rewritten.WriteString(proxyOrigin)
+			body = rest
+		} else {
+			rewritten.WriteString(body[:end])
+			body = body[end:]
+		}
+	}
+}
+
+// isOriginEnd returns if the text following an origin ends it.
+func isOriginEnd(rest string) bool {
+	if rest == "" || strings.HasPrefix(rest, `\/`) {
+		return true
+	}
+	switch rest[0] {
+	case '/', '?', '#', '"', '\'', '<', ' ', '\t', '\n', '\r', '\f':
+		return true
+	}
+	return false
+}
+
+// rewriteBody maps the backend origin of an HTML or JSON body. Larger bodies
+// than the limit are left untouched, and still streamed.
+func (r *rewriter) rewriteBody(resp *http.Response, origin *url.URL) error {
+	if !isRewritableBody(resp) || resp.ContentLength > r.maxBodySize {
+		return nil
+	}
+	if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified || (resp.Request != nil && resp.Request.Method == http.MethodHead) {
+		return nil
+	}
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && !strings.EqualFold(encoding, "identity") {
+		log.Debug("Cannot rewrite a compressed body", "contentEncoding", encoding)
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, r.maxBodySize+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > r.maxBodySize {
+		log.Debug("The body is too large to be rewritten", "maxBodySize", r.maxBodySize)
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return nil
+	}
+
+	proxyOrigin := origin.Scheme + "://" + origin.Host + r.prefix
+	rewritten := r.replaceOrigin(string(body), "https://", proxyOrigin)
+	// Slashes may be escaped in JSON
+	rewritten = r.replaceOrigin(rewritten, `https:\/\/`, strings.ReplaceAll(proxyOrigin, "/", `\/`))
+	body = []byte(rewritten)
+
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{bytes.NewReader(body), resp.Body}
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	// The validators describe the original body
+	resp.Header.Del("ETag")
+	resp.Header.Del("Content-MD5")
+	return nil
+}
+
+// rewriteResponse maps the backend origin of the response headers and, if
+// enabled, of the body.
+func (r *rewriter) rewriteResponse(resp *http.Response, origin *url.URL) error {
+	r.rewriteHeaders(resp.Header, origin)
+	if !r.bodies {
+		return nil
+	}
+	return r.rewriteBody(resp, origin)
+}
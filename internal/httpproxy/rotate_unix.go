@@ -0,0 +1,37 @@
+// Copyright 2024 Ajabep
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build unix
+
+package httpproxy
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/ajabep/unmtlsproxy/internal/log"
+)
+
+// rotateOnSignal rotates the HAR capture on SIGUSR1.
+func rotateOnSignal(recorder *harRecorder, path string) {
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	go func() {
+		for range usr1 {
+			if err := recorder.Rotate(); err != nil {
+				log.Error("Cannot rotate the HAR file", "err", err)
+				continue
+			}
+			log.Info("Rotated the HAR file", "path", path)
+		}
+	}()
+}
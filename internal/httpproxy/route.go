@@ -0,0 +1,96 @@
+// Copyright 2024 Ajabep
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpproxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/ajabep/unmtlsproxy/internal/configuration"
+	"github.com/ajabep/unmtlsproxy/internal/log"
+)
+
+// route sends the matching requests to the handler of its backend.
+type route struct {
+	*configuration.Route
+	handler http.Handler
+}
+
+// requestHostname returns the hostname of the Host header, without its port.
+func requestHostname(host string) string {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	return strings.ToLower(strings.Trim(host, "[]"))
+}
+
+// matchesHost returns if the hostname is the route one, or one of its
+// subdomains for a `*.` route.
+func (r *route) matchesHost(hostname string) bool {
+	if r.Host == "" {
+		return true
+	}
+	if domain, found := strings.CutPrefix(r.Host, "*."); found {
+		return strings.HasSuffix(hostname, "."+domain)
+	}
+	return hostname == r.Host
+}
+
+// matchesPath returns if the path starts with the route prefix. The prefix
+// only matches full segments: `/api` matches `/api` and `/api/users`, but
+// not `/apis`.
+func (r *route) matchesPath(path string) bool {
+	prefix := strings.TrimSuffix(r.PathPrefix, "/")
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// stripPrefix removes the route prefix from the path of the request.
+func (r *route) stripPrefix(req *http.Request) {
+	prefix := strings.TrimSuffix(r.PathPrefix, "/")
+	strip := func(path string) string {
+		path = strings.TrimPrefix(path, prefix)
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		return path
+	}
+	req.URL.Path = strip(req.URL.Path)
+	if req.URL.RawPath != "" {
+		req.URL.RawPath = strip(req.URL.RawPath)
+	}
+}
+
+// makeRouter returns a handler sending the requests to the first matching
+// route, in order, and the other ones to the default handler.
+func makeRouter(routes []route, fallback http.Handler, forwardedHeaders bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		hostname := requestHostname(req.Host)
+		for i := range routes {
+			r := &routes[i]
+			if !r.matchesHost(hostname) || !r.matchesPath(req.URL.Path) {
+				continue
+			}
+
+			log.Debug("Routing the request", "route", r.String(), "backend", r.ParsedBackend, "path", req.URL.Path)
+			if r.StripPrefix {
+				r.stripPrefix(req)
+				if forwardedHeaders {
+					req.Header.Set("X-Forwarded-Prefix", strings.TrimSuffix(r.PathPrefix, "/"))
+				}
+			}
+			r.handler.ServeHTTP(w, req)
+			return
+		}
+		fallback.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,69 @@
+// Copyright 2024 Ajabep
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/ajabep/unmtlsproxy/internal/lifecycle"
+	"github.com/ajabep/unmtlsproxy/internal/log"
+)
+
+// hijackedKey is the context key of the tracker of the hijacked connections.
+type hijackedKey struct{}
+
+// server is the HTTP server, with the connections taken over by its handlers
+// (upgrades and tunnels), which http.Server does not drain.
+type server struct {
+	*http.Server
+	hijacked *lifecycle.Tracker
+}
+
+func newServer(s *http.Server) *server {
+	hijacked := &lifecycle.Tracker{}
+	s.BaseContext = func(net.Listener) context.Context {
+		return context.WithValue(context.Background(), hijackedKey{}, hijacked)
+	}
+	return &server{Server: s, hijacked: hijacked}
+}
+
+// Shutdown stops accepting connections, then waits for the active requests,
+// and for the hijacked connections.
+func (s *server) Shutdown(ctx context.Context) error {
+	if err := s.Server.Shutdown(ctx); err != nil {
+		return err
+	}
+	log.Info("Waiting for the upgraded connections and the tunnels", "count", s.hijacked.Len())
+	return s.hijacked.Wait(ctx)
+}
+
+func (s *server) Close() error {
+	return errors.Join(s.Server.Close(), s.hijacked.Close())
+}
+
+// hijack takes over the client connection. It is tracked, to be drained on
+// shutdown: release has to be called once it is closed.
+func hijack(w http.ResponseWriter, req *http.Request) (conn net.Conn, brw *bufio.ReadWriter, release func(), err error) {
+	conn, brw, err = http.NewResponseController(w).Hijack()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	release = func() {}
+	if hijacked, ok := req.Context().Value(hijackedKey{}).(*lifecycle.Tracker); ok {
+		release = hijacked.Track(conn)
+	}
+	return conn, brw, release, nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2024 Ajabep
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpproxy
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const streamBufferSize = 32 * 1024
+
+// isStreamed returns if the response has to be sent to the client as soon as
+// each chunk is received, instead of being buffered: events streams, and
+// responses whose length is unknown, such as slow chunked streams.
+func isStreamed(resp *http.Response) bool {
+	if resp.ContentLength == -1 {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// announceTrailers declares the trailers of the response, before the headers
+// are sent.
+func announceTrailers(w http.ResponseWriter, resp *http.Response) {
+	if len(resp.Trailer) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(resp.Trailer))
+	for k := range resp.Trailer {
+		keys = append(keys, k)
+	}
+	w.Header().Add("Trailer", strings.Join(keys, ", "))
+}
+
+// copyTrailers sends the trailers of the response. They are only known once
+// the body has been read.
+func copyTrailers(w http.ResponseWriter, resp *http.Response) {
+	for k, vv := range resp.Trailer {
+		w.Header()[http.TrailerPrefix+k] = vv
+	}
+}
+
+// copyBody sends the body of the response to the client. If `flush` is set,
+// each chunk is flushed as soon as it is received.
+func copyBody(w http.ResponseWriter, body io.Reader, flush bool) error {
+	if !flush {
+		_, err := io.Copy(w, body)
+		return err
+	}
+
+	rc := http.NewResponseController(w)
+	// Headers first: the first chunk may take a while
+	if err := rc.Flush(); err != nil {
+		return err
+	}
+
+	buffer := make([]byte, streamBufferSize)
+	for {
+		n, err := body.Read(buffer)
+		if n > 0 {
+			if _, err := w.Write(buffer[:n]); err != nil {
+				return err
+			}
+			if err := rc.Flush(); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2024 Ajabep
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpproxy
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/ajabep/unmtlsproxy/internal/log"
+)
+
+// headerContainsToken returns if one of the comma-separated values of the
+// header is the token, case-insensitively.
+func headerContainsToken(values []string, token string) bool {
+	for _, value := range values {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgradeType returns the protocol the client asks to switch to, such as
+// `websocket`, if any.
+func upgradeType(h http.Header) string {
+	if !headerContainsToken(h["Connection"], "Upgrade") {
+		return ""
+	}
+	return h.Get("Upgrade")
+}
+
+// handleUpgrade forwards the `101 Switching Protocols` response of the
+// backend, then splices the client connection and the backend stream, until
+// one of them is closed.
+func handleUpgrade(w http.ResponseWriter, req *http.Request, resp *http.Response) {
+	reqUpgrade := upgradeType(req.Header)
+	respUpgrade := upgradeType(resp.Header)
+	if !strings.EqualFold(reqUpgrade, respUpgrade) {
+		log.Error("The backend switched to another protocol than the requested one", "requested", reqUpgrade, "switched", respUpgrade)
+		http.Error(w, "backend switched to an unexpected protocol: "+respUpgrade, http.StatusBadGateway)
+		return
+	}
+
+	backend, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		log.Error("The backend stream cannot be written", "upgrade", respUpgrade)
+		http.Error(w, "backend stream cannot be written", http.StatusBadGateway)
+		return
+	}
+	defer backend.Close()
+
+	conn, brw, release, err := hijack(w, req)
+	if err != nil {
+		log.Error("Cannot take over the client connection", "err", err, "upgrade", respUpgrade)
+		http.Error(w, "cannot switch protocols: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer release()
+	defer conn.Close()
+
+	// The body is the switched stream: only the status and the headers are
+	// sent here
+	resp.Body = nil
+	if err := resp.Write(brw); err != nil {
+		log.Error("Cannot send the switching response to the client of the proxy", "err", err)
+		return
+	}
+	if err := brw.Flush(); err != nil {
+		log.Error("Cannot send the switching response to the client of the proxy", "err", err)
+		return
+	}
+
+	log.Debug("Switched protocols", "upgrade", respUpgrade)
+	done := make(chan struct{}, 2)
+	go func() {
+		// Bytes already read by the HTTP server are in the buffered reader
+		_, _ = io.Copy(backend, brw)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(conn, backend)
+		done <- struct{}{}
+	}()
+	<-done
+	log.Debug("Closing the switched connection", "upgrade", respUpgrade)
+}
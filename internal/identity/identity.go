@@ -0,0 +1,110 @@
+// Copyright 2024 Ajabep
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package identity selects the client certificate to present to the backend
+package identity
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/ajabep/unmtlsproxy/internal/log"
+)
+
+var ErrUnknownIdentity = errors.New("unknown identity")
+
+// Store holds the client certificates, and picks the one to present to the
+// server. The certificates can be replaced at any time, for instance when they
+// are renewed.
+type Store struct {
+	material atomic.Pointer[material]
+}
+
+type material struct {
+	certificates []tls.Certificate
+	named        map[string]tls.Certificate
+}
+
+// NewStore returns a store over the given client certificates, and the named
+// ones. They are tried in order.
+func NewStore(certificates []tls.Certificate, named map[string]tls.Certificate) *Store {
+	s := &Store{}
+	s.Update(certificates, named)
+	return s
+}
+
+// Update atomically replaces the client certificates. Handshakes in progress
+// keep using the previous ones.
+func (s *Store) Update(certificates []tls.Certificate, named map[string]tls.Certificate) {
+	s.material.Store(&material{
+		certificates: certificates,
+		named:        named,
+	})
+}
+
+// Has returns if a named client certificate exists.
+func (s *Store) Has(name string) bool {
+	_, has := s.material.Load().named[name]
+	return has
+}
+
+// Describe returns the log attributes identifying a client certificate.
+func Describe(cert *tls.Certificate) []any {
+	if cert == nil || cert.Leaf == nil {
+		return []any{"subject", ""}
+	}
+	return []any{
+		"subject", cert.Leaf.Subject.String(),
+		"issuer", cert.Leaf.Issuer.String(),
+		"serial", cert.Leaf.SerialNumber.String(),
+	}
+}
+
+// GetClientCertificate returns the first client certificate whose issuer is
+// in the server's AcceptableCAs and whose key supports one of the server's
+// signature schemes. It is meant to be used as
+// `tls.Config.GetClientCertificate`.
+func (s *Store) GetClientCertificate(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	certificates := s.material.Load().certificates
+	for i := range certificates {
+		cert := &certificates[i]
+		if err := cri.SupportsCertificate(cert); err != nil {
+			log.Debug("Client certificate not accepted by the server", append(Describe(cert), "err", err)...)
+			continue
+		}
+		log.Info("Using a client certificate", Describe(cert)...)
+		return cert, nil
+	}
+
+	// Same behavior as the `tls` package: do not send any certificate, and let
+	// the server decide if it is fatal.
+	log.Warn("No client certificate is accepted by the server", "acceptableCAs", len(cri.AcceptableCAs), "certificates", len(certificates))
+	return new(tls.Certificate), nil
+}
+
+// Named returns a `tls.Config.GetClientCertificate` function always
+// presenting the given named client certificate, even if the server is not
+// expected to accept it.
+func (s *Store) Named(name string) func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return func(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		cert, has := s.material.Load().named[name]
+		if !has {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownIdentity, name)
+		}
+		if err := cri.SupportsCertificate(&cert); err != nil {
+			log.Debug("Named client certificate may not be accepted by the server", append(Describe(&cert), "identity", name, "err", err)...)
+		}
+		log.Info("Using a named client certificate", append(Describe(&cert), "identity", name)...)
+		return &cert, nil
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2024 Ajabep
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package lifecycle stops the proxies gracefully on SIGINT and SIGTERM
+package lifecycle
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ajabep/unmtlsproxy/internal/log"
+)
+
+// Exit statuses of the proxy. The fatal errors exit with 1.
+const (
+	// ExitDrained means all the connections ended before the shutdown
+	// timeout.
+	ExitDrained = 0
+	// ExitForced means connections were still active at the shutdown
+	// timeout, and have been closed.
+	ExitForced = 2
+)
+
+// Server is a proxy which can be stopped gracefully.
+type Server interface {
+	// Shutdown stops accepting connections, and waits for the active ones to
+	// end, until the context is done.
+	Shutdown(ctx context.Context) error
+	// Close closes the active connections.
+	Close() error
+}
+
+// Run blocks until SIGINT or SIGTERM, then shuts the server down. The active
+// connections have `timeout` to end, or a second signal, before being
+// closed. It returns the exit status.
+func Run(server Server, timeout time.Duration) int {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	sig := <-signals
+	log.Info("Shutting down", "signal", sig.String(), "timeout", timeout)
+	return Shutdown(server, timeout, signals)
+}
+
+// Shutdown shuts the server down, waiting for its connections to end until
+// the timeout or until `force` receives a value.
+func Shutdown(server Server, timeout time.Duration, force <-chan os.Signal) int {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		select {
+		case sig := <-force:
+			log.Warn("Forcing the shutdown", "signal", sig.String())
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Warn("Closing the connections still active", "err", err)
+		if err := server.Close(); err != nil {
+			log.Error("Cannot close the connections", "err", err)
+		}
+		return ExitForced
+	}
+	log.Info("All the connections ended")
+	return ExitDrained
+}
+
+// Tracker tracks the active connections, to wait for them or close them.
+type Tracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	// removed is closed, and replaced, when a connection is removed
+	removed chan struct{}
+}
+
+// Track adds the connection to the active ones. The returned function
+// removes it; it has to be called once the connection is closed.
+func (t *Tracker) Track(conn net.Conn) func() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conns == nil {
+		t.conns = map[net.Conn]struct{}{}
+		t.removed = make(chan struct{})
+	}
+	t.conns[conn] = struct{}{}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			delete(t.conns, conn)
+			close(t.removed)
+			t.removed = make(chan struct{})
+		})
+	}
+}
+
+// Len returns the number of active connections.
+func (t *Tracker) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+// Wait waits for the active connections to end, until the context is done.
+func (t *Tracker) Wait(ctx context.Context) error {
+	for {
+		t.mu.Lock()
+		active, removed := len(t.conns), t.removed
+		t.mu.Unlock()
+		if active == 0 {
+			return nil
+		}
+		select {
+		case <-removed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Close closes the active connections.
+func (t *Tracker) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for conn := range t.conns {
+		_ = conn.Close()
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package lifecycletest
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ajabep/unmtlsproxy/internal/lifecycle"
+)
+
+// trackerServer is a server whose connections are pipes.
+type trackerServer struct {
+	tracker lifecycle.Tracker
+}
+
+func (s *trackerServer) Shutdown(ctx context.Context) error {
+	return s.tracker.Wait(ctx)
+}
+
+func (s *trackerServer) Close() error {
+	return s.tracker.Close()
+}
+
+// open returns a tracked connection, released once closed.
+func (s *trackerServer) open() net.Conn {
+	conn, peer := net.Pipe()
+	release := s.tracker.Track(conn)
+	go func() {
+		defer release()
+		defer peer.Close()
+		_, _ = peer.Read(make([]byte, 1))
+	}()
+	return conn
+}
+
+func TestTracker(t *testing.T) {
+	s := &trackerServer{}
+	if err := s.tracker.Wait(context.Background()); err != nil {
+		t.Errorf("Unexpected error without connections: %s", err)
+	}
+
+	first, second := s.open(), s.open()
+	if s.tracker.Len() != 2 {
+		t.Errorf("Unexpected number of connections: %d", s.tracker.Len())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.tracker.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the wait to time out, got %v", err)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		first.Close()
+		time.Sleep(20 * time.Millisecond)
+		second.Close()
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.tracker.Wait(ctx); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if s.tracker.Len() != 0 {
+		t.Errorf("Unexpected number of connections: %d", s.tracker.Len())
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	// The connections end before the timeout
+	s := &trackerServer{}
+	conn := s.open()
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		conn.Close()
+	}()
+	if status := lifecycle.Shutdown(s, 5*time.Second, nil); status != lifecycle.ExitDrained {
+		t.Errorf("Unexpected exit status: %d", status)
+	}
+
+	// The connections are closed at the timeout
+	s = &trackerServer{}
+	conn = s.open()
+	if status := lifecycle.Shutdown(s, 50*time.Millisecond, nil); status != lifecycle.ExitForced {
+		t.Errorf("Unexpected exit status: %d", status)
+	}
+	if _, err := conn.Write([]byte{0}); err == nil {
+		t.Errorf("The connection has not been closed")
+	}
+
+	// A signal forces the shutdown
+	s = &trackerServer{}
+	s.open()
+	force := make(chan os.Signal, 1)
+	force <- syscall.SIGTERM
+	started := time.Now()
+	if status := lifecycle.Shutdown(s, time.Minute, force); status != lifecycle.ExitForced {
+		t.Errorf("Unexpected exit status: %d", status)
+	}
+	if time.Since(started) > 10*time.Second {
+		t.Errorf("The shutdown has not been forced")
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2024 Ajabep
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package listener opens the listening socket of the proxy
+package listener
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"time"
+
+	"github.com/ajabep/unmtlsproxy/internal/configuration"
+	"github.com/ajabep/unmtlsproxy/internal/log"
+)
+
+var ErrSocketInUse = errors.New("the Unix socket is in use by another process")
+
+// Listen opens the listening socket: a TCP port, a Unix socket file, with the
+// configured mode and owner, or a Linux abstract socket.
+func Listen(cfg *configuration.Configuration) (net.Listener, error) {
+	addr := cfg.ParsedListen
+	if !addr.IsUnix() || addr.IsAbstract() {
+		return net.Listen(addr.Network(), addr.Address())
+	}
+
+	if err := removeStaleSocket(addr.UnixPath); err != nil {
+		return nil, err
+	}
+
+	// The socket is created with the right permissions, to never be reachable
+	// by other users, even for a short time
+	var listener net.Listener
+	err := withUmask(0o777&^cfg.ParsedUnixMode, func() error {
+		var err error
+		listener, err = net.Listen(addr.Network(), addr.Address())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(addr.UnixPath, cfg.ParsedUnixMode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if cfg.ParsedUnixUID != -1 || cfg.ParsedUnixGID != -1 {
+		if err := os.Chown(addr.UnixPath, cfg.ParsedUnixUID, cfg.ParsedUnixGID); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	log.Debug("Created the Unix socket", "path", addr.UnixPath, "mode", cfg.ParsedUnixMode, "uid", cfg.ParsedUnixUID, "gid", cfg.ParsedUnixGID)
+	return listener, nil
+}
+
+// removeStaleSocket removes the socket file left by a previous process which
+// did not exit cleanly. Sockets still in use, and other files, are kept.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("%w: %s", fs.ErrExist, path)
+	}
+
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%w: %s", ErrSocketInUse, path)
+	}
+	log.Debug("Removing a stale Unix socket", "path", path)
+	return os.Remove(path)
+}
@@ -0,0 +1,102 @@
+//go:build unix
+
+package listenertest
+
+import (
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/ajabep/unmtlsproxy/internal/configuration"
+	"github.com/ajabep/unmtlsproxy/internal/listener"
+)
+
+func unixConfiguration(path string, mode os.FileMode) *configuration.Configuration {
+	return &configuration.Configuration{
+		ParsedListen:   configuration.Addr{UnixPath: path},
+		ParsedUnixMode: mode,
+		ParsedUnixUID:  -1,
+		ParsedUnixGID:  -1,
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+
+	l, err := listener.Listen(unixConfiguration(path, 0o660))
+	if err != nil {
+		t.Fatalf("Cannot listen: %s", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Type() != fs.ModeSocket || info.Mode().Perm() != 0o660 {
+		t.Errorf("Unexpected socket file mode: %s", info.Mode())
+	}
+
+	if _, err := listener.Listen(unixConfiguration(path, 0o600)); !errors.Is(err, listener.ErrSocketInUse) {
+		t.Errorf("Expected error %q, got %v", listener.ErrSocketInUse, err)
+	}
+	l.Close()
+}
+
+func TestListenUnixStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+
+	// Leave a socket file behind, as a crashed process would
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := listener.Listen(unixConfiguration(path, 0o600))
+	if err != nil {
+		t.Fatalf("The stale socket has not been replaced: %s", err)
+	}
+	l.Close()
+
+	regular := filepath.Join(t.TempDir(), "regular")
+	if err := os.WriteFile(regular, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listener.Listen(unixConfiguration(regular, 0o600)); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Expected error %q, got %v", fs.ErrExist, err)
+	}
+}
+
+func TestListenAbstract(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Abstract sockets are only supported on Linux")
+	}
+
+	name := "@unmtlsproxy-test-" + filepath.Base(t.TempDir())
+	l, err := listener.Listen(unixConfiguration(name, 0o600))
+	if err != nil {
+		t.Fatalf("Cannot listen: %s", err)
+	}
+	defer l.Close()
+
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			_, _ = conn.Write([]byte("OK"))
+			conn.Close()
+		}
+	}()
+
+	conn, err := net.Dial("unix", name)
+	if err != nil {
+		t.Fatalf("Cannot connect to the abstract socket: %s", err)
+	}
+	defer conn.Close()
+	buffer := make([]byte, 2)
+	if _, err := conn.Read(buffer); err != nil || string(buffer) != "OK" {
+		t.Errorf("Unexpected answer: %q, %v", buffer, err)
+	}
+}
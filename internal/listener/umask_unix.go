@@ -0,0 +1,27 @@
+// Copyright 2024 Ajabep
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build unix
+
+package listener
+
+import (
+	"os"
+	"syscall"
+)
+
+// withUmask runs `f` with the given umask. The umask is process wide: it must
+// only be used while nothing else creates files.
+func withUmask(mask os.FileMode, f func() error) error {
+	previous := syscall.Umask(int(mask))
+	defer syscall.Umask(previous)
+	return f()
+}
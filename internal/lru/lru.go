@@ -0,0 +1,79 @@
+// Copyright 2024 Ajabep
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package lru bounds the caches filled from what the clients request
+package lru
+
+import "container/list"
+
+type entry[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+// Cache keeps the most recently used values, up to its size. It is not safe
+// for concurrent use.
+type Cache[K comparable, V any] struct {
+	size    int
+	onEvict func(K, V)
+	order   *list.List
+	entries map[K]*list.Element
+}
+
+// New returns a cache of the size. If set, onEvict is called with each value
+// the cache drops.
+func New[K comparable, V any](size int, onEvict func(K, V)) *Cache[K, V] {
+	return &Cache[K, V]{
+		size:    size,
+		onEvict: onEvict,
+		order:   list.New(),
+		entries: map[K]*list.Element{},
+	}
+}
+
+// Get returns the value of the key, and marks it as the most recently used.
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	element, has := c.entries[key]
+	if !has {
+		var zero V
+		return zero, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*entry[K, V]).value, true
+}
+
+// Add sets the value of the key. The previous value of the key, if any, is
+// dropped, as the least recently used value when the cache is full.
+func (c *Cache[K, V]) Add(key K, value V) {
+	if element, has := c.entries[key]; has {
+		c.order.MoveToFront(element)
+		replaced := element.Value.(*entry[K, V])
+		previous := replaced.value
+		replaced.value = value
+		if c.onEvict != nil {
+			c.onEvict(key, previous)
+		}
+		return
+	}
+	c.entries[key] = c.order.PushFront(&entry[K, V]{key: key, value: value})
+	if c.order.Len() > c.size {
+		oldest := c.order.Remove(c.order.Back()).(*entry[K, V])
+		delete(c.entries, oldest.key)
+		if c.onEvict != nil {
+			c.onEvict(oldest.key, oldest.value)
+		}
+	}
+}
+
+// Len returns the number of values in the cache.
+func (c *Cache[K, V]) Len() int {
+	return c.order.Len()
+}
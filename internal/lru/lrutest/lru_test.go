@@ -0,0 +1,41 @@
+package lrutest
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/ajabep/unmtlsproxy/internal/lru"
+)
+
+func TestCache(t *testing.T) {
+	var evicted []string
+	cache := lru.New(2, func(key string, value int) { evicted = append(evicted, fmt.Sprint(key, value)) })
+
+	cache.Add("a", 1)
+	cache.Add("b", 2)
+	// "a" becomes the most recently used
+	if value, has := cache.Get("a"); !has || value != 1 {
+		t.Errorf("Unexpected value of a: %d (%v)", value, has)
+	}
+	cache.Add("c", 3)
+
+	if _, has := cache.Get("b"); has {
+		t.Errorf("The least recently used value has not been dropped")
+	}
+	if !slices.Equal(evicted, []string{"b2"}) {
+		t.Errorf("Unexpected evicted values: %v", evicted)
+	}
+	if cache.Len() != 2 {
+		t.Errorf("Unexpected length: %d", cache.Len())
+	}
+
+	cache.Add("a", 4)
+	if value, has := cache.Get("a"); !has || value != 4 {
+		t.Errorf("Unexpected value of a: %d (%v)", value, has)
+	}
+	// The replaced value is dropped, and only it
+	if cache.Len() != 2 || !slices.Equal(evicted, []string{"b2", "a1"}) {
+		t.Errorf("Unexpected evicted values after a replacement: %v", evicted)
+	}
+}
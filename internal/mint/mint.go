@@ -0,0 +1,249 @@
+// Copyright 2024 Ajabep
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mint issues, on the fly, the certificates presented to the clients
+// of the proxy
+package mint
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ajabep/unmtlsproxy/internal/log"
+	"github.com/ajabep/unmtlsproxy/internal/lru"
+)
+
+var (
+	ErrNotCA        = errors.New("the certificate is not a CA")
+	ErrNotSigner    = errors.New("the key of the CA cannot sign")
+	ErrNoServerName = errors.New("cannot find the server name to issue a certificate for")
+	ErrInvalidName  = errors.New("invalid host name")
+)
+
+const (
+	authorityValidity = 365 * 24 * time.Hour
+	leafValidity      = 30 * 24 * time.Hour
+	// A leaf is issued again when it is about to expire
+	leafRenewBefore = 24 * time.Hour
+	// Tolerate clients whose clock is late
+	clockSkew = time.Hour
+	// The server names come from the clients: only the most recently used
+	// leaves are kept
+	maxLeaves = 1000
+)
+
+// Authority is a CA issuing a leaf certificate for each server name requested
+// by the clients. The leaves are kept until they are about to expire, or are
+// the least recently used of too many.
+type Authority struct {
+	certificate *x509.Certificate
+	key         crypto.Signer
+
+	mu     sync.Mutex
+	leaves *lru.Cache[string, *tls.Certificate]
+}
+
+// NewAuthority generates a self-signed CA. It only lives in memory: its
+// certificate has to be exported to be trusted by the clients.
+func NewAuthority() (*Authority, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"unmtlsproxy"}, CommonName: "unmtlsproxy CA " + now.Format(time.DateTime)},
+		NotBefore:             now.Add(-clockSkew),
+		NotAfter:              now.Add(authorityValidity),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		MaxPathLenZero:        true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug("Generated a CA", "subject", certificate.Subject.String(), "notAfter", certificate.NotAfter)
+	return newAuthority(certificate, key), nil
+}
+
+// LoadAuthority reads the PEM certificate of a CA and its PEM key. Reusing the
+// same CA across restarts avoids trusting a new one each time.
+func LoadAuthority(certPath, keyPath string) (*Authority, error) {
+	tc, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	certificate, err := x509.ParseCertificate(tc.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if !certificate.IsCA {
+		return nil, fmt.Errorf("%w: %s", ErrNotCA, certPath)
+	}
+	key, ok := tc.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotSigner, keyPath)
+	}
+
+	log.Debug("Loaded a CA", "subject", certificate.Subject.String(), "notAfter", certificate.NotAfter)
+	return newAuthority(certificate, key), nil
+}
+
+func newAuthority(certificate *x509.Certificate, key crypto.Signer) *Authority {
+	return &Authority{
+		certificate: certificate,
+		key:         key,
+		leaves:      lru.New[string, *tls.Certificate](maxLeaves, nil),
+	}
+}
+
+// Certificate returns the certificate of the CA.
+func (a *Authority) Certificate() *x509.Certificate {
+	return a.certificate
+}
+
+// CertificatePEM returns the PEM certificate of the CA, to be trusted by the
+// clients.
+func (a *Authority) CertificatePEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: a.certificate.Raw})
+}
+
+// GetCertificate returns a leaf certificate for the server name requested by
+// the client or, without SNI, for the address it connected to. It is meant to
+// be used as `tls.Config.GetCertificate`.
+func (a *Authority) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := hello.ServerName
+	if name == "" && hello.Conn != nil {
+		if addr, ok := hello.Conn.LocalAddr().(*net.TCPAddr); ok {
+			name = addr.IP.String()
+		}
+	}
+	if name == "" {
+		return nil, ErrNoServerName
+	}
+	return a.Issue(name)
+}
+
+// Issue returns a leaf certificate valid for the host name or the IP address.
+func (a *Authority) Issue(name string) (*tls.Certificate, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	ip := net.ParseIP(name)
+	if ip == nil && !validHostname(name) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+
+	// Only the cache is locked: the handshakes do not wait for the leaves of
+	// the others. The concurrent handshakes for a new name may each issue a
+	// leaf, the last one being kept
+	a.mu.Lock()
+	leaf, has := a.leaves.Get(name)
+	a.mu.Unlock()
+	if has && time.Until(leaf.Leaf.NotAfter) > leafRenewBefore {
+		return leaf, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-clockSkew),
+		NotAfter:     now.Add(leafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{name}
+	}
+	if template.NotAfter.After(a.certificate.NotAfter) {
+		template.NotAfter = a.certificate.NotAfter
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, a.certificate, key.Public(), a.key)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug("Issued a certificate", "name", name, "notAfter", parsed.NotAfter)
+	leaf = &tls.Certificate{
+		Certificate: [][]byte{der, a.certificate.Raw},
+		PrivateKey:  key,
+		Leaf:        parsed,
+	}
+	a.mu.Lock()
+	a.leaves.Add(name, leaf)
+	a.mu.Unlock()
+	return leaf, nil
+}
+
+// validHostname returns if the name is a DNS host name: dot-separated labels
+// of letters, digits, hyphens and underscores, not starting nor ending with a
+// hyphen.
+func validHostname(name string) bool {
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
@@ -0,0 +1,157 @@
+package minttest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ajabep/unmtlsproxy/internal/mint"
+)
+
+func TestIssue(t *testing.T) {
+	authority, err := mint.NewAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, _ := pem.Decode(authority.CertificatePEM())
+	if block == nil || block.Type != "CERTIFICATE" {
+		t.Fatalf("The exported CA is not a PEM certificate")
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(authority.Certificate())
+
+	for _, name := range []string{"backend.example", "127.0.0.1", "::1"} {
+		tc, err := authority.Issue(name)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		opts := x509.VerifyOptions{
+			DNSName:   name,
+			Roots:     roots,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		if _, err := tc.Leaf.Verify(opts); err != nil {
+			t.Errorf("%s: the issued certificate is not valid: %s", name, err)
+		}
+
+		again, err := authority.Issue(name)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if again != tc {
+			t.Errorf("%s: the certificate has been issued again instead of being reused", name)
+		}
+	}
+}
+
+func TestIssueInvalidName(t *testing.T) {
+	authority, err := mint.NewAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"", "bad name", "a..b", "-backend.example", "backend/example", strings.Repeat("a", 64) + ".example"} {
+		if _, err := authority.Issue(name); !errors.Is(err, mint.ErrInvalidName) {
+			t.Errorf("%q: expected error %q, got %v", name, mint.ErrInvalidName, err)
+		}
+	}
+	for _, name := range []string{"Backend.Example.", "_service.backend.example", "xn--blhaj-gra.example"} {
+		if _, err := authority.Issue(name); err != nil {
+			t.Errorf("%q: %s", name, err)
+		}
+	}
+}
+
+func TestGetCertificate(t *testing.T) {
+	authority, err := mint.NewAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(authority.Certificate())
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	go func() {
+		_ = tls.Server(server, &tls.Config{GetCertificate: authority.GetCertificate}).Handshake()
+	}()
+
+	conn := tls.Client(client, &tls.Config{ServerName: "backend.example", RootCAs: roots})
+	if err := conn.Handshake(); err != nil {
+		t.Fatalf("The handshake failed: %s", err)
+	}
+	if name := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; name != "backend.example" {
+		t.Errorf("Unexpected certificate: %s", name)
+	}
+}
+
+func TestLoadAuthority(t *testing.T) {
+	dir := t.TempDir()
+
+	write := func(name string, isCA bool) (string, string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tml := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: "BlaHaj Corp. " + name},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			IsCA:                  isCA,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tml, tml, &key.PublicKey, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDer, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		certPath := filepath.Join(dir, name+".crt.pem")
+		keyPath := filepath.Join(dir, name+".key.pem")
+		if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return certPath, keyPath
+	}
+
+	certPath, keyPath := write("ca", true)
+	authority, err := mint.LoadAuthority(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("Cannot load the CA: %s", err)
+	}
+	tc, err := authority.Issue("backend.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tc.Leaf.Issuer.CommonName != "BlaHaj Corp. ca" {
+		t.Errorf("Unexpected issuer: %s", tc.Leaf.Issuer)
+	}
+
+	certPath, keyPath = write("leaf", false)
+	if _, err := mint.LoadAuthority(certPath, keyPath); !errors.Is(err, mint.ErrNotCA) {
+		t.Errorf("Expected error %q, got %v", mint.ErrNotCA, err)
+	}
+}
@@ -0,0 +1,119 @@
+//go:build cgo
+
+package pkcs11keytest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/ajabep/unmtlsproxy/internal/pkcs11key"
+	"github.com/ajabep/unmtlsproxy/tests"
+)
+
+var softHSMModulePaths = []string{
+	"/usr/lib/softhsm/libsofthsm2.so",
+	"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/lib64/pkcs11/libsofthsm2.so",
+	"/usr/local/lib/softhsm/libsofthsm2.so",
+	"/opt/homebrew/lib/softhsm/libsofthsm2.so",
+}
+
+// setupSoftHSM creates a SoftHSMv2 token holding a client key, and returns the
+// PKCS#11 URI of the key and its certificate. The test is skipped if SoftHSMv2
+// is not installed. Its module path can be set with `SOFTHSM2_MODULE`.
+func setupSoftHSM(t *testing.T) (string, tls.Certificate) {
+	modulePath := os.Getenv("SOFTHSM2_MODULE")
+	for _, path := range softHSMModulePaths {
+		if modulePath != "" {
+			break
+		}
+		if _, err := os.Stat(path); err == nil {
+			modulePath = path
+		}
+	}
+	if modulePath == "" {
+		t.Skip("SoftHSMv2 module not found")
+	}
+	if _, err := exec.LookPath("softhsm2-util"); err != nil {
+		t.Skip("softhsm2-util not found")
+	}
+
+	tmpDir := t.TempDir()
+	tokenDir := filepath.Join(tmpDir, "tokens")
+	if err := os.Mkdir(tokenDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	confPath := filepath.Join(tmpDir, "softhsm2.conf")
+	if err := os.WriteFile(confPath, []byte(fmt.Sprintf("directories.tokendir = %s\nobjectstore.backend = file\n", tokenDir)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SOFTHSM2_CONF", confPath)
+
+	certPath := filepath.Join(tmpDir, "client.crt.pem")
+	keyPath := filepath.Join(tmpDir, "client.key.pem")
+	certFile, err := os.Create(certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer certFile.Close()
+	keyFile, err := os.Create(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keyFile.Close()
+	certPem, keyPem, err := tests.GenerateCertificate(true, certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPair, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyPair.Leaf, err = x509.ParseCertificate(keyPair.Certificate[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, args := range [][]string{
+		{"--init-token", "--free", "--label", "unmtlsproxy", "--pin", "1234", "--so-pin", "12345678"},
+		{"--import", keyPath, "--token", "unmtlsproxy", "--label", "client", "--id", "01", "--pin", "1234"},
+	} {
+		if out, err := exec.Command("softhsm2-util", args...).CombinedOutput(); err != nil {
+			t.Fatalf("softhsm2-util failed: %s: %s", err, out)
+		}
+	}
+
+	uri := fmt.Sprintf("pkcs11:token=unmtlsproxy;object=client?module-path=%s&pin-value=1234", modulePath)
+	return uri, keyPair
+}
+
+func TestSoftHSMSigner(t *testing.T) {
+	uri, keyPair := setupSoftHSM(t)
+
+	signer, err := pkcs11key.NewSigner(uri, keyPair.Leaf.PublicKey)
+	if err != nil {
+		t.Fatalf("Cannot load the PKCS#11 key: %s", err)
+	}
+
+	digest := sha256.Sum256([]byte("Hugging Department"))
+	signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatalf("Cannot sign with the PKCS#11 key: %s", err)
+	}
+
+	public, ok := keyPair.Leaf.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		t.Fatalf("Unexpected public key type: %T", keyPair.Leaf.PublicKey)
+	}
+	if !ecdsa.VerifyASN1(public, digest[:], signature) {
+		t.Errorf("The PKCS#11 signature is invalid")
+	}
+}
@@ -0,0 +1,89 @@
+package pkcs11keytest
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ajabep/unmtlsproxy/internal/pkcs11key"
+)
+
+func TestParseURIValid(t *testing.T) {
+	u, err := pkcs11key.ParseURI("pkcs11:token=My%20Token;object=client;id=%01%02;slot-id=3;type=private?module-path=/usr/lib/softhsm/libsofthsm2.so&pin-value=1234")
+	if err != nil {
+		t.Fatalf("The URI parsing failed while it was not supposed to fail: %s", err)
+	}
+
+	if u.Token != "My Token" {
+		t.Errorf("Unexpected token: %q", u.Token)
+	}
+	if u.Object != "client" {
+		t.Errorf("Unexpected object: %q", u.Object)
+	}
+	if !bytes.Equal(u.ID, []byte{1, 2}) {
+		t.Errorf("Unexpected id: %x", u.ID)
+	}
+	if u.SlotID == nil || *u.SlotID != 3 {
+		t.Errorf("Unexpected slot id: %v", u.SlotID)
+	}
+	if u.ModulePath != "/usr/lib/softhsm/libsofthsm2.so" {
+		t.Errorf("Unexpected module path: %q", u.ModulePath)
+	}
+	if pin, err := u.Pin(); err != nil || pin != "1234" {
+		t.Errorf("Unexpected pin: %q (%v)", pin, err)
+	}
+}
+
+func TestParseURIPinSource(t *testing.T) {
+	pinPath := filepath.Join(t.TempDir(), "pin")
+	if err := os.WriteFile(pinPath, []byte("4321\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := pkcs11key.ParseURI("pkcs11:object=client?module-path=/lib/p11.so&pin-source=file:" + pinPath)
+	if err != nil {
+		t.Fatalf("The URI parsing failed while it was not supposed to fail: %s", err)
+	}
+	if pin, err := u.Pin(); err != nil || pin != "4321" {
+		t.Errorf("Unexpected pin: %q (%v)", pin, err)
+	}
+}
+
+func TestParseURIInvalid(t *testing.T) {
+	testcases := []struct {
+		uri      string
+		expected error
+	}{
+		{"/path/to/key.pem", pkcs11key.ErrInvalidURI},
+		{"pkcs11:object=client", pkcs11key.ErrMissingModulePath},
+		{"pkcs11:token=mytoken?module-path=/lib/p11.so", pkcs11key.ErrMissingObject},
+		{"pkcs11:object=client;type=public?module-path=/lib/p11.so", pkcs11key.ErrInvalidURI},
+		{"pkcs11:object?module-path=/lib/p11.so", pkcs11key.ErrInvalidURI},
+		{"pkcs11:object=client;slot-id=abc?module-path=/lib/p11.so", pkcs11key.ErrInvalidURI},
+	}
+	for _, testcase := range testcases {
+		if _, err := pkcs11key.ParseURI(testcase.uri); !errors.Is(err, testcase.expected) {
+			t.Errorf("%s: expected error %q, got %v", testcase.uri, testcase.expected, err)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	testcases := []struct {
+		value    string
+		expected string
+	}{
+		{"/path/to/key.pem", "/path/to/key.pem"},
+		{"pkcs11:object=client?module-path=/lib/p11.so", "pkcs11:object=client?module-path=/lib/p11.so"},
+		{"pkcs11:object=client?module-path=/lib/p11.so&pin-value=1234", "pkcs11:object=client?module-path=/lib/p11.so&pin-value=REDACTED"},
+		{"pkcs11:object=client;pin-value=1234?module-path=/lib/p11.so", "pkcs11:object=client;pin-value=REDACTED?module-path=/lib/p11.so"},
+		{"pkcs11:object=client?pin-value&module-path=/lib/p11.so", "pkcs11:object=client?pin-value=REDACTED&module-path=/lib/p11.so"},
+	}
+	for _, testcase := range testcases {
+		if redacted := pkcs11key.Redact(testcase.value); redacted != testcase.expected {
+			t.Errorf("%s: expected %q, got %q", testcase.value, testcase.expected, redacted)
+		}
+	}
+}
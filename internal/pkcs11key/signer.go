@@ -0,0 +1,286 @@
+// Copyright 2024 Ajabep
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build cgo
+
+package pkcs11key
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+
+	"github.com/ajabep/unmtlsproxy/internal/log"
+	"github.com/miekg/pkcs11"
+)
+
+var (
+	ErrModuleLoad        = errors.New("cannot load the PKCS#11 module")
+	ErrTokenNotFound     = errors.New("no PKCS#11 token matches the URI")
+	ErrKeyNotFound       = errors.New("no PKCS#11 private key matches the URI")
+	ErrUnsupportedKey    = errors.New("unsupported PKCS#11 key type")
+	ErrUnsupportedDigest = errors.New("unsupported digest for a PKCS#11 signature")
+)
+
+// The modules, and the sessions, are kept for the whole life of the process:
+// reloading the certificates must not open new sessions each time.
+var (
+	cacheMu  sync.Mutex
+	modules  = map[string]*pkcs11.Ctx{}
+	sessions = map[string]*session{}
+)
+
+// session is a PKCS#11 session, with the private key found in it.
+type session struct {
+	// A PKCS#11 session cannot run several operations at the same time
+	mu     sync.Mutex
+	ctx    *pkcs11.Ctx
+	handle pkcs11.SessionHandle
+	key    pkcs11.ObjectHandle
+}
+
+// signer is a crypto.Signer whose private key never leaves the PKCS#11 token.
+type signer struct {
+	session *session
+	public  crypto.PublicKey
+}
+
+// NewSigner returns a signer using the private key designated by the URI. Its
+// public key is the one of the certificate, since the token may not hold it.
+func NewSigner(rawURI string, public crypto.PublicKey) (crypto.Signer, error) {
+	u, err := ParseURI(rawURI)
+	if err != nil {
+		return nil, err
+	}
+
+	switch public.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		return nil, fmt.Errorf("%w: %T", ErrUnsupportedKey, public)
+	}
+
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+
+	if sess, has := sessions[rawURI]; has {
+		return &signer{session: sess, public: public}, nil
+	}
+
+	ctx, err := loadModule(u.ModulePath)
+	if err != nil {
+		return nil, err
+	}
+
+	slot, err := findSlot(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+
+	handle, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open a PKCS#11 session: %w", err)
+	}
+
+	pin, err := u.Pin()
+	if err != nil {
+		_ = ctx.CloseSession(handle)
+		return nil, err
+	}
+	if pin != "" {
+		if err := ctx.Login(handle, pkcs11.CKU_USER, pin); err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)) {
+			_ = ctx.CloseSession(handle)
+			return nil, fmt.Errorf("cannot log in the PKCS#11 token: %w", err)
+		}
+	}
+
+	key, err := findKey(ctx, handle, u)
+	if err != nil {
+		_ = ctx.CloseSession(handle)
+		return nil, err
+	}
+
+	sess := &session{ctx: ctx, handle: handle, key: key}
+	sessions[rawURI] = sess
+	return &signer{session: sess, public: public}, nil
+}
+
+func loadModule(path string) (*pkcs11.Ctx, error) {
+	if ctx, has := modules[path]; has {
+		return ctx, nil
+	}
+
+	log.Debug("Loading the PKCS#11 module", "modulePath", path)
+	ctx := pkcs11.New(path)
+	if ctx == nil {
+		return nil, fmt.Errorf("%w: %s", ErrModuleLoad, path)
+	}
+	if err := ctx.Initialize(); err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED)) {
+		ctx.Destroy()
+		return nil, fmt.Errorf("%w: %s: %w", ErrModuleLoad, path, err)
+	}
+	modules[path] = ctx
+	return ctx, nil
+}
+
+func findSlot(ctx *pkcs11.Ctx, u *URI) (uint, error) {
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return 0, fmt.Errorf("cannot list the PKCS#11 slots: %w", err)
+	}
+
+	for _, slot := range slots {
+		if u.SlotID != nil && *u.SlotID != slot {
+			continue
+		}
+		info, err := ctx.GetTokenInfo(slot)
+		if err != nil {
+			log.Debug("Cannot read the PKCS#11 token info", "slot", slot, "err", err)
+			continue
+		}
+		if (u.Token == "" || u.Token == info.Label) &&
+			(u.Manufacturer == "" || u.Manufacturer == info.ManufacturerID) &&
+			(u.Serial == "" || u.Serial == info.SerialNumber) &&
+			(u.Model == "" || u.Model == info.Model) {
+			log.Debug("Found the PKCS#11 token", "slot", slot, "token", info.Label)
+			return slot, nil
+		}
+	}
+	return 0, ErrTokenNotFound
+}
+
+func findKey(ctx *pkcs11.Ctx, handle pkcs11.SessionHandle, u *URI) (pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+	}
+	if u.Object != "" {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_LABEL, u.Object))
+	}
+	if len(u.ID) != 0 {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, u.ID))
+	}
+
+	if err := ctx.FindObjectsInit(handle, template); err != nil {
+		return 0, fmt.Errorf("cannot search the PKCS#11 private key: %w", err)
+	}
+	defer func() { _ = ctx.FindObjectsFinal(handle) }()
+
+	objects, _, err := ctx.FindObjects(handle, 1)
+	if err != nil {
+		return 0, fmt.Errorf("cannot search the PKCS#11 private key: %w", err)
+	}
+	if len(objects) == 0 {
+		return 0, ErrKeyNotFound
+	}
+	return objects[0], nil
+}
+
+// Public returns the public key of the certificate.
+func (s *signer) Public() crypto.PublicKey {
+	return s.public
+}
+
+// Sign signs the digest with the private key of the token.
+func (s *signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var mechanism *pkcs11.Mechanism
+	data := digest
+
+	switch s.public.(type) {
+	case *rsa.PublicKey:
+		if pssOpts, ok := opts.(*rsa.PSSOptions); ok {
+			params, err := pssParams(pssOpts)
+			if err != nil {
+				return nil, err
+			}
+			mechanism = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_PSS, params)
+		} else {
+			prefix, has := pkcs1Prefixes[opts.HashFunc()]
+			if !has {
+				return nil, fmt.Errorf("%w: %s", ErrUnsupportedDigest, opts.HashFunc())
+			}
+			mechanism = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)
+			data = append(append([]byte{}, prefix...), digest...)
+		}
+
+	case *ecdsa.PublicKey:
+		mechanism = pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)
+
+	default:
+		return nil, fmt.Errorf("%w: %T", ErrUnsupportedKey, s.public)
+	}
+
+	s.session.mu.Lock()
+	defer s.session.mu.Unlock()
+
+	if err := s.session.ctx.SignInit(s.session.handle, []*pkcs11.Mechanism{mechanism}, s.session.key); err != nil {
+		return nil, fmt.Errorf("cannot sign with the PKCS#11 key: %w", err)
+	}
+	signature, err := s.session.ctx.Sign(s.session.handle, data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot sign with the PKCS#11 key: %w", err)
+	}
+
+	if _, ok := s.public.(*ecdsa.PublicKey); ok {
+		// PKCS#11 returns r || s, while TLS expects an ASN.1 sequence
+		return marshalECDSASignature(signature)
+	}
+	return signature, nil
+}
+
+// pkcs1Prefixes are the DigestInfo prefixes of the PKCS#1 v1.5 signatures.
+// The MD5+SHA1 digest, used by TLS < 1.2, has none.
+var pkcs1Prefixes = map[crypto.Hash][]byte{
+	crypto.MD5SHA1: {},
+	crypto.SHA1:    {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA224:  {0x30, 0x2d, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x04, 0x05, 0x00, 0x04, 0x1c},
+	crypto.SHA256:  {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384:  {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512:  {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+func pssParams(opts *rsa.PSSOptions) ([]byte, error) {
+	var hashAlg, mgf uint
+	switch opts.Hash {
+	case crypto.SHA256:
+		hashAlg, mgf = pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256
+	case crypto.SHA384:
+		hashAlg, mgf = pkcs11.CKM_SHA384, pkcs11.CKG_MGF1_SHA384
+	case crypto.SHA512:
+		hashAlg, mgf = pkcs11.CKM_SHA512, pkcs11.CKG_MGF1_SHA512
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedDigest, opts.Hash)
+	}
+
+	// TLS always uses a salt as long as the digest
+	saltLength := opts.SaltLength
+	if saltLength == rsa.PSSSaltLengthEqualsHash || saltLength == rsa.PSSSaltLengthAuto {
+		saltLength = opts.Hash.Size()
+	}
+	return pkcs11.NewPSSParams(hashAlg, mgf, uint(saltLength)), nil
+}
+
+func marshalECDSASignature(signature []byte) ([]byte, error) {
+	if len(signature) == 0 || len(signature)%2 != 0 {
+		return nil, fmt.Errorf("invalid ECDSA signature length returned by the PKCS#11 module: %d", len(signature))
+	}
+	half := len(signature) / 2
+	return asn1.Marshal(struct {
+		R, S *big.Int
+	}{
+		R: new(big.Int).SetBytes(signature[:half]),
+		S: new(big.Int).SetBytes(signature[half:]),
+	})
+}
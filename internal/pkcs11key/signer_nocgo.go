@@ -0,0 +1,29 @@
+// Copyright 2024 Ajabep
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !cgo
+
+package pkcs11key
+
+import (
+	"crypto"
+	"errors"
+)
+
+var ErrNoCGO = errors.New("PKCS#11 keys are not supported: unmtlsproxy has been built without cgo")
+
+// NewSigner always fails, since loading a PKCS#11 module requires cgo.
+func NewSigner(rawURI string, public crypto.PublicKey) (crypto.Signer, error) {
+	if _, err := ParseURI(rawURI); err != nil {
+		return nil, err
+	}
+	return nil, ErrNoCGO
+}
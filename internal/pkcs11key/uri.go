@@ -0,0 +1,174 @@
+// Copyright 2024 Ajabep
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pkcs11key signs TLS handshakes with keys held by a PKCS#11 module
+// (HSM, smart card, SoftHSM...)
+package pkcs11key
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const scheme = "pkcs11:"
+
+var (
+	ErrInvalidURI        = errors.New("invalid PKCS#11 URI")
+	ErrMissingModulePath = errors.New("the PKCS#11 URI has no `module-path` attribute")
+	ErrMissingObject     = errors.New("the PKCS#11 URI has no `object` nor `id` attribute")
+)
+
+// URI is a PKCS#11 URI, as defined by RFC 7512. Only the attributes useful to
+// find a private key are kept.
+type URI struct {
+	Token        string
+	Manufacturer string
+	Serial       string
+	Model        string
+	SlotID       *uint
+	Object       string
+	ID           []byte
+
+	ModulePath string
+	PinValue   string
+	PinSource  string
+}
+
+// IsURI returns if the string is a PKCS#11 URI.
+func IsURI(s string) bool {
+	return strings.HasPrefix(s, scheme)
+}
+
+// ParseURI parses a PKCS#11 URI such as
+// `pkcs11:token=mytoken;object=mykey?module-path=/usr/lib/softhsm/libsofthsm2.so&pin-value=1234`.
+func ParseURI(s string) (*URI, error) {
+	if !IsURI(s) {
+		return nil, fmt.Errorf("%w: missing the `%s` scheme", ErrInvalidURI, scheme)
+	}
+	path, query, _ := strings.Cut(strings.TrimPrefix(s, scheme), "?")
+
+	u := &URI{}
+	for _, attr := range splitAttributes(path, ";") {
+		name, value, err := parseAttribute(attr)
+		if err != nil {
+			return nil, err
+		}
+		switch name {
+		case "token":
+			u.Token = value
+		case "manufacturer":
+			u.Manufacturer = value
+		case "serial":
+			u.Serial = value
+		case "model":
+			u.Model = value
+		case "slot-id":
+			id, err := strconv.ParseUint(value, 10, 0)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid `slot-id`: %w", ErrInvalidURI, err)
+			}
+			slotID := uint(id)
+			u.SlotID = &slotID
+		case "object":
+			u.Object = value
+		case "id":
+			u.ID = []byte(value)
+		case "type":
+			if value != "private" {
+				return nil, fmt.Errorf("%w: only private keys can be used, not %q", ErrInvalidURI, value)
+			}
+		}
+	}
+
+	for _, attr := range splitAttributes(query, "&") {
+		name, value, err := parseAttribute(attr)
+		if err != nil {
+			return nil, err
+		}
+		switch name {
+		case "module-path":
+			u.ModulePath = value
+		case "pin-value":
+			u.PinValue = value
+		case "pin-source":
+			u.PinSource = value
+		}
+	}
+
+	if u.ModulePath == "" {
+		return nil, ErrMissingModulePath
+	}
+	if u.Object == "" && len(u.ID) == 0 {
+		return nil, ErrMissingObject
+	}
+	return u, nil
+}
+
+// Pin returns the PIN of the token, read from `pin-source` if needed. An empty
+// PIN means that no login is needed.
+func (u *URI) Pin() (string, error) {
+	if u.PinValue != "" || u.PinSource == "" {
+		return u.PinValue, nil
+	}
+
+	data, err := os.ReadFile(strings.TrimPrefix(u.PinSource, "file:"))
+	if err != nil {
+		return "", fmt.Errorf("cannot read the PIN source: %w", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// Redact returns the string with the value of its `pin-value` attributes
+// hidden, to be logged. A string which is not a PKCS#11 URI is returned as is.
+func Redact(s string) string {
+	if !IsURI(s) {
+		return s
+	}
+	path, query, hasQuery := strings.Cut(strings.TrimPrefix(s, scheme), "?")
+	redacted := scheme + redactAttributes(path, ";")
+	if hasQuery {
+		redacted += "?" + redactAttributes(query, "&")
+	}
+	return redacted
+}
+
+func redactAttributes(s, sep string) string {
+	attrs := splitAttributes(s, sep)
+	for i, attr := range attrs {
+		if name, _, _ := strings.Cut(attr, "="); name == "pin-value" {
+			attrs[i] = name + "=REDACTED"
+		}
+	}
+	return strings.Join(attrs, sep)
+}
+
+func splitAttributes(s, sep string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, sep)
+}
+
+func parseAttribute(attr string) (string, string, error) {
+	name, value, found := strings.Cut(attr, "=")
+	if !found {
+		return "", "", fmt.Errorf("%w: attribute without value: %q", ErrInvalidURI, attr)
+	}
+	value, err := url.PathUnescape(value)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %w", ErrInvalidURI, err)
+	}
+	return name, value, nil
+}
@@ -0,0 +1,171 @@
+// Copyright 2024 Ajabep
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package relay copies the streams between the clients and the backends
+package relay
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrNoHalfClose = errors.New("the connection cannot be half-closed")
+	ErrIdle        = errors.New("no traffic for the idle timeout")
+)
+
+// BufferSize is the size of the buffers used to copy the streams. It holds
+// two TLS records.
+const BufferSize = 32 << 10
+
+var buffers = sync.Pool{
+	New: func() any {
+		buffer := make([]byte, BufferSize)
+		return &buffer
+	},
+}
+
+// kernelCopy returns if the kernel can move the data from src to dst, without
+// copying them to the user space (splice on Linux). Only the tunnels passed
+// through by the forward mode, without upstream proxy, are between sockets:
+// the other streams have a TLS connection on one side.
+func kernelCopy(dst, src net.Conn) bool {
+	switch dst.(type) {
+	case *net.TCPConn:
+		switch src.(type) {
+		case *net.TCPConn, *net.UnixConn:
+			return true
+		}
+	case *net.UnixConn:
+		_, ok := src.(*net.TCPConn)
+		return ok
+	}
+	return false
+}
+
+// Copy copies src to dst until EOF on src, with a pooled buffer. Between
+// sockets, the kernel copies the data instead.
+func Copy(dst, src net.Conn) (int64, error) {
+	if kernelCopy(dst, src) {
+		return io.Copy(dst, src)
+	}
+
+	buffer := buffers.Get().(*[]byte)
+	defer buffers.Put(buffer)
+	// Hide the ReadFrom and WriteTo methods, which would use their own buffer
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buffer)
+}
+
+// CloseWrite shuts down the writing side of the connection: the peer reads
+// EOF, but can still send data.
+func CloseWrite(conn net.Conn) error {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		return c.CloseWrite()
+	}
+	return ErrNoHalfClose
+}
+
+// forward copies src to dst, then half-closes dst, so that the peer of dst
+// knows the stream has ended. If dst cannot be half-closed, its peer only
+// sees the end once the connections are closed.
+func forward(dst, src net.Conn) error {
+	if _, err := Copy(dst, src); err != nil {
+		return err
+	}
+	if err := CloseWrite(dst); err != nil && !errors.Is(err, ErrNoHalfClose) {
+		return err
+	}
+	return nil
+}
+
+// BufferedConn is a connection whose first bytes were already read into a
+// buffer.
+type BufferedConn struct {
+	net.Conn
+	Reader *bufio.Reader
+}
+
+func (c *BufferedConn) Read(b []byte) (int, error) {
+	return c.Reader.Read(b)
+}
+
+func (c *BufferedConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
+
+// activeConn records the time of its last read.
+type activeConn struct {
+	net.Conn
+	lastRead *atomic.Int64
+}
+
+func (c *activeConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.lastRead.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *activeConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
+
+// Pipe copies the streams of the connections, both ways. The end of a stream
+// is propagated as a half-close, if possible, and the other stream goes on.
+// It returns once both streams have ended, one of the copies fails, the
+// context is done, or, if the idle timeout is not zero, no data has been
+// read for the idle timeout. The copies still running stop once the caller
+// closes the connections.
+func Pipe(ctx context.Context, a, b net.Conn, idleTimeout time.Duration) error {
+	var lastRead atomic.Int64
+	var timer *time.Timer = nil
+	var idle <-chan time.Time = nil
+	if idleTimeout > 0 {
+		// The kernel cannot copy the data of the wrapped connections: their
+		// reads are seen
+		lastRead.Store(time.Now().UnixNano())
+		a = &activeConn{Conn: a, lastRead: &lastRead}
+		b = &activeConn{Conn: b, lastRead: &lastRead}
+		timer = time.NewTimer(idleTimeout)
+		defer timer.Stop()
+		idle = timer.C
+	}
+
+	errs := make(chan error, 2)
+	go func() { errs <- forward(b, a) }()
+	go func() { errs <- forward(a, b) }()
+
+	for ended := 0; ended < 2; {
+		select {
+		case err := <-errs:
+			if err != nil {
+				return err
+			}
+			ended++
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-idle:
+			remaining := idleTimeout - time.Since(time.Unix(0, lastRead.Load()))
+			if remaining <= 0 {
+				return ErrIdle
+			}
+			timer.Reset(remaining)
+		}
+	}
+	return nil
+}
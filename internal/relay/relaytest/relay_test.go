@@ -0,0 +1,262 @@
+package relaytest
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ajabep/unmtlsproxy/internal/relay"
+	"github.com/ajabep/unmtlsproxy/tests"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t testing.TB) (net.Conn, net.Conn) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-accepted
+	if server == nil {
+		t.Fatal("cannot accept the connection")
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// pipe relays a client and a backend, and returns the error of relay.Pipe.
+func pipe(t *testing.T, ctx context.Context, idleTimeout time.Duration) (client, backend net.Conn, result <-chan error) {
+	client, front := tcpPair(t)
+	back, backend := tcpPair(t)
+	errs := make(chan error, 1)
+	go func() { errs <- relay.Pipe(ctx, front, back, idleTimeout) }()
+	return client, backend, errs
+}
+
+func TestPipeHalfClose(t *testing.T) {
+	client, backend, errs := pipe(t, context.Background(), 0)
+
+	// The backend answers once the whole request is received
+	go func() {
+		request, _ := io.ReadAll(backend)
+		_, _ = backend.Write(append([]byte("echo: "), request...))
+		_ = relay.CloseWrite(backend)
+	}()
+
+	if _, err := client.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	if err := relay.CloseWrite(client); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	response, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response) != "echo: request" {
+		t.Errorf("Unexpected response: %q", response)
+	}
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("The pipe has not returned")
+	}
+}
+
+func TestPipeCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	_, _, errs := pipe(t, ctx, 0)
+
+	cancel()
+	select {
+	case err := <-errs:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected error %q, got %v", context.Canceled, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("The pipe has not returned")
+	}
+}
+
+func TestPipeIdle(t *testing.T) {
+	client, backend, errs := pipe(t, context.Background(), 300*time.Millisecond)
+	go func() { _, _ = io.Copy(io.Discard, backend) }()
+
+	// The traffic keeps the pipe open
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if _, err := client.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, relay.ErrIdle) {
+			t.Errorf("Expected error %q, got %v", relay.ErrIdle, err)
+		}
+		if elapsed := time.Since(start); elapsed < 700*time.Millisecond {
+			t.Errorf("The pipe has been closed while active, after %s", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("The idle pipe has not returned")
+	}
+}
+
+func TestPipeNoHalfClose(t *testing.T) {
+	// The pipes cannot be half-closed: the backend does not see the end of
+	// the request, but its answer is still relayed
+	client, front := tcpPair(t)
+	back, backend := net.Pipe()
+	defer backend.Close()
+	errs := make(chan error, 1)
+	go func() { errs <- relay.Pipe(context.Background(), front, back, 0) }()
+
+	if _, err := io.WriteString(client, "request"); err != nil {
+		t.Fatal(err)
+	}
+	if err := relay.CloseWrite(client); err != nil {
+		t.Fatal(err)
+	}
+	request := make([]byte, len("request"))
+	if _, err := io.ReadFull(backend, request); err != nil || string(request) != "request" {
+		t.Fatalf("Unexpected request: %q, %v", request, err)
+	}
+	if _, err := io.WriteString(backend, "answer"); err != nil {
+		t.Fatalf("The answer is not relayed: %s", err)
+	}
+	backend.Close()
+	if answer, err := io.ReadAll(client); err != nil || string(answer) != "answer" {
+		t.Errorf("Unexpected answer: %q, %v", answer, err)
+	}
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("The pipe has not returned")
+	}
+}
+
+// copyWith1KiBBuffer is the copy loop used before the relay package, as a
+// reference.
+func copyWith1KiBBuffer(dst, src net.Conn) (int64, error) {
+	var written int64
+	buffer := make([]byte, 1024)
+	for {
+		n, err := src.Read(buffer)
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+		if _, err := dst.Write(buffer[:n]); err != nil {
+			return written, err
+		}
+		written += int64(n)
+	}
+}
+
+// tlsPair returns both ends of a loopback TLS connection, once the handshake
+// is done.
+func tlsPair(tb testing.TB) (*tls.Conn, *tls.Conn) {
+	tb.Helper()
+	var certPem, keyPem bytes.Buffer
+	if _, _, err := tests.GenerateServerCertificate(nil, []net.IP{net.IPv4(127, 0, 0, 1)}, &certPem, &keyPem); err != nil {
+		tb.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPem.Bytes(), keyPem.Bytes())
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	rawClient, rawServer := tcpPair(tb)
+	client := tls.Client(rawClient, &tls.Config{InsecureSkipVerify: true})
+	server := tls.Server(rawServer, &tls.Config{Certificates: []tls.Certificate{cert}})
+	handshake := make(chan error, 1)
+	go func() { handshake <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		tb.Fatal(err)
+	}
+	if err := <-handshake; err != nil {
+		tb.Fatal(err)
+	}
+	return client, server
+}
+
+// BenchmarkCopy measures the copies from a TLS connection to a socket, as the
+// ones from the backends to the clients: the kernel cannot copy them, thus the
+// pooled buffer is used.
+func BenchmarkCopy(b *testing.B) {
+	const chunkSize = 256 << 10
+	chunk := bytes.Repeat([]byte{'x'}, chunkSize)
+
+	for _, benchmark := range []struct {
+		name string
+		copy func(dst, src net.Conn) (int64, error)
+	}{
+		{"1KiB buffer", copyWith1KiBBuffer},
+		{"pooled buffer", relay.Copy},
+	} {
+		b.Run(benchmark.name, func(b *testing.B) {
+			writer, src := tlsPair(b)
+			dst, reader := tcpPair(b)
+			b.SetBytes(chunkSize)
+			b.ResetTimer()
+
+			go func() {
+				for i := 0; i < b.N; i++ {
+					if _, err := writer.Write(chunk); err != nil {
+						break
+					}
+				}
+				writer.Close()
+			}()
+			copied := make(chan error, 1)
+			go func() {
+				_, err := benchmark.copy(dst, src)
+				dst.Close()
+				copied <- err
+			}()
+
+			if n, err := io.Copy(io.Discard, reader); err != nil || n != int64(b.N)*chunkSize {
+				b.Fatalf("Copied %d bytes: %v", n, err)
+			}
+			if err := <-copied; err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2024 Ajabep
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package reload triggers the reloading of the certificates
+package reload
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/ajabep/unmtlsproxy/internal/log"
+	"github.com/fsnotify/fsnotify"
+)
+
+// Files are usually renewed by several writes, or by writing a new file and
+// renaming it. Wait for things to settle before reloading.
+const debounceDelay = 200 * time.Millisecond
+
+// Start calls `reload` on SIGHUP and, if `watch` is set, when one of the
+// paths changes. It stops when the context is done. Is NOT blocking.
+func Start(ctx context.Context, paths []string, watch bool, reload func()) error {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	var watcher *fsnotify.Watcher
+	watched := map[string]struct{}{}
+	if watch {
+		var err error
+		if watcher, err = fsnotify.NewWatcher(); err != nil {
+			signal.Stop(hup)
+			return err
+		}
+
+		// The parent directories are watched, instead of the files, to
+		// survive the files being replaced (atomic renames, symlink swaps...)
+		dirs := map[string]struct{}{}
+		for _, path := range paths {
+			path = filepath.Clean(path)
+			watched[path] = struct{}{}
+			dir := filepath.Dir(path)
+			if info, err := os.Stat(path); err == nil && info.IsDir() {
+				dir = path
+			}
+			dirs[dir] = struct{}{}
+		}
+		for dir := range dirs {
+			log.Debug("Watching a directory", "dir", dir)
+			if err := watcher.Add(dir); err != nil {
+				watcher.Close()
+				signal.Stop(hup)
+				return err
+			}
+		}
+		events = watcher.Events
+		errs = watcher.Errors
+	}
+
+	go func() {
+		defer signal.Stop(hup)
+		if watcher != nil {
+			defer watcher.Close()
+		}
+
+		debounce := time.NewTimer(debounceDelay)
+		debounce.Stop()
+		defer debounce.Stop()
+
+		for {
+			select {
+			case <-hup:
+				log.Info("Received SIGHUP, reloading the certificates")
+				reload()
+
+			case event := <-events:
+				if !isWatched(watched, event.Name) || event.Op == fsnotify.Chmod {
+					continue
+				}
+				log.Debug("A watched file changed", "event", event)
+				debounce.Reset(debounceDelay)
+
+			case <-debounce.C:
+				log.Info("Certificate files changed, reloading the certificates")
+				reload()
+
+			case err := <-errs:
+				log.Error("Error while watching the certificate files", "err", err)
+
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// isWatched returns if the file is one of the watched paths, or is in one of
+// the watched directories.
+func isWatched(watched map[string]struct{}, name string) bool {
+	name = filepath.Clean(name)
+	if _, has := watched[name]; has {
+		return true
+	}
+	_, has := watched[filepath.Dir(name)]
+	return has
+}
@@ -0,0 +1,63 @@
+//go:build unix
+
+package reloadtest
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ajabep/unmtlsproxy/internal/reload"
+)
+
+func TestReloadOnFileChange(t *testing.T) {
+	tmpDir := t.TempDir()
+	watchedPath := filepath.Join(tmpDir, "client.crt.pem")
+	if err := os.WriteFile(watchedPath, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reloaded := make(chan struct{}, 10)
+	if err := reload.Start(ctx, []string{watchedPath}, true, func() { reloaded <- struct{}{} }); err != nil {
+		t.Fatal(err)
+	}
+
+	// Not a watched file
+	if err := os.WriteFile(filepath.Join(tmpDir, "other"), []byte("other"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-reloaded:
+		t.Errorf("Reloaded while no watched file changed")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// Replaced like most tools renewing certificates do
+	newPath := filepath.Join(tmpDir, "client.crt.pem.new")
+	if err := os.WriteFile(newPath, []byte("new"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(newPath, watchedPath); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-reloaded:
+	case <-time.After(2 * time.Second):
+		t.Errorf("Not reloaded while the watched file changed")
+	}
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-reloaded:
+	case <-time.After(2 * time.Second):
+		t.Errorf("Not reloaded on SIGHUP")
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2024 Ajabep
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package scope restricts the destinations the proxy connects to
+package scope
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidPattern = errors.New("invalid scope pattern. Use `host`, `*.domain`, `*`, an IP address or a CIDR, optionally followed by `:port`")
+
+// Scope is a list of allowed destinations.
+type Scope struct {
+	rules []rule
+}
+
+type rule struct {
+	// host is empty for CIDR rules. `*` matches any host, and `*.domain` any
+	// subdomain.
+	host   string
+	prefix netip.Prefix
+	// port is 0 for any port
+	port uint16
+}
+
+// Parse parses the patterns of the allowed destinations: a hostname, `*.`
+// followed by a domain for its subdomains, `*` for any host, an IP address,
+// or a CIDR. Each of them can be followed by `:port` to only allow this port.
+// IPv6 addresses with a port are written between brackets.
+func Parse(patterns []string) (*Scope, error) {
+	s := &Scope{}
+	for _, pattern := range patterns {
+		r, err := parseRule(pattern)
+		if err != nil {
+			return nil, err
+		}
+		s.rules = append(s.rules, r)
+	}
+	return s, nil
+}
+
+func parseRule(pattern string) (rule, error) {
+	r := rule{}
+	host := pattern
+	if h, port, err := net.SplitHostPort(pattern); err == nil {
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil || p == 0 {
+			return r, fmt.Errorf("%w: %s", ErrInvalidPattern, pattern)
+		}
+		host, r.port = h, uint16(p)
+	}
+	if host == "" {
+		return r, fmt.Errorf("%w: %s", ErrInvalidPattern, pattern)
+	}
+
+	if strings.Contains(host, "/") {
+		prefix, err := netip.ParsePrefix(host)
+		if err != nil {
+			return r, fmt.Errorf("%w: %s", ErrInvalidPattern, pattern)
+		}
+		r.prefix = prefix.Masked()
+		return r, nil
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ip = ip.Unmap()
+		r.prefix = netip.PrefixFrom(ip, ip.BitLen())
+		return r, nil
+	}
+
+	r.host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if r.host != "*" && strings.Contains(strings.TrimPrefix(r.host, "*."), "*") {
+		return r, fmt.Errorf("%w: %s", ErrInvalidPattern, pattern)
+	}
+	return r, nil
+}
+
+func (r *rule) allows(host string, ip netip.Addr, port uint16) bool {
+	if r.port != 0 && r.port != port {
+		return false
+	}
+	if r.prefix.IsValid() {
+		return ip.IsValid() && r.prefix.Contains(ip)
+	}
+	if r.host == "*" {
+		return true
+	}
+	if domain, found := strings.CutPrefix(r.host, "*."); found {
+		return strings.HasSuffix(host, "."+domain)
+	}
+	return host == r.host
+}
+
+// Allowed returns if the destination is allowed. The host is either a
+// hostname or an IP address; hostnames are not resolved to be checked
+// against the CIDRs.
+func (s *Scope) Allowed(host string, port uint16) bool {
+	host = strings.ToLower(strings.TrimSuffix(strings.Trim(host, "[]"), "."))
+	ip, err := netip.ParseAddr(host)
+	if err == nil {
+		ip = ip.Unmap()
+	}
+	for i := range s.rules {
+		if s.rules[i].allows(host, ip, port) {
+			return true
+		}
+	}
+	return false
+}
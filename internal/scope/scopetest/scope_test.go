@@ -0,0 +1,66 @@
+package scopetest
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ajabep/unmtlsproxy/internal/scope"
+)
+
+func TestScope(t *testing.T) {
+	s, err := scope.Parse([]string{"example.com", "*.internal.example.com", "api.example.org:8443", "10.0.0.0/8", "192.0.2.1:443", "[2001:db8::1]:443"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		host    string
+		port    uint16
+		allowed bool
+	}{
+		{"example.com", 443, true},
+		{"EXAMPLE.com.", 8443, true},
+		{"www.example.com", 443, false},
+		{"a.internal.example.com", 443, true},
+		{"a.b.internal.example.com", 443, true},
+		{"internal.example.com", 443, false},
+		{"api.example.org", 8443, true},
+		{"api.example.org", 443, false},
+		{"10.1.2.3", 443, true},
+		{"::ffff:10.1.2.3", 443, true},
+		{"11.1.2.3", 443, false},
+		{"192.0.2.1", 443, true},
+		{"192.0.2.1", 8443, false},
+		{"[2001:db8::1]", 443, true},
+		{"2001:db8::2", 443, false},
+	}
+	for _, testcase := range testcases {
+		if allowed := s.Allowed(testcase.host, testcase.port); allowed != testcase.allowed {
+			t.Errorf("%s:%d: expected allowed=%t, got %t", testcase.host, testcase.port, testcase.allowed, allowed)
+		}
+	}
+
+	anyScope, err := scope.Parse([]string{"*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !anyScope.Allowed("example.net", 1234) || !anyScope.Allowed("192.0.2.1", 443) {
+		t.Errorf("The `*` scope does not allow every destination")
+	}
+
+	empty, err := scope.Parse(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty.Allowed("example.com", 443) {
+		t.Errorf("The empty scope allows a destination")
+	}
+}
+
+func TestScopeInvalid(t *testing.T) {
+	for _, pattern := range []string{"", ":443", "example.com:0", "example.com:http", "example.com:65536", "10.0.0.0/33", "a.*.example.com", "*example.com"} {
+		if _, err := scope.Parse([]string{pattern}); !errors.Is(err, scope.ErrInvalidPattern) {
+			t.Errorf("%q: expected error %q, got %v", pattern, scope.ErrInvalidPattern, err)
+		}
+	}
+}
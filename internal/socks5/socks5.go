@@ -0,0 +1,211 @@
+// Copyright 2024 Ajabep
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package socks5 implements the server side of the SOCKS5 CONNECT command
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+)
+
+var (
+	ErrUnsupportedVersion     = errors.New("unsupported SOCKS version")
+	ErrNoAcceptableMethod     = errors.New("no acceptable authentication method")
+	ErrAuthenticationFailed   = errors.New("invalid SOCKS credentials")
+	ErrUnsupportedCommand     = errors.New("unsupported SOCKS command")
+	ErrUnsupportedAddressType = errors.New("unsupported SOCKS address type")
+)
+
+const version = 5
+
+// Authentication methods (RFC 1928, section 3)
+const (
+	methodNoAuth       = 0x00
+	methodUserPassword = 0x02
+	methodNoAcceptable = 0xff
+)
+
+// Username/password authentication (RFC 1929)
+const (
+	userPasswordVersion = 1
+	userPasswordSuccess = 0
+	userPasswordFailure = 1
+)
+
+const commandConnect = 0x01
+
+// Address types (RFC 1928, section 5)
+const (
+	addressIPv4   = 0x01
+	addressDomain = 0x03
+	addressIPv6   = 0x04
+)
+
+// Reply codes (RFC 1928, section 6)
+const (
+	ReplySucceeded               byte = 0x00
+	ReplyGeneralFailure          byte = 0x01
+	ReplyNotAllowed              byte = 0x02
+	ReplyNetworkUnreachable      byte = 0x03
+	ReplyHostUnreachable         byte = 0x04
+	ReplyConnectionRefused       byte = 0x05
+	ReplyTTLExpired              byte = 0x06
+	ReplyCommandNotSupported     byte = 0x07
+	ReplyAddressTypeNotSupported byte = 0x08
+)
+
+// Request is the destination requested by the client.
+type Request struct {
+	Host string
+	Port uint16
+	// User is the authenticated user, if any.
+	User string
+}
+
+// String formats the destination as `host:port`.
+func (r *Request) String() string {
+	return net.JoinHostPort(r.Host, strconv.Itoa(int(r.Port)))
+}
+
+// Handshake negotiates the authentication method, authenticates the client
+// and reads its request. If authenticate is nil, no authentication is
+// required; otherwise, the username/password method is. The unsupported
+// requests are answered; the other ones have to be answered with Reply.
+func Handshake(conn io.ReadWriter, authenticate func(user, password string) bool) (*Request, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != version {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+
+	method := byte(methodNoAuth)
+	if authenticate != nil {
+		method = methodUserPassword
+	}
+	if !slices.Contains(methods, method) {
+		_, _ = conn.Write([]byte{version, methodNoAcceptable})
+		return nil, ErrNoAcceptableMethod
+	}
+	if _, err := conn.Write([]byte{version, method}); err != nil {
+		return nil, err
+	}
+
+	user := ""
+	if authenticate != nil {
+		var err error
+		if user, err = authenticateUserPassword(conn, authenticate); err != nil {
+			return nil, err
+		}
+	}
+
+	// VER CMD RSV ATYP
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return nil, err
+	}
+	if request[0] != version {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, request[0])
+	}
+
+	var host string
+	switch request[3] {
+	case addressIPv4, addressIPv6:
+		ip := make([]byte, 4)
+		if request[3] == addressIPv6 {
+			ip = make([]byte, 16)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return nil, err
+		}
+		addr, _ := netip.AddrFromSlice(ip)
+		host = addr.Unmap().String()
+	case addressDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return nil, err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return nil, err
+		}
+		host = string(domain)
+	default:
+		_ = Reply(conn, ReplyAddressTypeNotSupported)
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedAddressType, request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return nil, err
+	}
+
+	if request[1] != commandConnect {
+		_ = Reply(conn, ReplyCommandNotSupported)
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedCommand, request[1])
+	}
+	return &Request{
+		Host: host,
+		Port: binary.BigEndian.Uint16(port),
+		User: user,
+	}, nil
+}
+
+// authenticateUserPassword runs the username/password authentication.
+func authenticateUserPassword(conn io.ReadWriter, authenticate func(user, password string) bool) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != userPasswordVersion {
+		return "", fmt.Errorf("%w: %d", ErrUnsupportedVersion, header[0])
+	}
+	user := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return "", err
+	}
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return "", err
+	}
+	password := make([]byte, length[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return "", err
+	}
+
+	if !authenticate(string(user), string(password)) {
+		_, _ = conn.Write([]byte{userPasswordVersion, userPasswordFailure})
+		return "", ErrAuthenticationFailed
+	}
+	if _, err := conn.Write([]byte{userPasswordVersion, userPasswordSuccess}); err != nil {
+		return "", err
+	}
+	return string(user), nil
+}
+
+// Reply answers the request of the client. The bound address is not
+// disclosed.
+func Reply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{version, code, 0, addressIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,124 @@
+package socks5test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/ajabep/unmtlsproxy/internal/socks5"
+	"golang.org/x/net/proxy"
+)
+
+// pipeDialer connects the SOCKS5 client to one end of a pipe.
+type pipeDialer struct {
+	conn net.Conn
+}
+
+func (d *pipeDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.conn, nil
+}
+
+func TestHandshake(t *testing.T) {
+	testcases := []struct {
+		name         string
+		auth         *proxy.Auth
+		authenticate func(user, password string) bool
+		destination  string
+		expected     socks5.Request
+		err          error
+	}{
+		{
+			name:        "domain, no authentication",
+			destination: "client.badssl.com:443",
+			expected:    socks5.Request{Host: "client.badssl.com", Port: 443},
+		},
+		{
+			name:        "IPv4",
+			destination: "192.0.2.1:8443",
+			expected:    socks5.Request{Host: "192.0.2.1", Port: 8443},
+		},
+		{
+			name:        "IPv6",
+			destination: "[2001:db8::1]:443",
+			expected:    socks5.Request{Host: "2001:db8::1", Port: 443},
+		},
+		{
+			name:         "valid credentials",
+			auth:         &proxy.Auth{User: "blahaj", Password: "hugs"},
+			authenticate: func(user, password string) bool { return user == "blahaj" && password == "hugs" },
+			destination:  "client.badssl.com:443",
+			expected:     socks5.Request{Host: "client.badssl.com", Port: 443, User: "blahaj"},
+		},
+		{
+			name:         "invalid credentials",
+			auth:         &proxy.Auth{User: "blahaj", Password: "bites"},
+			authenticate: func(user, password string) bool { return user == "blahaj" && password == "hugs" },
+			destination:  "client.badssl.com:443",
+			err:          socks5.ErrAuthenticationFailed,
+		},
+		{
+			name:         "missing credentials",
+			authenticate: func(user, password string) bool { return true },
+			destination:  "client.badssl.com:443",
+			err:          socks5.ErrNoAcceptableMethod,
+		},
+	}
+	for _, testcase := range testcases {
+		client, server := net.Pipe()
+
+		dialer, err := proxy.SOCKS5("tcp", "proxy", testcase.auth, &pipeDialer{conn: client})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dialed := make(chan error, 1)
+		go func() {
+			conn, err := dialer.Dial("tcp", testcase.destination)
+			if err == nil {
+				conn.Close()
+			}
+			dialed <- err
+		}()
+
+		request, err := socks5.Handshake(server, testcase.authenticate)
+		if !errors.Is(err, testcase.err) {
+			t.Errorf("%s: expected error %v, got %v", testcase.name, testcase.err, err)
+		}
+		if err == nil {
+			if *request != testcase.expected {
+				t.Errorf("%s: expected request %+v, got %+v", testcase.name, testcase.expected, *request)
+			}
+			if err := socks5.Reply(server, socks5.ReplySucceeded); err != nil {
+				t.Fatal(err)
+			}
+		}
+		server.Close()
+
+		if err := <-dialed; (err == nil) != (testcase.err == nil) {
+			t.Errorf("%s: unexpected client error: %v", testcase.name, err)
+		}
+	}
+}
+
+func TestHandshakeUnsupportedCommand(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	replies := make(chan []byte, 1)
+	go func() {
+		// Negotiation, then BIND client.badssl.com:443
+		_, _ = client.Write([]byte{5, 1, 0})
+		_, _ = io.ReadFull(client, make([]byte, 2))
+		_, _ = client.Write(append(append([]byte{5, 2, 0, 3, 17}, "client.badssl.com"...), 1, 187))
+		reply, _ := io.ReadAll(client)
+		replies <- reply
+	}()
+
+	if _, err := socks5.Handshake(server, nil); !errors.Is(err, socks5.ErrUnsupportedCommand) {
+		t.Errorf("Expected error %v, got %v", socks5.ErrUnsupportedCommand, err)
+	}
+	server.Close()
+	if reply := <-replies; len(reply) < 2 || reply[1] != socks5.ReplyCommandNotSupported {
+		t.Errorf("Unexpected reply: %v", reply)
+	}
+}
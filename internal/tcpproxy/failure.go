@@ -0,0 +1,96 @@
+// Copyright 2024 Ajabep
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	"github.com/ajabep/unmtlsproxy/internal/relay"
+)
+
+// Time given to the clients to read the failure message. Meanwhile, their data
+// are discarded: closing a socket with unread data resets it, and the message
+// could be lost.
+const failureLingerTimeout = 1 * time.Second
+
+// postgresErrorResponse returns a PostgreSQL ErrorResponse message.
+func postgresErrorResponse(severity, code, message string) []byte {
+	var fields []byte
+	for _, field := range []struct {
+		kind  byte
+		value string
+	}{
+		{'S', severity},
+		{'V', severity},
+		{'C', code},
+		{'M', message},
+	} {
+		fields = append(fields, field.kind)
+		fields = append(fields, field.value...)
+		fields = append(fields, 0)
+	}
+	fields = append(fields, 0)
+
+	response := []byte{'E'}
+	// The length includes itself
+	response = binary.BigEndian.AppendUint32(response, uint32(len(fields)+4))
+	return append(response, fields...)
+}
+
+// failureMessages tell the clients the backend cannot be reached, by error
+// style. They have no detail: the error is only logged.
+var failureMessages = map[string][]byte{
+	"http":     []byte("HTTP/1.1 502 Bad Gateway\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: 12\r\nConnection: close\r\n\r\nBad Gateway\n"),
+	"postgres": postgresErrorResponse("FATAL", "08006", "the backend is unreachable"),
+	"smtp":     []byte("421 Service not available, closing transmission channel\r\n"),
+}
+
+// reportFailure tells the client the backend cannot be reached, in the error
+// style: close, reset, or one of the failureMessages. The caller closes the
+// connection.
+func reportFailure(client net.Conn, style string) error {
+	switch style {
+	case "close":
+		return nil
+	case "reset":
+		return reset(client)
+	}
+
+	if err := client.SetDeadline(time.Now().Add(failureLingerTimeout)); err != nil {
+		return err
+	}
+	if _, err := client.Write(failureMessages[style]); err != nil {
+		return err
+	}
+	if err := relay.CloseWrite(client); err != nil {
+		return err
+	}
+	// Until the client closes the connection, or the timeout
+	_, _ = io.Copy(io.Discard, client)
+	return nil
+}
+
+// reset makes the closing of the connection send a TCP RST. The Unix sockets
+// are only closed.
+func reset(conn net.Conn) error {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		return tcpConn.SetLinger(0)
+	}
+	return nil
+}
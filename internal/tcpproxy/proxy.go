@@ -14,116 +14,329 @@ package tcpproxy
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"net"
-	"os"
-	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/ajabep/unmtlsproxy/internal/access"
 	"github.com/ajabep/unmtlsproxy/internal/configuration"
+	"github.com/ajabep/unmtlsproxy/internal/identity"
+	"github.com/ajabep/unmtlsproxy/internal/lifecycle"
+	"github.com/ajabep/unmtlsproxy/internal/listener"
 	"github.com/ajabep/unmtlsproxy/internal/log"
+	"github.com/ajabep/unmtlsproxy/internal/relay"
+	"github.com/ajabep/unmtlsproxy/internal/upstream"
+	"github.com/ajabep/unmtlsproxy/internal/verify"
 )
 
 type proxy struct {
-	from      configuration.Addr
-	to        configuration.Addr
-	tlsConfig *tls.Config
+	from            configuration.Addr
+	to              configuration.Addr
+	tlsConfig       *tls.Config
+	listenTLSConfig *tls.Config
+	filter          *access.Filter
+	preamble        string
+	errorStyle      string
+	dialer          upstream.Dialer
+	timeouts        upstream.Timeouts
+	// connect opens the connection to the backend, once the client is
+	// accepted. It reports the errors to the client.
+	connect func(ctx context.Context, client net.Conn) (net.Conn, error)
+	// tracker tracks the client connections, to drain them on shutdown
+	tracker lifecycle.Tracker
+	// slots holds a value per handled connection, if their number is
+	// limited
+	slots chan struct{}
+	// rejectOverflow closes the connections over the limit, instead of
+	// leaving them in the listen backlog
+	rejectOverflow bool
+	// maxLifetime is the time after which the connections are closed, if
+	// not zero
+	maxLifetime time.Duration
 }
 
-func newProxy(from, to configuration.Addr, tlsConfig *tls.Config) *proxy {
-	return &proxy{
-		from:      from,
-		to:        to,
-		tlsConfig: tlsConfig,
+func newProxy(from, to configuration.Addr, tlsConfig, listenTLSConfig *tls.Config, filter *access.Filter, preamble, errorStyle string, dialer upstream.Dialer, timeouts upstream.Timeouts) *proxy {
+	p := &proxy{
+		from:            from,
+		to:              to,
+		tlsConfig:       tlsConfig,
+		listenTLSConfig: listenTLSConfig,
+		filter:          filter,
+		preamble:        preamble,
+		errorStyle:      errorStyle,
+		dialer:          dialer,
+		timeouts:        timeouts,
 	}
+	p.connect = p.connectBackend
+	return p
 }
 
-// Start the proxy. Is blocking!
-func (p *proxy) start(ctx context.Context) error {
-	log.Debug("Binding port", "listening addr", p.from)
-	listener, err := net.Listen("tcp", p.from.String())
-	if err != nil {
-		return err
+// Bounds of the delay before accepting again, after a temporary error
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = 1 * time.Second
+)
+
+// temporaryAcceptErrors are the accept errors due to a lack of resources, or
+// to a client leaving before being accepted. Accepting again may succeed.
+var temporaryAcceptErrors = []error{
+	syscall.EMFILE,
+	syscall.ENFILE,
+	syscall.ENOBUFS,
+	syscall.ENOMEM,
+	syscall.ECONNABORTED,
+	syscall.ECONNRESET,
+	syscall.EINTR,
+	syscall.EAGAIN,
+}
+
+func isTemporaryAcceptError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	for _, temporary := range temporaryAcceptErrors {
+		if errors.Is(err, temporary) {
+			return true
+		}
 	}
+	return false
+}
+
+// Start the proxy. Is blocking! It returns once the listener is closed, or
+// the context is done, and on the accept errors which are not temporary.
+func (p *proxy) start(ctx context.Context, listener net.Listener) error {
 	defer listener.Close()
 
+	listener = p.filter.Listener(listener)
+	if p.listenTLSConfig != nil {
+		log.Debug("Enabling TLS on the bound port", "listening addr", p.from)
+		listener = tls.NewListener(listener, p.listenTLSConfig)
+	}
+
+	// Accept is only interrupted by closing the listener
+	stop := context.AfterFunc(ctx, func() {
+		log.Debug("Closing the bound port", "listeningAddr", p.from)
+		listener.Close()
+	})
+	defer stop()
+
+	var delay time.Duration
 	for {
-		select {
+		// Until a connection ends, the clients over the limit wait in the
+		// listen backlog
+		if !p.rejectOverflow && !p.acquire(ctx) {
+			return nil
+		}
 
-		default:
-			if connection, err := listener.Accept(); err == nil {
-				log.Debug("Accepting a new connection", "listening addr", p.from)
-				go p.handle(ctx, connection)
+		connection, err := listener.Accept()
+		if err != nil {
+			if !p.rejectOverflow {
+				p.release()
+			}
+			if errors.Is(err, net.ErrClosed) || ctx.Err() != nil {
+				log.Debug("Closed the bound port", "listeningAddr", p.from)
+				return nil
+			}
+			if !isTemporaryAcceptError(err) {
+				return err
 			}
 
-		case <-ctx.Done():
-			log.Debug("Closing the bound port", "listeningAddr", p.from)
-			return nil
+			delay = min(max(2*delay, minAcceptDelay), maxAcceptDelay)
+			log.Warn("Cannot accept a connection, retrying", "err", err, "listeningAddr", p.from, "delay", delay)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return nil
+			}
+			continue
+		}
+		delay = 0
+
+		if p.rejectOverflow && !p.tryAcquire() {
+			log.Warn("Rejected a client over the maximum number of connections", "client", connection.RemoteAddr(), "maxConnections", cap(p.slots))
+			connection.Close()
+			continue
 		}
+
+		log.Debug("Accepting a new connection", "listening addr", p.from)
+		release := p.tracker.Track(connection)
+		go func() {
+			defer p.release()
+			defer release()
+			p.handle(ctx, connection)
+		}()
+	}
+}
+
+// acquire waits for a free connection slot. It returns false if the context
+// is done first.
+func (p *proxy) acquire(ctx context.Context) bool {
+	if p.slots == nil {
+		return true
+	}
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	default:
+	}
+	log.Debug("Maximum number of connections reached, queueing the clients", "listeningAddr", p.from, "maxConnections", cap(p.slots))
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// tryAcquire takes a free connection slot, if any.
+func (p *proxy) tryAcquire() bool {
+	if p.slots == nil {
+		return true
+	}
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *proxy) release() {
+	if p.slots != nil {
+		<-p.slots
 	}
 }
 
 func (p *proxy) handle(ctx context.Context, connection net.Conn) {
 	defer connection.Close()
 
-	log.Debug("Opening a socket to the backend", "destinationAddr", p.to)
-	remote, err := tls.Dial("tcp", p.to.String(), p.tlsConfig)
+	if p.maxLifetime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.maxLifetime)
+		defer cancel()
+	}
+
+	if tlsConnection, ok := connection.(*tls.Conn); ok {
+		if p.timeouts.Handshake > 0 {
+			_ = connection.SetDeadline(time.Now().Add(p.timeouts.Handshake))
+		}
+		// Do not open a socket to the backend for clients failing the handshake
+		if err := tlsConnection.HandshakeContext(ctx); err != nil {
+			log.Error("Error during the TLS handshake with the client", "err", err, "client", connection.RemoteAddr())
+			return
+		}
+		if err := connection.SetDeadline(time.Time{}); err != nil {
+			return
+		}
+	}
+
+	if p.preamble != "" {
+		if err := access.CheckPreamble(connection, p.preamble); err != nil {
+			log.Warn("Rejected a client without the valid preamble", "err", err, "client", connection.RemoteAddr())
+			return
+		}
+	}
+
+	remote, err := p.connect(ctx, connection)
 	if err != nil {
-		log.Error("Error connecting the backend", "err", err, "backend", p.to)
-		_, _ = connection.Write([]byte(err.Error()))
 		return
 	}
 	defer remote.Close()
 
-	subctx, cancel := context.WithCancel(ctx)
-	go p.copy(subctx, cancel, remote, connection)
-	go p.copy(subctx, cancel, connection, remote)
+	err = relay.Pipe(ctx, connection, remote, p.timeouts.Idle)
+	log.Debug("Closing the socket", "err", err)
+}
+
+// connectBackend opens a connection to the configured backend.
+func (p *proxy) connectBackend(ctx context.Context, client net.Conn) (net.Conn, error) {
+	log.Debug("Opening a socket to the backend", "destinationAddr", p.to)
+	remote, err := upstream.DialTLS(ctx, p.dialer, p.to.String(), p.tlsConfig, p.timeouts)
+	if err != nil {
+		log.Error("Error connecting the backend", "err", err, "backend", p.to, "client", client.RemoteAddr())
+		if err := reportFailure(client, p.errorStyle); err != nil {
+			log.Debug("Cannot report the failure to the client", "err", err, "client", client.RemoteAddr(), "errorStyle", p.errorStyle)
+		}
+		return nil, err
+	}
+	return remote, nil
+}
 
-	<-subctx.Done()
-	log.Debug("Closing the socket")
+// server stops the proxy gracefully.
+type server struct {
+	listener net.Listener
+	proxy    *proxy
+	// cancel aborts the connections still being opened
+	cancel context.CancelFunc
 }
 
-func (p *proxy) copy(ctx context.Context, cancel context.CancelFunc, from, to net.Conn) {
-	defer cancel()
+// Shutdown closes the listener, then waits for the active connections.
+func (s *server) Shutdown(ctx context.Context) error {
+	if err := s.listener.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	log.Info("Waiting for the active connections", "count", s.proxy.tracker.Len())
+	return s.proxy.tracker.Wait(ctx)
+}
 
-	var n int
-	var err error
-	buffer := make([]byte, 1024)
+func (s *server) Close() error {
+	s.cancel()
+	return s.proxy.tracker.Close()
+}
 
-	select {
+// Start starts the proxy. The server certificates of the backends are
+// verified by the verifier. It blocks until the proxy is shut down, and
+// returns the exit status.
+func Start(cfg *configuration.Configuration, tlsConfig *tls.Config, verifier *verify.Verifier, listenTLSConfig *tls.Config, store *identity.Store) int {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	default:
-		for {
-			n, err = from.Read(buffer)
-			if err != nil {
-				return
-			}
+	log.Debug("Binding port", "listening addr", cfg.ParsedListen)
+	l, err := listener.Listen(cfg)
+	if err != nil {
+		log.Fatal("Unable to start proxy", "err", err, "listen", cfg.ParsedListen, "backend", cfg.ParsedBackend)
+	}
 
-			_, err = to.Write(buffer[:n])
-			if err != nil {
-				return
+	filter := access.NewFilter(cfg.ParsedAllowCIDRs, cfg.ParsedDenyCIDRs)
+	var p *proxy
+	if cfg.Mode == "socks5" {
+		var authenticate func(user, password string) bool = nil
+		if authenticator := access.NewAuthenticator(cfg.ParsedBasicAuth, nil); !authenticator.IsEmpty() {
+			authenticate = authenticator.CheckBasic
+		}
+		destTLSConfig := func(host string, port uint16) *tls.Config {
+			destTLSConfig := verifier.Config(tlsConfig, host)
+			name := cfg.DestinationIdentityOf(host, port)
+			if name == "" {
+				return destTLSConfig
 			}
+			log.Debug("Using a named identity for the destination", "host", host, "port", port, "identity", name)
+			destTLSConfig.GetClientCertificate = store.Named(name)
+			return destTLSConfig
 		}
-
-	case <-ctx.Done():
-		return
+		p = newSOCKS5Proxy(cfg.ParsedListen, listenTLSConfig, filter, cfg.UpstreamDialer, cfg.Timeouts(), cfg.ParsedScope, authenticate, destTLSConfig)
+	} else {
+		p = newProxy(cfg.ParsedListen, cfg.ParsedBackend, verifier.Config(tlsConfig, cfg.ParsedBackend.Hostname), listenTLSConfig, filter, cfg.TCPPreamble, cfg.TCPErrorStyle, cfg.UpstreamDialer, cfg.Timeouts())
 	}
-}
 
-// Start starts the proxy
-func Start(cfg *configuration.Configuration, tlsConfig *tls.Config) {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	if cfg.MaxConnections > 0 {
+		p.slots = make(chan struct{}, cfg.MaxConnections)
+		p.rejectOverflow = cfg.MaxConnectionsPolicy == "reject"
+	}
+	p.maxLifetime = cfg.MaxConnLifetime
 
 	go func() {
-		if err := newProxy(cfg.ParsedListen, cfg.ParsedBackend, tlsConfig).start(ctx); err != nil {
+		if err := p.start(ctx, l); err != nil {
 			log.Fatal("Unable to start proxy", "err", err, "listen", cfg.ParsedListen, "backend", cfg.ParsedBackend)
 		}
 	}()
 
-	log.Info("MTLSProxy is ready", "mode", cfg.Mode, "listen", cfg.ParsedListen, "backend", cfg.ParsedBackend)
-
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	if cfg.Mode == "socks5" {
+		log.Info("MTLSProxy is ready", "mode", cfg.Mode, "listen", cfg.ParsedListen, "scope", cfg.Scope, "listenTLS", listenTLSConfig != nil, "maxConnections", cfg.MaxConnections)
+	} else {
+		log.Info("MTLSProxy is ready", "mode", cfg.Mode, "listen", cfg.ParsedListen, "backend", cfg.ParsedBackend, "listenTLS", listenTLSConfig != nil, "maxConnections", cfg.MaxConnections)
+	}
 
-	<-c
-	log.Debug("Leaving!")
+	return lifecycle.Run(&server{listener: l, proxy: p, cancel: cancel}, cfg.ShutdownTimeout)
 }
@@ -0,0 +1,104 @@
+// Copyright 2024 Ajabep
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcpproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/ajabep/unmtlsproxy/internal/access"
+	"github.com/ajabep/unmtlsproxy/internal/configuration"
+	"github.com/ajabep/unmtlsproxy/internal/log"
+	"github.com/ajabep/unmtlsproxy/internal/scope"
+	"github.com/ajabep/unmtlsproxy/internal/socks5"
+	"github.com/ajabep/unmtlsproxy/internal/upstream"
+)
+
+var ErrOutOfScope = errors.New("destination out of the scope")
+
+// newSOCKS5Proxy returns a proxy connecting, with TLS, to the destinations
+// requested by its SOCKS5 clients, if they are in the scope. If authenticate
+// is set, the clients have to send valid credentials. The TLS configuration
+// of each destination is given by destTLSConfig.
+func newSOCKS5Proxy(from configuration.Addr, listenTLSConfig *tls.Config, filter *access.Filter, dialer upstream.Dialer, timeouts upstream.Timeouts, scope *scope.Scope, authenticate func(user, password string) bool, destTLSConfig func(host string, port uint16) *tls.Config) *proxy {
+	p := &proxy{
+		from:            from,
+		listenTLSConfig: listenTLSConfig,
+		filter:          filter,
+		dialer:          dialer,
+		timeouts:        timeouts,
+	}
+	p.connect = func(ctx context.Context, client net.Conn) (net.Conn, error) {
+		return connectSOCKS5(ctx, client, dialer, timeouts, scope, authenticate, destTLSConfig)
+	}
+	return p
+}
+
+// replyOf returns the SOCKS5 reply matching the connection error.
+func replyOf(err error) byte {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5.ReplyConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks5.ReplyNetworkUnreachable
+	case errors.As(err, &dnsErr), errors.Is(err, syscall.EHOSTUNREACH):
+		return socks5.ReplyHostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return socks5.ReplyTTLExpired
+	default:
+		return socks5.ReplyGeneralFailure
+	}
+}
+
+// connectSOCKS5 reads the SOCKS5 request of the client, and opens a TLS
+// connection to the requested destination. The SOCKS5 handshake is bounded by
+// the handshake timeout, as the TLS ones.
+func connectSOCKS5(ctx context.Context, client net.Conn, dialer upstream.Dialer, timeouts upstream.Timeouts, scope *scope.Scope, authenticate func(user, password string) bool, destTLSConfig func(host string, port uint16) *tls.Config) (net.Conn, error) {
+	if timeouts.Handshake > 0 {
+		if err := client.SetDeadline(time.Now().Add(timeouts.Handshake)); err != nil {
+			return nil, err
+		}
+	}
+	request, err := socks5.Handshake(client, authenticate)
+	if err != nil {
+		log.Warn("Rejected an invalid SOCKS5 request", "err", err, "client", client.RemoteAddr())
+		return nil, err
+	}
+	if err := client.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+
+	if !scope.Allowed(request.Host, request.Port) {
+		log.Warn("Rejected a connection to a destination out of the scope", "client", client.RemoteAddr(), "destination", request.String())
+		_ = socks5.Reply(client, socks5.ReplyNotAllowed)
+		return nil, ErrOutOfScope
+	}
+
+	log.Debug("Opening a socket to the destination", "destination", request.String(), "user", request.User)
+	remote, err := upstream.DialTLS(ctx, dialer, request.String(), destTLSConfig(request.Host, request.Port), timeouts)
+	if err != nil {
+		log.Error("Error connecting the destination", "err", err, "destination", request.String())
+		_ = socks5.Reply(client, replyOf(err))
+		return nil, err
+	}
+	if err := socks5.Reply(client, socks5.ReplySucceeded); err != nil {
+		remote.Close()
+		return nil, err
+	}
+	return remote, nil
+}
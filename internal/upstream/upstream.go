@@ -0,0 +1,275 @@
+// Copyright 2024 Ajabep
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package upstream opens the connections to the backends, optionally through an upstream proxy
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ajabep/unmtlsproxy/internal/relay"
+	"golang.org/x/net/proxy"
+)
+
+var (
+	ErrUnsupportedScheme = errors.New("unsupported upstream proxy scheme. Use `http`, `https`, `socks5` or `socks5h`")
+	ErrMissingHost       = errors.New("the upstream proxy has no host")
+	ErrConnectRefused    = errors.New("the upstream proxy refused the tunnel")
+)
+
+// Dialer opens network connections.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Direct is the dialer of the direct connections. The dials are only bounded
+// by their context, see WithDialTimeout.
+var Direct Dialer = &net.Dialer{
+	KeepAlive: 30 * time.Second,
+}
+
+// Timeouts bounds the connections to the backends. A zero timeout is no
+// limit.
+type Timeouts struct {
+	// Dial bounds the opening of the connections, including through the
+	// upstream proxy.
+	Dial time.Duration
+	// Handshake bounds the TLS handshakes.
+	Handshake time.Duration
+	// Idle is the time after which the connections without traffic are
+	// closed.
+	Idle time.Duration
+}
+
+// withTimeout returns a context done after the timeout, if it is not zero.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// timeoutDialer bounds the dials of its dialer.
+type timeoutDialer struct {
+	dialer  Dialer
+	timeout time.Duration
+}
+
+func (d *timeoutDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	ctx, cancel := withTimeout(ctx, d.timeout)
+	defer cancel()
+	return d.dialer.DialContext(ctx, network, address)
+}
+
+// WithDialTimeout returns a dialer whose dials are bounded by the timeout. If
+// the timeout is zero, the dialer is returned.
+func WithDialTimeout(dialer Dialer, timeout time.Duration) Dialer {
+	if timeout == 0 {
+		return dialer
+	}
+	return &timeoutDialer{dialer: dialer, timeout: timeout}
+}
+
+// NewDialer returns a dialer connecting through the proxy: an HTTP(S) proxy,
+// with CONNECT tunnels, or a SOCKS5 one. The credentials of the proxy are
+// the ones of its URL. If the proxy is nil, Direct is returned.
+func NewDialer(proxyURL *url.URL) (Dialer, error) {
+	if proxyURL == nil {
+		return Direct, nil
+	}
+	if proxyURL.Hostname() == "" {
+		return nil, fmt.Errorf("%w: %s", ErrMissingHost, proxyURL.Redacted())
+	}
+
+	switch proxyURL.Scheme {
+	case "http", "https":
+		return &connectDialer{proxy: proxyURL, forward: Direct}, nil
+	case "socks5", "socks5h":
+		// The hostnames are always resolved by the SOCKS5 proxy
+		d, err := proxy.FromURL(proxyURL, socksForward{})
+		if err != nil {
+			return nil, err
+		}
+		return &socksDialer{dialer: d.(proxy.ContextDialer)}, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedScheme, proxyURL.Scheme)
+	}
+}
+
+// DialTLS opens a TLS connection with the dialer. As with tls.Dial, the
+// server name is the hostname of the address if the configuration has none.
+// The dial and the handshake are bounded by the timeouts.
+func DialTLS(ctx context.Context, dialer Dialer, address string, config *tls.Config, timeouts Timeouts) (*tls.Conn, error) {
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	conn, err := WithDialTimeout(dialer, timeouts.Dial).DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := withTimeout(ctx, timeouts.Handshake)
+	defer cancel()
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// connectDialer opens the connections with CONNECT tunnels through an HTTP
+// proxy.
+type connectDialer struct {
+	proxy   *url.URL
+	forward Dialer
+}
+
+// proxyAddress returns the address of the proxy, with the default port of its
+// scheme if it has none.
+func (d *connectDialer) proxyAddress() string {
+	if port := d.proxy.Port(); port != "" {
+		return net.JoinHostPort(d.proxy.Hostname(), port)
+	}
+	if d.proxy.Scheme == "https" {
+		return net.JoinHostPort(d.proxy.Hostname(), "443")
+	}
+	return net.JoinHostPort(d.proxy.Hostname(), "80")
+}
+
+func (d *connectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.forward.DialContext(ctx, network, d.proxyAddress())
+	if err != nil {
+		return nil, err
+	}
+	if d.proxy.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: d.proxy.Hostname()})
+	}
+
+	// The tunnel opening is aborted when the context is done, and only then:
+	// its errors are those of the context
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Unix(1, 0))
+	})
+
+	tunnel, err := d.connect(conn, address)
+	if !stop() {
+		err = errors.Join(err, ctx.Err())
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tunnel, nil
+}
+
+// connect asks the proxy to open a tunnel to the address.
+func (d *connectDialer) connect(conn net.Conn, address string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if user := d.proxy.User; user != nil {
+		password, _ := user.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s", ErrConnectRefused, resp.Status)
+	}
+
+	if reader.Buffered() == 0 {
+		return conn, nil
+	}
+	// The backend already sent bytes, read with the response
+	return &relay.BufferedConn{Conn: conn, Reader: reader}, nil
+}
+
+// proxyConnKey is the context key of the pointer where socksForward stores
+// the connection to the SOCKS5 proxy.
+type proxyConnKey struct{}
+
+// socksForward dials the SOCKS5 proxy directly, and stores the connection in
+// the pointer of the context, if any.
+type socksForward struct{}
+
+func (f socksForward) Dial(network, address string) (net.Conn, error) {
+	return f.DialContext(context.Background(), network, address)
+}
+
+func (socksForward) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := Direct.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if proxyConn, ok := ctx.Value(proxyConnKey{}).(*net.Conn); ok {
+		*proxyConn = conn
+	}
+	return conn, nil
+}
+
+// socksDialer opens the connections through a SOCKS5 proxy. The connections
+// of x/net cannot be half-closed: the tunnels are half-closed through the
+// connections to the proxy.
+type socksDialer struct {
+	dialer proxy.ContextDialer
+}
+
+func (d *socksDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var proxyConn net.Conn = nil
+	conn, err := d.dialer.DialContext(context.WithValue(ctx, proxyConnKey{}, &proxyConn), network, address)
+	if err != nil {
+		return nil, err
+	}
+	if proxyConn == nil {
+		return conn, nil
+	}
+	return &socksConn{Conn: conn, proxyConn: proxyConn}, nil
+}
+
+// socksConn is a tunnel through a SOCKS5 proxy.
+type socksConn struct {
+	net.Conn
+	proxyConn net.Conn
+}
+
+func (c *socksConn) CloseWrite() error {
+	return relay.CloseWrite(c.proxyConn)
+}
@@ -0,0 +1,137 @@
+// Copyright 2024 Ajabep
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package verify verifies the certificate of the backend
+package verify
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"sync/atomic"
+)
+
+var ErrPinMismatch = errors.New("no server public key matches the pinned ones")
+
+// Pin is the SHA-256 hash of a SubjectPublicKeyInfo.
+type Pin [sha256.Size]byte
+
+// String formats the pin as `sha256/<base64>`, like HPKP and curl.
+func (p Pin) String() string {
+	return "sha256/" + base64.StdEncoding.EncodeToString(p[:])
+}
+
+// PinOf returns the pin of the certificate's public key.
+func PinOf(cert *x509.Certificate) Pin {
+	return sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+}
+
+// Verifier verifies the server certificate against CAs which can be replaced
+// at any time, and against pinned public keys. It has to be used with
+// `InsecureSkipVerify`, since the `tls` package cannot use CAs changing over
+// time.
+type Verifier struct {
+	roots    atomic.Pointer[x509.CertPool]
+	hostname string
+	pins     []Pin
+}
+
+// NewVerifier returns a verifier trusting the given CAs. If there are no CAs,
+// the chain is not verified. The hostname overrides the server name to find
+// in the certificate. If there are pins, one of the public keys of the chain
+// has to match one of them; if the chain is not verified, only the leaf
+// public key is considered.
+func NewVerifier(roots *x509.CertPool, hostname string, pins []Pin) *Verifier {
+	v := &Verifier{
+		hostname: hostname,
+		pins:     pins,
+	}
+	v.Update(roots)
+	return v
+}
+
+// Update atomically replaces the trusted CAs.
+func (v *Verifier) Update(roots *x509.CertPool) {
+	v.roots.Store(roots)
+}
+
+// Config returns a copy of the TLS configuration, whose server certificate is
+// verified by the verifier. The server name to find in the certificate is the
+// hostname of the verifier, else the server name of the configuration, else
+// the host of the server.
+func (v *Verifier) Config(config *tls.Config, host string) *tls.Config {
+	config = config.Clone()
+	serverName := config.ServerName
+	if serverName == "" {
+		serverName = host
+	}
+	config.VerifyConnection = v.VerifyConnection(serverName)
+	return config
+}
+
+// VerifyConnection returns a function verifying the server certificate chain
+// for the server name, like the `tls` package does when `InsecureSkipVerify`
+// is not set, then the pins. It is meant to be used as
+// `tls.Config.VerifyConnection`. The server name is not the one of the
+// connection state: the `tls` package leaves the IP addresses out of it.
+func (v *Verifier) VerifyConnection(serverName string) func(tls.ConnectionState) error {
+	if v.hostname != "" {
+		serverName = v.hostname
+	}
+	return func(cs tls.ConnectionState) error {
+		return v.verify(cs, serverName)
+	}
+}
+
+func (v *Verifier) verify(cs tls.ConnectionState, serverName string) error {
+	roots := v.roots.Load()
+	if roots == nil && len(v.pins) == 0 {
+		return nil
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return &tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}
+	}
+
+	// Without a verified chain, the other certificates sent by the server
+	// prove nothing.
+	candidates := cs.PeerCertificates[:1]
+
+	if roots != nil {
+		opts := x509.VerifyOptions{
+			Roots:         roots,
+			DNSName:       serverName,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, cert := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+
+		chains, err := cs.PeerCertificates[0].Verify(opts)
+		if err != nil {
+			return &tls.CertificateVerificationError{UnverifiedCertificates: cs.PeerCertificates, Err: err}
+		}
+		candidates = slices.Concat(chains...)
+	}
+
+	if len(v.pins) == 0 {
+		return nil
+	}
+	for _, cert := range candidates {
+		if slices.Contains(v.pins, PinOf(cert)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: the server public key is %s", ErrPinMismatch, PinOf(cs.PeerCertificates[0]))
+}
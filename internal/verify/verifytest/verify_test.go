@@ -0,0 +1,138 @@
+package verifytest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ajabep/unmtlsproxy/internal/verify"
+)
+
+// generateChain returns a CA and a leaf certificate valid for `backend.example`.
+func generateChain(t *testing.T) (*x509.Certificate, *x509.Certificate) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTml := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "BlaHaj Corp. CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTml, caTml, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafTml := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "backend.example"},
+		DNSNames:     []string{"backend.example"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leafDer, err := x509.CreateCertificate(rand.Reader, leafTml, ca, &leafKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(leafDer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca, leaf
+}
+
+func TestVerifyConnection(t *testing.T) {
+	ca, leaf := generateChain(t)
+	_, otherLeaf := generateChain(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	testcases := []struct {
+		name       string
+		roots      *x509.CertPool
+		hostname   string
+		pins       []verify.Pin
+		serverName string
+		chain      []*x509.Certificate
+		success    bool
+	}{
+		{"Nothing to verify", nil, "", nil, "10.0.0.1", []*x509.Certificate{otherLeaf}, true},
+		{"Valid chain", roots, "", nil, "backend.example", []*x509.Certificate{leaf}, true},
+		{"Valid chain, wrong server name", roots, "", nil, "10.0.0.1", []*x509.Certificate{leaf}, false},
+		{"Valid chain, overridden hostname", roots, "backend.example", nil, "10.0.0.1", []*x509.Certificate{leaf}, true},
+		{"Unknown CA", roots, "", nil, "backend.example", []*x509.Certificate{otherLeaf}, false},
+		{"Pinned leaf, no CA", nil, "", []verify.Pin{verify.PinOf(leaf)}, "10.0.0.1", []*x509.Certificate{leaf}, true},
+		{"Wrong pin, no CA", nil, "", []verify.Pin{verify.PinOf(leaf)}, "10.0.0.1", []*x509.Certificate{otherLeaf}, false},
+		{"Pinned CA, unverified chain", nil, "", []verify.Pin{verify.PinOf(ca)}, "10.0.0.1", []*x509.Certificate{leaf, ca}, false},
+		{"Pinned CA, verified chain", roots, "", []verify.Pin{verify.PinOf(ca)}, "backend.example", []*x509.Certificate{leaf}, true},
+	}
+	for _, testcase := range testcases {
+		v := verify.NewVerifier(testcase.roots, testcase.hostname, testcase.pins)
+		err := v.VerifyConnection(testcase.serverName)(tls.ConnectionState{PeerCertificates: testcase.chain})
+		if testcase.success && err != nil {
+			t.Errorf("%s: unexpected error: %s", testcase.name, err)
+		}
+		if !testcase.success && err == nil {
+			t.Errorf("%s: the verification succeeded while it was not supposed to", testcase.name)
+		}
+	}
+
+	v := verify.NewVerifier(nil, "", []verify.Pin{verify.PinOf(leaf)})
+	if err := v.VerifyConnection("")(tls.ConnectionState{PeerCertificates: []*x509.Certificate{otherLeaf}}); !errors.Is(err, verify.ErrPinMismatch) {
+		t.Errorf("Expected error %q, got %v", verify.ErrPinMismatch, err)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	ca, leaf := generateChain(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}}
+
+	testcases := []struct {
+		name       string
+		hostname   string
+		serverName string
+		host       string
+		success    bool
+	}{
+		{"Host", "", "", "backend.example", true},
+		{"IP address host", "", "", "10.0.0.1", false},
+		{"Server name", "", "backend.example", "10.0.0.1", true},
+		{"Wrong server name", "", "other.example", "backend.example", false},
+		{"Overridden hostname", "backend.example", "other.example", "10.0.0.1", true},
+	}
+	for _, testcase := range testcases {
+		v := verify.NewVerifier(roots, testcase.hostname, nil)
+		config := v.Config(&tls.Config{ServerName: testcase.serverName}, testcase.host)
+		err := config.VerifyConnection(state)
+		if testcase.success && err != nil {
+			t.Errorf("%s: unexpected error: %s", testcase.name, err)
+		}
+		if !testcase.success && err == nil {
+			t.Errorf("%s: the verification succeeded while it was not supposed to", testcase.name)
+		}
+	}
+}
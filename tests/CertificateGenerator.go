@@ -14,13 +14,24 @@ import (
 )
 
 func GenerateCertificate(clientAuth bool, certOut, privOut io.Writer) ([]byte, []byte, error) {
+	return generateCertificate(clientAuth, nil, []net.IP{net.IPv4(127, 0, 0, 1)}, 120, certOut, privOut)
+}
+
+/**
+ * Generates a self-signed server certificate, valid for an hour, for the DNS names and the IP addresses.
+ */
+func GenerateServerCertificate(dnsNames []string, ipAddresses []net.IP, certOut, privOut io.Writer) ([]byte, []byte, error) {
+	return generateCertificate(false, dnsNames, ipAddresses, time.Hour, certOut, privOut)
+}
+
+func generateCertificate(clientAuth bool, dnsNames []string, ipAddresses []net.IP, validity time.Duration, certOut, privOut io.Writer) ([]byte, []byte, error) {
 	privDerBytes, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	notBefore := time.Now()
-	notAfter := notBefore.Add(120)
+	notAfter := notBefore.Add(validity)
 
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
@@ -40,7 +51,8 @@ func GenerateCertificate(clientAuth bool, certOut, privOut io.Writer) ([]byte, [
 		ExtKeyUsage:           []x509.ExtKeyUsage{},
 		BasicConstraintsValid: true,
 
-		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		DNSNames:    dnsNames,
+		IPAddresses: ipAddresses,
 	}
 
 	templateCert.KeyUsage |= x509.KeyUsageDigitalSignature
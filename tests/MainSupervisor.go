@@ -1,11 +1,13 @@
 package tests
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
+	"sync"
 	"testing"
 	"time"
 
@@ -19,6 +21,26 @@ type MainSupervisor struct {
 	testName string
 	main     MainFunc
 	cmd      *exec.Cmd
+	stopped  chan struct{}
+	logs     *syncedBuffer
+}
+
+// syncedBuffer is a buffer written by the main function, and read by the test.
+type syncedBuffer struct {
+	m sync.Mutex
+	b bytes.Buffer
+}
+
+func (s *syncedBuffer) Write(p []byte) (int, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.b.Write(p)
+}
+
+func (s *syncedBuffer) String() string {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.b.String()
 }
 
 // Will init a new supervisor to execute the main function without crashing the current program.
@@ -65,6 +87,9 @@ func (m *MainSupervisor) Run(config map[string]string) (string, bool, error) {
 
 	mainStarted := make(chan struct{}, 1)
 	mainStopped := make(chan struct{}, 2)
+	m.stopped = mainStopped
+	logs := &syncedBuffer{}
+	m.logs = logs
 
 	go func(config map[string]string, mainStarted, mainStopped chan<- struct{}) {
 		jsonArgs, err := json.Marshal(config)
@@ -75,6 +100,7 @@ func (m *MainSupervisor) Run(config map[string]string) (string, bool, error) {
 
 		m.cmd = exec.Command(os.Args[0], fmt.Sprintf("-test.run=%s", m.testName))
 		m.cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%s", m.envName, rawArgs))
+		m.cmd.Stderr = logs
 
 		close(mainStarted)
 		_ = m.cmd.Run()
@@ -91,6 +117,44 @@ func (m *MainSupervisor) Run(config map[string]string) (string, bool, error) {
 
 	return addr, mainHasReturned, nil
 }
+
+// Logs returns what the main function has logged. They are complete once it
+// has returned.
+func (m *MainSupervisor) Logs() string {
+	if m.logs == nil {
+		return ""
+	}
+	return m.logs.String()
+}
+
+// Signal sends the signal to the main function.
+func (m *MainSupervisor) Signal(sig os.Signal) error {
+	if m.cmd == nil || m.cmd.Process == nil {
+		return os.ErrProcessDone
+	}
+	return m.cmd.Process.Signal(sig)
+}
+
+// Wait waits for the main function to return, at most for the timeout. It
+// returns if the main function has returned.
+func (m *MainSupervisor) Wait(timeout time.Duration) bool {
+	select {
+	case <-m.stopped:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// ExitCode returns the exit status of the main function, once it has
+// returned.
+func (m *MainSupervisor) ExitCode() int {
+	if m.cmd == nil || m.cmd.ProcessState == nil {
+		return -1
+	}
+	return m.cmd.ProcessState.ExitCode()
+}
+
 func (m *MainSupervisor) Close() {
 	if m.cmd != nil && m.cmd.Process != nil {
 		_ = m.cmd.Process.Kill()
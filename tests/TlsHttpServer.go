@@ -0,0 +1,73 @@
+package tests
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+)
+
+type TlsHttpServer struct {
+	CertClientFilePath string
+	KeyClientFilePath  string
+
+	server *httptest.Server
+}
+
+/**
+ * Creates and starts a TLS HTTP/1.1 server, requiring a client certificate, serving the handler.
+ * It also generates a temporary client certificate and key.
+ */
+func NewStartedTlsHttpServer(handler http.Handler) (*TlsHttpServer, error) {
+	return newStartedTlsHttpServer(handler, false)
+}
+
+/**
+ * Same as NewStartedTlsHttpServer, but also supporting HTTP/2.
+ */
+func NewStartedTlsHttp2Server(handler http.Handler) (*TlsHttpServer, error) {
+	return newStartedTlsHttpServer(handler, true)
+}
+
+func newStartedTlsHttpServer(handler http.Handler, http2 bool) (*TlsHttpServer, error) {
+	srv := TlsHttpServer{}
+
+	certClientFile, err := os.CreateTemp("", "unmtlsproxy_unit_tests_cert_client_*")
+	if err != nil {
+		return nil, err
+	}
+	privClientFile, err := os.CreateTemp("", "unmtlsproxy_unit_tests_priv_client_*")
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := GenerateCertificate(true, certClientFile, privClientFile); err != nil {
+		return nil, err
+	}
+	if err := certClientFile.Close(); err != nil {
+		return nil, err
+	}
+	if err := privClientFile.Close(); err != nil {
+		return nil, err
+	}
+	srv.CertClientFilePath = certClientFile.Name()
+	srv.KeyClientFilePath = privClientFile.Name()
+
+	srv.server = httptest.NewUnstartedServer(handler)
+	srv.server.TLS = &tls.Config{
+		ClientAuth: tls.RequireAnyClientCert,
+	}
+	srv.server.EnableHTTP2 = http2
+	srv.server.StartTLS()
+	return &srv, nil
+}
+
+func (srv *TlsHttpServer) Backend() string {
+	return strings.TrimPrefix(srv.server.URL, "https://")
+}
+
+func (srv *TlsHttpServer) Close() {
+	srv.server.Close()
+	os.Remove(srv.CertClientFilePath)
+	os.Remove(srv.KeyClientFilePath)
+}
@@ -12,15 +12,20 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"io"
 	"os"
 	"time"
 
 	"github.com/ajabep/unmtlsproxy/internal/configuration"
 	"github.com/ajabep/unmtlsproxy/internal/httpproxy"
+	"github.com/ajabep/unmtlsproxy/internal/identity"
 	"github.com/ajabep/unmtlsproxy/internal/log"
+	"github.com/ajabep/unmtlsproxy/internal/reload"
 	"github.com/ajabep/unmtlsproxy/internal/tcpproxy"
+	"github.com/ajabep/unmtlsproxy/internal/verify"
 )
 
 func main() {
@@ -45,25 +50,124 @@ func main() {
 		}
 	}
 
+	store := identity.NewStore(cfg.ClientCertificates, cfg.NamedCertificates)
+	verifier := verify.NewVerifier(cfg.ServerCAPool, cfg.VerifyHostname, cfg.ParsedPins)
+
+	// Each route has its own verifier, and its own store if it has its own
+	// client certificate
+	routeStores := make([]*identity.Store, len(cfg.Routes))
+	routeVerifiers := make([]*verify.Verifier, len(cfg.Routes))
+	for i, route := range cfg.Routes {
+		if route.ClientCertificate != nil {
+			routeStores[i] = identity.NewStore([]tls.Certificate{*route.ClientCertificate}, nil)
+		}
+		pool := cfg.ServerCAPool
+		if route.ServerCAVerify {
+			pool = route.ServerCAPool
+		}
+		routeVerifiers[i] = verify.NewVerifier(pool, route.VerifyHostname, route.ParsedPins)
+	}
+
+	err = reload.Start(context.Background(), cfg.WatchedPaths(), cfg.Watch, func() {
+		certificates, named, pool, err := cfg.ReloadCertificates()
+		if err != nil {
+			log.Error("Unable to reload the certificates, keeping the previous ones", "err", err)
+			return
+		}
+		// Everything is read before anything is swapped, to not mix the
+		// previous and the new certificates
+		routeCertificates := make([]*tls.Certificate, len(cfg.Routes))
+		routePools := make([]*x509.CertPool, len(cfg.Routes))
+		for i := range cfg.Routes {
+			routeCertificates[i], routePools[i], err = cfg.Routes[i].ReloadCertificates()
+			if err != nil {
+				log.Error("Unable to reload the certificates of a route, keeping the previous ones", "route", cfg.Routes[i].String(), "err", err)
+				return
+			}
+			if !cfg.Routes[i].ServerCAVerify {
+				routePools[i] = pool
+			}
+		}
+
+		for i := range cfg.Routes {
+			if routeStores[i] != nil {
+				routeStores[i].Update([]tls.Certificate{*routeCertificates[i]}, nil)
+			}
+			routeVerifiers[i].Update(routePools[i])
+		}
+		store.Update(certificates, named)
+		verifier.Update(pool)
+		log.Info("Reloaded the certificates", "count", len(certificates))
+	})
+	if err != nil {
+		log.Fatal("Unable to watch the certificates", "err", err)
+	}
+
 	tlsConfig := &tls.Config{
 		// Server
-		RootCAs:            cfg.ServerCAPool,
-		InsecureSkipVerify: !cfg.ServerCAVerify,
+		// The verification is done by the verifiers, for each backend, to be able to reload the CAs and to pin keys
+		ServerName:         cfg.SNI,
+		InsecureSkipVerify: true,
 
 		// Client
-		Certificates:           cfg.ClientCertificates,
+		GetClientCertificate:   store.GetClientCertificate,
 		ClientSessionCache:     cliSessionCache,
 		SessionTicketsDisabled: cliSessionCache != nil,
 
 		// Exchange
-		KeyLogWriter:  w,
-		Renegotiation: tls.RenegotiateFreelyAsClient,
+		MinVersion:       cfg.ParsedTLSMinVersion,
+		MaxVersion:       cfg.ParsedTLSMaxVersion,
+		CipherSuites:     cfg.ParsedCipherSuites,
+		CurvePreferences: cfg.ParsedCurves,
+		NextProtos:       cfg.ALPN,
+		KeyLogWriter:     w,
+		Renegotiation:    cfg.ParsedRenegotiation,
+	}
+
+	routeTLSConfigs := make([]*tls.Config, len(cfg.Routes))
+	for i, route := range cfg.Routes {
+		routeTLSConfig := tlsConfig.Clone()
+		// Defaults to the hostname of the route backend
+		routeTLSConfig.ServerName = route.SNI
+		switch {
+		case routeStores[i] != nil:
+			routeTLSConfig.GetClientCertificate = routeStores[i].GetClientCertificate
+		case route.Identity != "":
+			routeTLSConfig.GetClientCertificate = store.Named(route.Identity)
+		}
+		if route.ParsedTLSMinVersion != 0 {
+			routeTLSConfig.MinVersion = route.ParsedTLSMinVersion
+		}
+		if route.ParsedTLSMaxVersion != 0 {
+			routeTLSConfig.MaxVersion = route.ParsedTLSMaxVersion
+		}
+		routeTLSConfigs[i] = routeVerifiers[i].Config(routeTLSConfig, route.ParsedBackend.Hostname)
+	}
+
+	var listenTLSConfig *tls.Config = nil
+	switch {
+	case cfg.ListenCertificate != nil:
+		listenTLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{*cfg.ListenCertificate},
+		}
+	case cfg.ListenAutoTLS:
+		listenTLSConfig = &tls.Config{
+			GetCertificate: cfg.ListenAuthority.GetCertificate,
+		}
+	}
+	if cfg.ListenAuthority != nil && cfg.ListenCAExportPath != "" {
+		if err := os.WriteFile(cfg.ListenCAExportPath, cfg.ListenAuthority.CertificatePEM(), 0o644); err != nil {
+			log.Fatal("Unable to export the listening CA", "err", err)
+		}
+		log.Info("Exported the listening CA", "path", cfg.ListenCAExportPath, "subject", cfg.ListenAuthority.Certificate().Subject.String())
 	}
 
+	status := 0
 	switch cfg.Mode {
-	case "http":
-		httpproxy.Start(cfg, tlsConfig)
-	case "tcp":
-		tcpproxy.Start(cfg, tlsConfig)
+	case "http", "forward":
+		status = httpproxy.Start(cfg, tlsConfig, verifier, routeTLSConfigs, listenTLSConfig, store)
+	case "tcp", "socks5":
+		status = tcpproxy.Start(cfg, tlsConfig, verifier, listenTLSConfig, store)
 	}
+	os.Exit(status)
 }
@@ -3,20 +3,31 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/ajabep/unmtlsproxy/internal/configuration/configurationtest"
+	"github.com/ajabep/unmtlsproxy/internal/har"
 	"github.com/ajabep/unmtlsproxy/tests"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/proxy"
 )
 
 type HttpStatus int
@@ -44,6 +55,8 @@ type TestCaseMainType struct {
 		bodyValue      string
 		bodyConstraint Constraint
 	}
+	// logged, if set, has to be in the logs of the main function
+	logged string
 }
 type TestCaseHttpDisableSocketReusingType struct {
 	name    string
@@ -452,10 +465,11 @@ func TestMainTcp(t *testing.T) {
 		{
 			name: "Non existing backend",
 			config: map[string]string{
-				"backend":  "0.0.0.0:443",
-				"cert":     filepath.Join(exampleDir, testCertClientCertPem),
-				"cert-key": filepath.Join(exampleDir, testCertClientKeyNoEncryptionPem),
-				"mode":     "tcp",
+				"backend":         "0.0.0.0:443",
+				"cert":            filepath.Join(exampleDir, testCertClientCertPem),
+				"cert-key":        filepath.Join(exampleDir, testCertClientKeyNoEncryptionPem),
+				"mode":            "tcp",
+				"tcp-error-style": "http",
 			},
 			expected: struct {
 				status         HttpStatus
@@ -463,18 +477,19 @@ func TestMainTcp(t *testing.T) {
 				bodyConstraint Constraint
 			}{
 				NoRequestSent,
-				"dial tcp 0.0.0.0:443: connect",
+				"HTTP/1.1 502 Bad Gateway",
 				Contains,
 			},
 		},
 		{
 			name: "Wrong CA for validating the Server",
 			config: map[string]string{
-				"backend":   fmt.Sprintf("%s:443", testCertHostname),
-				"cert":      filepath.Join(exampleDir, testCertClientCertPem),
-				"cert-key":  filepath.Join(exampleDir, testCertClientKeyNoEncryptionPem),
-				"mode":      "tcp",
-				"server-ca": filepath.Join(exampleDir, testCertClientCertPem),
+				"backend":         fmt.Sprintf("%s:443", testCertHostname),
+				"cert":            filepath.Join(exampleDir, testCertClientCertPem),
+				"cert-key":        filepath.Join(exampleDir, testCertClientKeyNoEncryptionPem),
+				"mode":            "tcp",
+				"server-ca":       filepath.Join(exampleDir, testCertClientCertPem),
+				"tcp-error-style": "http",
 			},
 			expected: struct {
 				status         HttpStatus
@@ -482,9 +497,10 @@ func TestMainTcp(t *testing.T) {
 				bodyConstraint Constraint
 			}{
 				NoRequestSent,
-				"tls: failed to verify certificate: x509: certificate signed by unknown authority",
-				Is,
+				"HTTP/1.1 502 Bad Gateway",
+				Contains,
 			},
+			logged: "tls: failed to verify certificate: x509: certificate signed by unknown authority",
 		},
 		{
 			name: "Wrong listen definition: Null port",
@@ -718,6 +734,15 @@ func TestMainTcp(t *testing.T) {
 			if !testFunc(body, testValue) {
 				t.Errorf("The body does not pass via the condition! Condition = `%d`; Condition Value = `%s`; Body = `%s`", testcase.expected.bodyConstraint, testcase.expected.bodyValue, body)
 			}
+
+			if testcase.logged != "" {
+				// The logs are complete once the main function has returned
+				mainSupervisor.Close()
+				mainSupervisor.Wait(time.Second)
+				if logs := mainSupervisor.Logs(); !strings.Contains(logs, testcase.logged) {
+					t.Errorf("The logs do not contain `%s`: %s", testcase.logged, logs)
+				}
+			}
 		}
 		testingFnc(testcase)
 	}
@@ -910,3 +935,2115 @@ func TestTcpIsSocketReusingDisabled(t *testing.T) {
 		}
 	}
 }
+
+func TestHttpUpgrade(t *testing.T) {
+	mainSupervisor := tests.NewMainSupervisor(t, main)
+	defer mainSupervisor.Close()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Upgrade") != "echo" {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		_ = brw.Flush()
+		for {
+			line, err := brw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			_, _ = brw.WriteString("echo: " + line)
+			_ = brw.Flush()
+		}
+	})
+	srv, err := tests.NewStartedTlsHttpServer(handler)
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	defer srv.Close()
+	// The switches only exist in HTTP/1.1, even when the backend supports
+	// HTTP/2
+	h2Srv, err := tests.NewStartedTlsHttp2Server(handler)
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	defer h2Srv.Close()
+
+	for _, testcase := range []struct {
+		name   string
+		srv    *tests.TlsHttpServer
+		config map[string]string
+	}{
+		{name: "HTTP/1.1 backend", srv: srv, config: map[string]string{}},
+		{name: "HTTP/2 backend", srv: h2Srv, config: map[string]string{}},
+		// The capture does not take over the switched stream
+		{name: "HAR capture", srv: srv, config: map[string]string{"har-out": filepath.Join(t.TempDir(), "capture.har")}},
+	} {
+		t.Logf("Running Test `%s`", testcase.name)
+
+		testcase.config["backend"] = testcase.srv.Backend()
+		testcase.config["cert"] = testcase.srv.CertClientFilePath
+		testcase.config["cert-key"] = testcase.srv.KeyClientFilePath
+		testcase.config["mode"] = "http"
+		addr, hasReturned, err := mainSupervisor.Run(testcase.config)
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		if hasReturned {
+			t.Fatalf("The main function has returned and should not returned.")
+		}
+
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: " + addr + "\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Errorf("The protocol has not been switched: %s", resp.Status)
+			conn.Close()
+			continue
+		}
+
+		for _, msg := range []string{"ping\n", "pong\n"} {
+			if _, err := conn.Write([]byte(msg)); err != nil {
+				t.Fatalf(unexpectedError, err)
+			}
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf(unexpectedError, err)
+			}
+			if line != "echo: "+msg {
+				t.Errorf("Unexpected message through the switched connection: %q", line)
+			}
+		}
+		conn.Close()
+	}
+}
+
+func TestHttpStreaming(t *testing.T) {
+	mainSupervisor := tests.NewMainSupervisor(t, main)
+	defer mainSupervisor.Close()
+
+	release := make(chan struct{})
+	backendCanceled := make(chan struct{})
+	srv, err := tests.NewStartedTlsHttpServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/events":
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = io.WriteString(w, "data: first\n\n")
+			http.NewResponseController(w).Flush()
+			<-release
+			_, _ = io.WriteString(w, "data: second\n\n")
+		case "/trailers":
+			w.Header().Set("Trailer", "X-Checksum")
+			_, _ = io.WriteString(w, "body")
+			w.Header().Set("X-Checksum", "blahaj")
+		case "/endless":
+			_, _ = io.WriteString(w, "chunk")
+			http.NewResponseController(w).Flush()
+			<-req.Context().Done()
+			close(backendCanceled)
+		}
+	}))
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	defer srv.Close()
+
+	addr, hasReturned, err := mainSupervisor.Run(map[string]string{
+		"backend":  srv.Backend(),
+		"cert":     srv.CertClientFilePath,
+		"cert-key": srv.KeyClientFilePath,
+		"mode":     "http",
+	})
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	if hasReturned {
+		t.Fatalf("The main function has returned and should not returned.")
+	}
+
+	t.Log("Running Test `Server-Sent Events are flushed`")
+	resp, err := http.Get(fmt.Sprintf("http://%s/events", addr))
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	if err != nil || line != "data: first\n" {
+		t.Errorf("The first event has not been received before the end of the stream: %q, %v", line, err)
+	}
+	close(release)
+	rest, err := io.ReadAll(reader)
+	if err != nil || string(rest) != "\ndata: second\n\n" {
+		t.Errorf("Unexpected end of the stream: %q, %v", rest, err)
+	}
+	resp.Body.Close()
+
+	t.Log("Running Test `Trailers are forwarded`")
+	resp, err = http.Get(fmt.Sprintf("http://%s/trailers", addr))
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != "body" {
+		t.Errorf("Unexpected body: %q, %v", body, err)
+	}
+	if checksum := resp.Trailer.Get("X-Checksum"); checksum != "blahaj" {
+		t.Errorf("The trailer has not been forwarded: %q", checksum)
+	}
+
+	t.Log("Running Test `The backend request is canceled when the client leaves`")
+	resp, err = http.Get(fmt.Sprintf("http://%s/endless", addr))
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	if _, err := resp.Body.Read(make([]byte, 5)); err != nil {
+		t.Errorf(unexpectedError, err)
+	}
+	resp.Body.Close()
+	select {
+	case <-backendCanceled:
+	case <-time.After(5 * time.Second):
+		t.Errorf("The backend request has not been canceled after the client left")
+	}
+}
+
+func TestHttpHeaders(t *testing.T) {
+	mainSupervisor := tests.NewMainSupervisor(t, main)
+	defer mainSupervisor.Close()
+
+	srv, err := tests.NewStartedTlsHttpServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "1")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("X-End-To-End", "1")
+		_ = req.Header.Write(w)
+	}))
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	defer srv.Close()
+
+	for _, testcase := range []struct {
+		name      string
+		config    map[string]string
+		forwarded bool
+	}{
+		{
+			name: "Forwarded headers",
+			config: map[string]string{
+				"backend":  srv.Backend(),
+				"cert":     srv.CertClientFilePath,
+				"cert-key": srv.KeyClientFilePath,
+				"mode":     "http",
+			},
+			forwarded: true,
+		},
+		{
+			name: "No forwarded headers",
+			config: map[string]string{
+				"backend":              srv.Backend(),
+				"cert":                 srv.CertClientFilePath,
+				"cert-key":             srv.KeyClientFilePath,
+				"mode":                 "http",
+				"no-forwarded-headers": "true",
+			},
+			forwarded: false,
+		},
+	} {
+		t.Logf("Running Test `%s`", testcase.name)
+
+		addr, hasReturned, err := mainSupervisor.Run(testcase.config)
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		if hasReturned {
+			t.Fatalf("The main function has returned and should not returned.")
+		}
+
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/", addr), nil)
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		req.Header.Set("Connection", "X-Secret")
+		req.Header.Set("X-Secret", "1")
+		req.Header.Set("Keep-Alive", "timeout=5")
+		req.Header.Set("Proxy-Authorization", "Basic YmxhaGFqOmh1Z3M=")
+		req.Header.Set("X-End-To-End", "1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		defer resp.Body.Close()
+
+		received, err := textproto.NewReader(bufio.NewReader(io.MultiReader(resp.Body, strings.NewReader("\r\n")))).ReadMIMEHeader()
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		for _, name := range []string{"Connection", "X-Secret", "Keep-Alive", "Proxy-Authorization"} {
+			if received.Get(name) != "" {
+				t.Errorf("The hop-by-hop request header %s has been forwarded", name)
+			}
+		}
+		if received.Get("X-End-To-End") != "1" {
+			t.Errorf("The end-to-end request header has not been forwarded")
+		}
+		for _, name := range []string{"X-Hop", "Keep-Alive"} {
+			if resp.Header.Get(name) != "" {
+				t.Errorf("The hop-by-hop response header %s has been forwarded", name)
+			}
+		}
+		if resp.Header.Get("X-End-To-End") != "1" {
+			t.Errorf("The end-to-end response header has not been forwarded")
+		}
+
+		expected := map[string]string{
+			"X-Forwarded-For":   "127.0.0.1",
+			"X-Forwarded-Host":  addr,
+			"X-Forwarded-Proto": "http",
+			"Forwarded":         fmt.Sprintf(`for=127.0.0.1;host="%s";proto=http`, addr),
+		}
+		for name, value := range expected {
+			if !testcase.forwarded {
+				value = ""
+			}
+			if received.Get(name) != value {
+				t.Errorf("Unexpected %s header: expected %q, got %q", name, value, received.Get(name))
+			}
+		}
+	}
+}
+
+func TestHttpRewrite(t *testing.T) {
+	mainSupervisor := tests.NewMainSupervisor(t, main)
+	defer mainSupervisor.Close()
+
+	var backendOrigin string
+	srv, err := tests.NewStartedTlsHttpServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/redirect":
+			w.Header().Set("Refresh", "5; url="+backendOrigin+"/refreshed")
+			w.Header().Add("Set-Cookie", "session=blahaj; Domain=127.0.0.1; Path=/; Secure; HttpOnly; SameSite=None")
+			w.Header().Add("Set-Cookie", "other=shark; Domain=example.com")
+			http.Redirect(w, req, backendOrigin+"/next?q=1", http.StatusFound)
+		case "/html":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = io.WriteString(w, `<a href="`+backendOrigin+`/page">page</a><a href="https://example.com/">other</a>`)
+		case "/json":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = io.WriteString(w, `{"next":"`+strings.ReplaceAll(backendOrigin, "/", `\/`)+`\/page"}`)
+		case "/longer":
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = io.WriteString(w, backendOrigin+"0/ "+backendOrigin+".evil/ "+backendOrigin+"?q=1")
+		case "/large":
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = io.WriteString(w, backendOrigin+strings.Repeat(" ", 100))
+		}
+	}))
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	defer srv.Close()
+	backendOrigin = "https://" + srv.Backend()
+
+	addr, hasReturned, err := mainSupervisor.Run(map[string]string{
+		"backend":               srv.Backend(),
+		"cert":                  srv.CertClientFilePath,
+		"cert-key":              srv.KeyClientFilePath,
+		"mode":                  "http",
+		"rewrite-urls":          "true",
+		"rewrite-bodies":        "true",
+		"rewrite-body-max-size": "100",
+	})
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	if hasReturned {
+		t.Fatalf("The main function has returned and should not returned.")
+	}
+	proxyOrigin := "http://" + addr
+
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	t.Log("Running Test `Headers`")
+	resp, err := client.Get(proxyOrigin + "/redirect")
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	resp.Body.Close()
+	if location := resp.Header.Get("Location"); location != proxyOrigin+"/next?q=1" {
+		t.Errorf("Unexpected Location: %q", location)
+	}
+	if refresh := resp.Header.Get("Refresh"); refresh != "5; url="+proxyOrigin+"/refreshed" {
+		t.Errorf("Unexpected Refresh: %q", refresh)
+	}
+	cookies := resp.Header.Values("Set-Cookie")
+	if len(cookies) != 2 || cookies[0] != "session=blahaj; Path=/; HttpOnly" || cookies[1] != "other=shark; Domain=example.com" {
+		t.Errorf("Unexpected cookies: %q", cookies)
+	}
+
+	for _, testcase := range []struct {
+		path     string
+		expected string
+	}{
+		{"/html", `<a href="` + proxyOrigin + `/page">page</a><a href="https://example.com/">other</a>`},
+		{"/json", `{"next":"` + strings.ReplaceAll(proxyOrigin, "/", `\/`) + `\/page"}`},
+		// The hosts starting with the backend one are other hosts
+		{"/longer", backendOrigin + "0/ " + backendOrigin + ".evil/ " + proxyOrigin + "?q=1"},
+		{"/large", backendOrigin + strings.Repeat(" ", 100)},
+	} {
+		t.Logf("Running Test `Body %s`", testcase.path)
+		resp, err := client.Get(proxyOrigin + testcase.path)
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		if string(body) != testcase.expected {
+			t.Errorf("Unexpected body: %q", body)
+		}
+	}
+
+	t.Log("Running Test `Stripped prefix`")
+	routesPath := filepath.Join(t.TempDir(), "routes.yaml")
+	routes := fmt.Sprintf(`
+routes:
+  - path: /app/
+    strip-prefix: true
+    backend: %s
+    cert: %s
+    cert-key: %s
+`, srv.Backend(), srv.CertClientFilePath, srv.KeyClientFilePath)
+	if err := os.WriteFile(routesPath, []byte(routes), 0600); err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	addr, hasReturned, err = mainSupervisor.Run(map[string]string{
+		"backend":        srv.Backend(),
+		"cert":           srv.CertClientFilePath,
+		"cert-key":       srv.KeyClientFilePath,
+		"mode":           "http",
+		"routes":         routesPath,
+		"rewrite-urls":   "true",
+		"rewrite-bodies": "true",
+	})
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	if hasReturned {
+		t.Fatalf("The main function has returned and should not returned.")
+	}
+	proxyOrigin = "http://" + addr
+
+	// The URLs keep the prefix the client used
+	resp, err = client.Get(proxyOrigin + "/app/redirect")
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	resp.Body.Close()
+	if location := resp.Header.Get("Location"); location != proxyOrigin+"/app/next?q=1" {
+		t.Errorf("Unexpected Location: %q", location)
+	}
+	if refresh := resp.Header.Get("Refresh"); refresh != "5; url="+proxyOrigin+"/app/refreshed" {
+		t.Errorf("Unexpected Refresh: %q", refresh)
+	}
+	resp, err = client.Get(proxyOrigin + "/app/html")
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	if expected := `<a href="` + proxyOrigin + `/app/page">page</a><a href="https://example.com/">other</a>`; string(body) != expected {
+		t.Errorf("Unexpected body: %q", body)
+	}
+}
+
+func TestHttp2(t *testing.T) {
+	mainSupervisor := tests.NewMainSupervisor(t, main)
+	defer mainSupervisor.Close()
+
+	srv, err := tests.NewStartedTlsHttp2Server(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = io.WriteString(w, req.Proto)
+	}))
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	defer srv.Close()
+
+	h2cClient := &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			},
+		},
+	}
+
+	for _, testcase := range []struct {
+		name         string
+		config       map[string]string
+		client       *http.Client
+		clientProto  string
+		backendProto string
+	}{
+		{
+			name: "HTTP/1.1 client, HTTP/2 backend",
+			config: map[string]string{
+				"backend":  srv.Backend(),
+				"cert":     srv.CertClientFilePath,
+				"cert-key": srv.KeyClientFilePath,
+				"mode":     "http",
+			},
+			client:       http.DefaultClient,
+			clientProto:  "HTTP/1.1",
+			backendProto: "HTTP/2.0",
+		},
+		{
+			name: "h2c client, HTTP/2 backend",
+			config: map[string]string{
+				"backend":  srv.Backend(),
+				"cert":     srv.CertClientFilePath,
+				"cert-key": srv.KeyClientFilePath,
+				"mode":     "http",
+				"h2c":      "true",
+			},
+			client:       h2cClient,
+			clientProto:  "HTTP/2.0",
+			backendProto: "HTTP/2.0",
+		},
+		{
+			name: "h2c client, HTTP/1.1 forced on the backend",
+			config: map[string]string{
+				"backend":  srv.Backend(),
+				"cert":     srv.CertClientFilePath,
+				"cert-key": srv.KeyClientFilePath,
+				"mode":     "http",
+				"h2c":      "true",
+				"alpn":     "http/1.1",
+			},
+			client:       h2cClient,
+			clientProto:  "HTTP/2.0",
+			backendProto: "HTTP/1.1",
+		},
+	} {
+		t.Logf("Running Test `%s`", testcase.name)
+
+		addr, hasReturned, err := mainSupervisor.Run(testcase.config)
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		if hasReturned {
+			t.Fatalf("The main function has returned and should not returned.")
+		}
+
+		resp, err := testcase.client.Get(fmt.Sprintf("http://%s/", addr))
+		if err != nil {
+			t.Errorf(unexpectedError, err)
+			continue
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf(unexpectedError, err)
+			continue
+		}
+		if resp.Proto != testcase.clientProto {
+			t.Errorf("Unexpected protocol between the client and the proxy: %s", resp.Proto)
+		}
+		if string(body) != testcase.backendProto {
+			t.Errorf("Unexpected protocol between the proxy and the backend: %s", body)
+		}
+	}
+}
+
+func TestHttpRoutes(t *testing.T) {
+	mainSupervisor := tests.NewMainSupervisor(t, main)
+	defer mainSupervisor.Close()
+
+	// Each backend tells which client certificate it received
+	newBackend := func(name string) *tests.TlsHttpServer {
+		var expected []byte
+		srv, err := tests.NewStartedTlsHttpServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			identity := "unexpected identity"
+			if bytes.Equal(req.TLS.PeerCertificates[0].Raw, expected) {
+				identity = "own identity"
+			}
+			_, _ = fmt.Fprintf(w, "%s %s %s %s", name, req.URL.Path, identity, req.Header.Get("X-Forwarded-Prefix"))
+		}))
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		cert, err := tls.LoadX509KeyPair(srv.CertClientFilePath, srv.KeyClientFilePath)
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		expected = cert.Certificate[0]
+		return srv
+	}
+	mainSrv, apiSrv, adminSrv := newBackend("main"), newBackend("api"), newBackend("admin")
+	defer mainSrv.Close()
+	defer apiSrv.Close()
+	defer adminSrv.Close()
+
+	routesFile, err := os.CreateTemp("", "unmtlsproxy_unit_tests_routes_*.yaml")
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	defer os.Remove(routesFile.Name())
+	_, err = fmt.Fprintf(routesFile, `
+routes:
+  - path: /api/
+    strip-prefix: true
+    backend: %s
+    cert: %s
+    cert-key: %s
+  - host: admin.localhost
+    backend: %s
+    cert: %s
+    cert-key: %s
+`, apiSrv.Backend(), apiSrv.CertClientFilePath, apiSrv.KeyClientFilePath, adminSrv.Backend(), adminSrv.CertClientFilePath, adminSrv.KeyClientFilePath)
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	if err := routesFile.Close(); err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+
+	addr, hasReturned, err := mainSupervisor.Run(map[string]string{
+		"backend":  mainSrv.Backend(),
+		"cert":     mainSrv.CertClientFilePath,
+		"cert-key": mainSrv.KeyClientFilePath,
+		"mode":     "http",
+		"routes":   routesFile.Name(),
+	})
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	if hasReturned {
+		t.Fatalf("The main function has returned and should not returned.")
+	}
+
+	for _, testcase := range []struct {
+		host     string
+		path     string
+		expected string
+	}{
+		{"", "/", "main / own identity "},
+		{"", "/apis", "main /apis own identity "},
+		{"", "/api", "api / own identity /api"},
+		{"", "/api/users/1", "api /users/1 own identity /api"},
+		{"admin.localhost", "/api/users/1", "api /users/1 own identity /api"},
+		{"admin.localhost:8080", "/users/1", "admin /users/1 own identity "},
+		{"ADMIN.localhost", "/", "admin / own identity "},
+		{"other.localhost", "/users/1", "main /users/1 own identity "},
+	} {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s%s", addr, testcase.path), nil)
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		if testcase.host != "" {
+			req.Host = testcase.host
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf(unexpectedError, err)
+			continue
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf(unexpectedError, err)
+			continue
+		}
+		if string(body) != testcase.expected {
+			t.Errorf("%s%s: expected %q, got %q", testcase.host, testcase.path, testcase.expected, body)
+		}
+	}
+}
+
+func TestHttpRoutesReload(t *testing.T) {
+	mainSupervisor := tests.NewMainSupervisor(t, main)
+	defer mainSupervisor.Close()
+
+	// The backend tells if it received the client certificate of the api
+	// route
+	var expected []byte
+	srv, err := tests.NewStartedTlsHttpServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if bytes.Equal(req.TLS.PeerCertificates[0].Raw, expected) {
+			_, _ = io.WriteString(w, "own identity")
+		} else {
+			_, _ = io.WriteString(w, "unexpected identity")
+		}
+	}))
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	defer srv.Close()
+	otherSrv, err := tests.NewStartedTlsHttpServer(http.NotFoundHandler())
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	defer otherSrv.Close()
+
+	// The routes have their own copy of the client certificate, to be
+	// changed
+	dir := t.TempDir()
+	copyFile := func(src, dst string) {
+		data, err := os.ReadFile(src)
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		if err := os.WriteFile(dst, data, 0600); err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+	}
+	paths := map[string][2]string{}
+	for _, name := range []string{"api", "admin"} {
+		paths[name] = [2]string{filepath.Join(dir, name+".crt.pem"), filepath.Join(dir, name+".key.pem")}
+		copyFile(srv.CertClientFilePath, paths[name][0])
+		copyFile(srv.KeyClientFilePath, paths[name][1])
+	}
+	cert, err := tls.LoadX509KeyPair(srv.CertClientFilePath, srv.KeyClientFilePath)
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	expected = cert.Certificate[0]
+
+	routesPath := filepath.Join(dir, "routes.yaml")
+	routes := fmt.Sprintf(`
+routes:
+  - path: /api/
+    backend: %s
+    cert: %s
+    cert-key: %s
+  - path: /admin/
+    backend: %s
+    cert: %s
+    cert-key: %s
+`, srv.Backend(), paths["api"][0], paths["api"][1], srv.Backend(), paths["admin"][0], paths["admin"][1])
+	if err := os.WriteFile(routesPath, []byte(routes), 0600); err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+
+	addr, hasReturned, err := mainSupervisor.Run(map[string]string{
+		"backend":  srv.Backend(),
+		"cert":     srv.CertClientFilePath,
+		"cert-key": srv.KeyClientFilePath,
+		"mode":     "http",
+		"routes":   routesPath,
+		// Each request opens a connection with the current certificate
+		"disable-socket-reusing": "true",
+	})
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	if hasReturned {
+		t.Fatalf("The main function has returned and should not returned.")
+	}
+
+	get := func(path string) string {
+		resp, err := http.Get(fmt.Sprintf("http://%s%s", addr, path))
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		return string(body)
+	}
+	if body := get("/api/"); body != "own identity" {
+		t.Fatalf("Unexpected response before the reload: %q", body)
+	}
+
+	// The api route gets a new certificate, but the one of the admin route
+	// is broken: nothing is reloaded
+	copyFile(otherSrv.CertClientFilePath, paths["api"][0])
+	copyFile(otherSrv.KeyClientFilePath, paths["api"][1])
+	if err := os.WriteFile(paths["admin"][0], nil, 0600); err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	if err := mainSupervisor.Signal(syscall.SIGHUP); err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	for _, path := range []string{"/api/", "/admin/"} {
+		if body := get(path); body != "own identity" {
+			t.Errorf("%s: the certificates have been partially reloaded: %q", path, body)
+		}
+	}
+}
+
+func TestForwardProxy(t *testing.T) {
+	mainSupervisor := tests.NewMainSupervisor(t, main)
+	defer mainSupervisor.Close()
+
+	srv, err := tests.NewStartedTlsHttpServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = fmt.Fprintf(w, "%s %d", req.URL.Path, len(req.TLS.PeerCertificates))
+	}))
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	defer srv.Close()
+	clientCert, err := tls.LoadX509KeyPair(srv.CertClientFilePath, srv.KeyClientFilePath)
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	_, backendPort, err := net.SplitHostPort(srv.Backend())
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+
+	caFile, err := os.CreateTemp("", "unmtlsproxy_unit_tests_forward_ca_*")
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	caFile.Close()
+	defer os.Remove(caFile.Name())
+
+	for _, testcase := range []struct {
+		name   string
+		config map[string]string
+		// url is requested through the proxy, with the proxy user
+		url       string
+		proxyUser *url.Userinfo
+		// newTLSConfig returns the TLS configuration used by the client of
+		// the proxy for HTTPS URLs
+		newTLSConfig func() *tls.Config
+		status       int
+		body         string
+	}{
+		{
+			name: "Absolute-form request",
+			config: map[string]string{
+				"cert":     srv.CertClientFilePath,
+				"cert-key": srv.KeyClientFilePath,
+				"mode":     "forward",
+				"scope":    "127.0.0.1",
+			},
+			url:    "http://127.0.0.1:" + backendPort + "/absolute",
+			status: http.StatusOK,
+			body:   "/absolute 1",
+		},
+		{
+			name: "Out of the scope",
+			config: map[string]string{
+				"cert":     srv.CertClientFilePath,
+				"cert-key": srv.KeyClientFilePath,
+				"mode":     "forward",
+				"scope":    "127.0.0.1:1",
+			},
+			url:    "http://127.0.0.1:" + backendPort + "/absolute",
+			status: http.StatusForbidden,
+		},
+		{
+			name: "Missing proxy credentials",
+			config: map[string]string{
+				"cert":       srv.CertClientFilePath,
+				"cert-key":   srv.KeyClientFilePath,
+				"mode":       "forward",
+				"scope":      "*",
+				"auth-basic": "blahaj:hugs",
+			},
+			url:    "http://127.0.0.1:" + backendPort + "/absolute",
+			status: http.StatusProxyAuthRequired,
+		},
+		{
+			name: "Proxy credentials",
+			config: map[string]string{
+				"cert":       srv.CertClientFilePath,
+				"cert-key":   srv.KeyClientFilePath,
+				"mode":       "forward",
+				"scope":      "*",
+				"auth-basic": "blahaj:hugs",
+			},
+			url:       "http://127.0.0.1:" + backendPort + "/absolute",
+			proxyUser: url.UserPassword("blahaj", "hugs"),
+			status:    http.StatusOK,
+			body:      "/absolute 1",
+		},
+		{
+			name: "Intercepted tunnel",
+			config: map[string]string{
+				"cert":              srv.CertClientFilePath,
+				"cert-key":          srv.KeyClientFilePath,
+				"mode":              "forward",
+				"scope":             "127.0.0.1",
+				"forward-intercept": "true",
+				"listen-ca-export":  caFile.Name(),
+			},
+			url: "https://127.0.0.1:" + backendPort + "/intercepted",
+			newTLSConfig: func() *tls.Config {
+				ca, err := os.ReadFile(caFile.Name())
+				if err != nil {
+					t.Fatalf(unexpectedError, err)
+				}
+				pool := x509.NewCertPool()
+				pool.AppendCertsFromPEM(ca)
+				return &tls.Config{RootCAs: pool}
+			},
+			status: http.StatusOK,
+			body:   "/intercepted 1",
+		},
+		{
+			name: "Passed through tunnel",
+			config: map[string]string{
+				"cert":     srv.CertClientFilePath,
+				"cert-key": srv.KeyClientFilePath,
+				"mode":     "forward",
+				"scope":    "127.0.0.1",
+			},
+			url: "https://127.0.0.1:" + backendPort + "/passed",
+			newTLSConfig: func() *tls.Config {
+				// The client of the proxy talks to the backend itself
+				return &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{clientCert}}
+			},
+			status: http.StatusOK,
+			body:   "/passed 1",
+		},
+	} {
+		t.Logf("Running Test `%s`", testcase.name)
+
+		addr, hasReturned, err := mainSupervisor.Run(testcase.config)
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		if hasReturned {
+			t.Fatalf("The main function has returned and should not returned.")
+		}
+
+		transport := &http.Transport{
+			Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: addr, User: testcase.proxyUser}),
+		}
+		if testcase.newTLSConfig != nil {
+			transport.TLSClientConfig = testcase.newTLSConfig()
+		}
+		client := &http.Client{Transport: transport}
+
+		resp, err := client.Get(testcase.url)
+		if err != nil {
+			t.Errorf(unexpectedError, err)
+			continue
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf(unexpectedError, err)
+			continue
+		}
+		if resp.StatusCode != testcase.status {
+			t.Errorf("Unexpected status: %d", resp.StatusCode)
+		} else if testcase.status == http.StatusOK && string(body) != testcase.body {
+			t.Errorf("Unexpected body: %q", body)
+		}
+		transport.CloseIdleConnections()
+	}
+}
+
+func TestSocks5Proxy(t *testing.T) {
+	mainSupervisor := tests.NewMainSupervisor(t, main)
+	defer mainSupervisor.Close()
+
+	// Each backend tells which client certificate it received
+	newBackend := func(name string) *tests.TlsHttpServer {
+		var expected []byte
+		srv, err := tests.NewStartedTlsHttpServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			identity := "unexpected identity"
+			if bytes.Equal(req.TLS.PeerCertificates[0].Raw, expected) {
+				identity = "own identity"
+			}
+			_, _ = fmt.Fprintf(w, "%s %s %s", name, req.URL.Path, identity)
+		}))
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		cert, err := tls.LoadX509KeyPair(srv.CertClientFilePath, srv.KeyClientFilePath)
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		expected = cert.Certificate[0]
+		return srv
+	}
+	defaultSrv, namedSrv := newBackend("default"), newBackend("named")
+	defer defaultSrv.Close()
+	defer namedSrv.Close()
+
+	addr, hasReturned, err := mainSupervisor.Run(map[string]string{
+		"cert":          defaultSrv.CertClientFilePath,
+		"cert-key":      defaultSrv.KeyClientFilePath,
+		"mode":          "socks5",
+		"scope":         defaultSrv.Backend() + " " + namedSrv.Backend(),
+		"identity":      "named=" + namedSrv.CertClientFilePath + "," + namedSrv.KeyClientFilePath,
+		"dest-identity": namedSrv.Backend() + "=named",
+		"auth-basic":    "blahaj:hugs",
+	})
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	if hasReturned {
+		t.Fatalf("The main function has returned and should not returned.")
+	}
+
+	for _, testcase := range []struct {
+		name string
+		auth *proxy.Auth
+		// url is requested in plaintext through the SOCKS5 proxy
+		url string
+		// body is empty if the connection has to be refused
+		body string
+	}{
+		{
+			name: "Default identity",
+			auth: &proxy.Auth{User: "blahaj", Password: "hugs"},
+			url:  "http://" + defaultSrv.Backend() + "/a",
+			body: "default /a own identity",
+		},
+		{
+			name: "Destination identity",
+			auth: &proxy.Auth{User: "blahaj", Password: "hugs"},
+			url:  "http://" + namedSrv.Backend() + "/b",
+			body: "named /b own identity",
+		},
+		{
+			name: "Missing credentials",
+			url:  "http://" + defaultSrv.Backend() + "/a",
+		},
+		{
+			name: "Invalid credentials",
+			auth: &proxy.Auth{User: "blahaj", Password: "bites"},
+			url:  "http://" + defaultSrv.Backend() + "/a",
+		},
+		{
+			name: "Out of the scope",
+			auth: &proxy.Auth{User: "blahaj", Password: "hugs"},
+			url:  "http://127.0.0.1:1/a",
+		},
+	} {
+		t.Logf("Running Test `%s`", testcase.name)
+
+		dialer, err := proxy.SOCKS5("tcp", addr, testcase.auth, proxy.Direct)
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		transport := &http.Transport{Dial: dialer.Dial}
+		client := &http.Client{Transport: transport}
+
+		resp, err := client.Get(testcase.url)
+		if testcase.body == "" {
+			if err == nil {
+				resp.Body.Close()
+				t.Errorf("The connection has not been refused")
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf(unexpectedError, err)
+			continue
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf(unexpectedError, err)
+		} else if string(body) != testcase.body {
+			t.Errorf("Unexpected body: %q", body)
+		}
+		transport.CloseIdleConnections()
+	}
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	mainSupervisor := tests.NewMainSupervisor(t, main)
+	defer mainSupervisor.Close()
+
+	srv, err := tests.NewStartedTlsHttpServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = fmt.Fprintf(w, "%s %d", req.URL.Path, len(req.TLS.PeerCertificates))
+	}))
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	defer srv.Close()
+
+	// The upstream proxy only opens tunnels to the backend, and counts them
+	tunnels := make(chan string, 10)
+	upstreamProxy := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		user, password, ok := (&http.Request{Header: http.Header{"Authorization": req.Header["Proxy-Authorization"]}}).BasicAuth()
+		if req.Method != http.MethodConnect || !ok || user != "blahaj" || password != "hugs" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		backend, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer backend.Close()
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+			return
+		}
+		tunnels <- req.Host
+		go func() {
+			_, _ = io.Copy(backend, brw)
+			backend.Close()
+		}()
+		_, _ = io.Copy(conn, backend)
+	})}
+	upstreamListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	go func() {
+		_ = upstreamProxy.Serve(upstreamListener)
+	}()
+	defer upstreamProxy.Close()
+
+	for _, testcase := range []struct {
+		name     string
+		mode     string
+		upstream string
+		// tunneled is false if the connection to the backend has to fail
+		tunneled bool
+	}{
+		{name: "TCP mode", mode: "tcp", upstream: "http://blahaj:hugs@" + upstreamListener.Addr().String(), tunneled: true},
+		{name: "HTTP mode", mode: "http", upstream: "http://blahaj:hugs@" + upstreamListener.Addr().String(), tunneled: true},
+		{name: "Invalid upstream credentials", mode: "http", upstream: "http://blahaj:bites@" + upstreamListener.Addr().String()},
+	} {
+		t.Logf("Running Test `%s`", testcase.name)
+
+		addr, hasReturned, err := mainSupervisor.Run(map[string]string{
+			"backend":        srv.Backend(),
+			"cert":           srv.CertClientFilePath,
+			"cert-key":       srv.KeyClientFilePath,
+			"mode":           testcase.mode,
+			"upstream-proxy": testcase.upstream,
+		})
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		if hasReturned {
+			t.Fatalf("The main function has returned and should not returned.")
+		}
+
+		transport := &http.Transport{DisableKeepAlives: true}
+		resp, err := (&http.Client{Transport: transport}).Get("http://" + addr + "/upstream")
+		if err != nil {
+			if testcase.tunneled {
+				t.Errorf(unexpectedError, err)
+			}
+			continue
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf(unexpectedError, err)
+			continue
+		}
+		if !testcase.tunneled {
+			if resp.StatusCode == http.StatusOK {
+				t.Errorf("The backend has been reached without valid upstream credentials")
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusOK || string(body) != "/upstream 1" {
+			t.Errorf("Unexpected response: %d %q", resp.StatusCode, body)
+		}
+		select {
+		case host := <-tunnels:
+			if host != srv.Backend() {
+				t.Errorf("Unexpected tunnel destination: %s", host)
+			}
+		default:
+			t.Errorf("The backend has been reached without the upstream proxy")
+		}
+	}
+}
+
+func TestHarCapture(t *testing.T) {
+	mainSupervisor := tests.NewMainSupervisor(t, main)
+	defer mainSupervisor.Close()
+
+	srv, err := tests.NewStartedTlsHttpServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "blahaj"})
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = fmt.Fprintf(w, "%s %s", req.URL.Path, body)
+	}))
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	defer srv.Close()
+	clientCert, err := tls.LoadX509KeyPair(srv.CertClientFilePath, srv.KeyClientFilePath)
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	clientLeaf, err := x509.ParseCertificate(clientCert.Certificate[0])
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+
+	harPath := filepath.Join(t.TempDir(), "capture.har")
+	addr, hasReturned, err := mainSupervisor.Run(map[string]string{
+		"backend":           srv.Backend(),
+		"cert":              srv.CertClientFilePath,
+		"cert-key":          srv.KeyClientFilePath,
+		"mode":              "http",
+		"har-out":           harPath,
+		"har-body-max-size": "10",
+	})
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	if hasReturned {
+		t.Fatalf("The main function has returned and should not returned.")
+	}
+
+	readHAR := func(path string) har.HAR {
+		var h har.HAR
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		if err := json.Unmarshal(content, &h); err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		return h
+	}
+	waitFile := func(path string) {
+		for i := 0; i < 50; i++ {
+			if _, err := os.Stat(path); err == nil {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatalf("The HAR file %s has not been written", path)
+	}
+
+	resp, err := http.Post("http://"+addr+"/post?q=1", "text/plain", strings.NewReader("hello, HAR capture"))
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	// The first exchange is rotated
+	if err := mainSupervisor.Signal(syscall.SIGUSR1); err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	waitFile(har.RotatedPath(harPath, 1))
+	h := readHAR(har.RotatedPath(harPath, 1))
+	if len(h.Log.Entries) != 1 {
+		t.Fatalf("Unexpected rotated entries: %v", h.Log.Entries)
+	}
+	entry := h.Log.Entries[0]
+	if entry.Request.Method != http.MethodPost || entry.Request.URL != "https://"+srv.Backend()+"/post?q=1" {
+		t.Errorf("Unexpected request: %s %s", entry.Request.Method, entry.Request.URL)
+	}
+	if entry.Request.PostData == nil || entry.Request.PostData.Text != "hello, HAR" || entry.Request.PostData.Comment != "truncated" || entry.Request.BodySize != 18 {
+		t.Errorf("Unexpected request body: %+v (%d bytes)", entry.Request.PostData, entry.Request.BodySize)
+	}
+	if len(entry.Request.QueryString) != 1 || entry.Request.QueryString[0] != (har.NameValue{Name: "q", Value: "1"}) {
+		t.Errorf("Unexpected query string: %v", entry.Request.QueryString)
+	}
+	if entry.Response.Status != http.StatusOK || entry.Response.Content.Text != "/post hell" || entry.Response.Content.Size != 24 || entry.Response.Content.MimeType != "text/plain" {
+		t.Errorf("Unexpected response: %+v", entry.Response)
+	}
+	if len(entry.Response.Cookies) != 1 || entry.Response.Cookies[0].Name != "session" {
+		t.Errorf("Unexpected response cookies: %v", entry.Response.Cookies)
+	}
+	if entry.TLS == nil || entry.TLS.Version == "" || entry.TLS.CipherSuite == "" {
+		t.Errorf("Unexpected TLS details: %+v", entry.TLS)
+	}
+	if entry.ClientCert == nil || entry.ClientCert.Subject != clientLeaf.Subject.String() {
+		t.Errorf("Unexpected client certificate: %+v", entry.ClientCert)
+	}
+	if entry.Timings.Connect < 0 || entry.Timings.SSL < 0 || entry.Time <= 0 {
+		t.Errorf("Unexpected timings: %+v (%f ms)", entry.Timings, entry.Time)
+	}
+
+	// The second exchange is written on shutdown, on a reused connection
+	resp, err = http.Get("http://" + addr + "/get")
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if err := mainSupervisor.Signal(os.Interrupt); err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	mainSupervisor.Wait(5 * time.Second)
+	waitFile(harPath)
+	h = readHAR(harPath)
+	if len(h.Log.Entries) != 1 {
+		t.Fatalf("Unexpected entries: %v", h.Log.Entries)
+	}
+	entry = h.Log.Entries[0]
+	if entry.Request.URL != "https://"+srv.Backend()+"/get" || entry.Request.PostData != nil || entry.Response.Content.Text != "/get " {
+		t.Errorf("Unexpected exchange: %+v", entry)
+	}
+	if entry.ClientCert == nil || entry.ClientCert.Subject != clientLeaf.Subject.String() {
+		t.Errorf("Unexpected client certificate on the reused connection: %+v", entry.ClientCert)
+	}
+	if entry.Timings.Connect != -1 {
+		t.Errorf("The connection has not been reused: %+v", entry.Timings)
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	mainSupervisor := tests.NewMainSupervisor(t, main)
+	defer mainSupervisor.Close()
+
+	srv, err := tests.NewStartedTlsHttpServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		delay, _ := time.ParseDuration(req.URL.Query().Get("delay"))
+		time.Sleep(delay)
+		_, _ = fmt.Fprint(w, "done")
+	}))
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	defer srv.Close()
+
+	for _, testcase := range []struct {
+		name   string
+		mode   string
+		signal os.Signal
+		// delay is the time taken by the backend to answer
+		delay string
+		// drained is false if the request has to be interrupted
+		drained bool
+		status  int
+	}{
+		{name: "TCP mode, drained", mode: "tcp", signal: syscall.SIGTERM, delay: "500ms", drained: true, status: 0},
+		{name: "HTTP mode, drained", mode: "http", signal: os.Interrupt, delay: "500ms", drained: true, status: 0},
+		{name: "TCP mode, forced", mode: "tcp", signal: syscall.SIGTERM, delay: "3s", status: 2},
+		{name: "HTTP mode, forced", mode: "http", signal: syscall.SIGTERM, delay: "3s", status: 2},
+	} {
+		t.Logf("Running Test `%s`", testcase.name)
+
+		addr, hasReturned, err := mainSupervisor.Run(map[string]string{
+			"backend":          srv.Backend(),
+			"cert":             srv.CertClientFilePath,
+			"cert-key":         srv.KeyClientFilePath,
+			"mode":             testcase.mode,
+			"shutdown-timeout": "1s",
+		})
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		if hasReturned {
+			t.Fatalf("The main function has returned and should not returned.")
+		}
+
+		type result struct {
+			body string
+			err  error
+		}
+		results := make(chan result, 1)
+		go func() {
+			// In TCP mode, the stream only ends when the client closes it
+			client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+			resp, err := client.Get("http://" + addr + "/?delay=" + testcase.delay)
+			if err != nil {
+				results <- result{err: err}
+				return
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			results <- result{body: string(body), err: err}
+		}()
+
+		// The request is in flight
+		time.Sleep(200 * time.Millisecond)
+		if err := mainSupervisor.Signal(testcase.signal); err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+
+		// New connections are refused
+		time.Sleep(100 * time.Millisecond)
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			t.Errorf("A connection has been accepted during the shutdown")
+		}
+
+		res := <-results
+		if testcase.drained && (res.err != nil || res.body != "done") {
+			t.Errorf("The request has not been drained: %q, %v", res.body, res.err)
+		}
+		if !testcase.drained && res.err == nil && res.body == "done" {
+			t.Errorf("The request has not been interrupted")
+		}
+
+		if !mainSupervisor.Wait(5 * time.Second) {
+			t.Fatalf("The main function has not returned")
+		}
+		if status := mainSupervisor.ExitCode(); status != testcase.status {
+			t.Errorf("Unexpected exit status: %d", status)
+		}
+	}
+}
+
+func TestTcpMaxConnections(t *testing.T) {
+	mainSupervisor := tests.NewMainSupervisor(t, main)
+	defer mainSupervisor.Close()
+
+	srv, err := tests.NewStartedTlsHttpServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = fmt.Fprint(w, "done")
+	}))
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	defer srv.Close()
+
+	// get sends a request on the connection, and reads the response body
+	get := func(conn net.Conn, timeout time.Duration) (string, error) {
+		if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			return "", err
+		}
+		if _, err := fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"); err != nil {
+			return "", err
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	for _, policy := range []string{"queue", "reject"} {
+		t.Logf("Running Test `%s`", policy)
+
+		addr, hasReturned, err := mainSupervisor.Run(map[string]string{
+			"backend":                srv.Backend(),
+			"cert":                   srv.CertClientFilePath,
+			"cert-key":               srv.KeyClientFilePath,
+			"mode":                   "tcp",
+			"max-connections":        "1",
+			"max-connections-policy": policy,
+		})
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		if hasReturned {
+			t.Fatalf("The main function has returned and should not returned.")
+		}
+
+		first, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		if body, err := get(first, 5*time.Second); err != nil || body != "done" {
+			t.Fatalf("Unexpected response on the first connection: %q, %v", body, err)
+		}
+
+		// The first connection is still open
+		second, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		_, err = get(second, 500*time.Millisecond)
+		var netErr net.Error
+		switch {
+		case policy == "queue" && !(errors.As(err, &netErr) && netErr.Timeout()):
+			t.Errorf("The second connection has not been queued: %v", err)
+		case policy == "reject" && (err == nil || errors.As(err, &netErr) && netErr.Timeout()):
+			t.Errorf("The second connection has not been rejected: %v", err)
+		}
+
+		first.Close()
+		if policy == "queue" {
+			// The queued connection is handled once the first one ends
+			if body, err := get(second, 5*time.Second); err != nil || body != "done" {
+				t.Errorf("Unexpected response on the queued connection: %q, %v", body, err)
+			}
+		}
+		second.Close()
+
+		// A slot is free again
+		time.Sleep(100 * time.Millisecond)
+		third, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		if body, err := get(third, 5*time.Second); err != nil || body != "done" {
+			t.Errorf("Unexpected response on the third connection: %q, %v", body, err)
+		}
+		third.Close()
+	}
+}
+
+func TestTcpHalfClose(t *testing.T) {
+	mainSupervisor := tests.NewMainSupervisor(t, main)
+	defer mainSupervisor.Close()
+
+	// The backend answers once the client has sent everything
+	srv, err := tests.NewStartedTlsHttpServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		body, _ := io.ReadAll(brw)
+		_, _ = fmt.Fprintf(conn, "echo: %s", body)
+	}))
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	defer srv.Close()
+
+	addr, hasReturned, err := mainSupervisor.Run(map[string]string{
+		"backend":  srv.Backend(),
+		"cert":     srv.CertClientFilePath,
+		"cert-key": srv.KeyClientFilePath,
+		"mode":     "tcp",
+	})
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	if hasReturned {
+		t.Fatalf("The main function has returned and should not returned.")
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := fmt.Fprint(conn, "POST / HTTP/1.1\r\nHost: localhost\r\n\r\nrequest"); err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	response, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	if string(response) != "echo: request" {
+		t.Errorf("Unexpected response: %q", response)
+	}
+}
+
+func TestTcpTimeouts(t *testing.T) {
+	mainSupervisor := tests.NewMainSupervisor(t, main)
+	defer mainSupervisor.Close()
+
+	srv, err := tests.NewStartedTlsHttpServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = fmt.Fprint(w, "done")
+	}))
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	defer srv.Close()
+
+	for _, testcase := range []struct {
+		name   string
+		config map[string]string
+		// interval is the time between the requests of the client
+		interval time.Duration
+	}{
+		{name: "idle timeout", config: map[string]string{"idle-timeout": "500ms"}, interval: 2 * time.Second},
+		{name: "max lifetime", config: map[string]string{"max-conn-lifetime": "1s"}, interval: 200 * time.Millisecond},
+	} {
+		t.Logf("Running Test `%s`", testcase.name)
+
+		config := map[string]string{
+			"backend":  srv.Backend(),
+			"cert":     srv.CertClientFilePath,
+			"cert-key": srv.KeyClientFilePath,
+			"mode":     "tcp",
+		}
+		for k, v := range testcase.config {
+			config[k] = v
+		}
+		addr, hasReturned, err := mainSupervisor.Run(config)
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		if hasReturned {
+			t.Fatalf("The main function has returned and should not returned.")
+		}
+
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		reader := bufio.NewReader(conn)
+		start := time.Now()
+		for time.Since(start) < 5*time.Second {
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err = fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"); err != nil {
+				break
+			}
+			var resp *http.Response
+			if resp, err = http.ReadResponse(reader, nil); err != nil {
+				break
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			time.Sleep(testcase.interval)
+		}
+		conn.Close()
+
+		var netErr net.Error
+		if err == nil || errors.As(err, &netErr) && netErr.Timeout() {
+			t.Errorf("The connection has not been closed by the proxy: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 3*time.Second {
+			t.Errorf("The connection has been closed after %s", elapsed)
+		}
+	}
+}
+
+func TestTcpErrorStyle(t *testing.T) {
+	mainSupervisor := tests.NewMainSupervisor(t, main)
+	defer mainSupervisor.Close()
+
+	// Only the client certificate of the server is used
+	srv, err := tests.NewStartedTlsHttpServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	defer srv.Close()
+
+	// The backend is unreachable
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	backend := l.Addr().String()
+	l.Close()
+
+	for _, testcase := range []struct {
+		style string
+		// check returns if the client has been told about the failure as
+		// expected
+		check func(response []byte, err error) bool
+	}{
+		{style: "close", check: func(response []byte, err error) bool {
+			return len(response) == 0 && err == nil
+		}},
+		{style: "reset", check: func(response []byte, err error) bool {
+			return len(response) == 0 && errors.Is(err, syscall.ECONNRESET)
+		}},
+		{style: "http", check: func(response []byte, err error) bool {
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(response)), nil)
+			return err == nil && resp.StatusCode == http.StatusBadGateway
+		}},
+		{style: "postgres", check: func(response []byte, err error) bool {
+			return err == nil && len(response) > 5 && response[0] == 'E' && bytes.Contains(response, []byte("C08006\x00"))
+		}},
+		{style: "smtp", check: func(response []byte, err error) bool {
+			return err == nil && bytes.HasPrefix(response, []byte("421 ")) && bytes.HasSuffix(response, []byte("\r\n"))
+		}},
+	} {
+		t.Logf("Running Test `%s`", testcase.style)
+
+		addr, hasReturned, err := mainSupervisor.Run(map[string]string{
+			"backend":         backend,
+			"cert":            srv.CertClientFilePath,
+			"cert-key":        srv.KeyClientFilePath,
+			"mode":            "tcp",
+			"tcp-error-style": testcase.style,
+		})
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		if hasReturned {
+			t.Fatalf("The main function has returned and should not returned.")
+		}
+
+		// On the loopback, the reset can come before the end of the dialing
+		var response []byte = nil
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+			response, err = io.ReadAll(conn)
+			conn.Close()
+		}
+		if !testcase.check(response, err) {
+			t.Errorf("Unexpected failure report: %q, %v", response, err)
+		}
+		if bytes.Contains(response, []byte(strings.TrimPrefix(backend, "127.0.0.1:"))) {
+			t.Errorf("The failure report has details: %q", response)
+		}
+	}
+}
+
+func TestHttpIdentitySelection(t *testing.T) {
+	mainSupervisor := tests.NewMainSupervisor(t, main)
+	defer mainSupervisor.Close()
+
+	// The backend answers the serial number of the client certificate, and
+	// the identity header it received
+	srv, err := tests.NewStartedTlsHttpServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = fmt.Fprintf(w, "%s|%s", req.TLS.PeerCertificates[0].SerialNumber, req.Header.Get("X-Unmtls-Identity"))
+	}))
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	defer srv.Close()
+
+	// Only the client certificates of these servers are used
+	serials := map[string]string{}
+	identities := []string{}
+	for _, name := range []string{"admin", "user"} {
+		certSrv, err := tests.NewStartedTlsHttpServer(http.NotFoundHandler())
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		defer certSrv.Close()
+		certificate, err := tls.LoadX509KeyPair(certSrv.CertClientFilePath, certSrv.KeyClientFilePath)
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		serials[name] = leaf.SerialNumber.String()
+		identities = append(identities, name+"="+certSrv.CertClientFilePath+","+certSrv.KeyClientFilePath)
+	}
+	certificate, err := tls.LoadX509KeyPair(srv.CertClientFilePath, srv.KeyClientFilePath)
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	serials[""] = leaf.SerialNumber.String()
+
+	addr, hasReturned, err := mainSupervisor.Run(map[string]string{
+		"backend":  srv.Backend(),
+		"cert":     srv.CertClientFilePath,
+		"cert-key": srv.KeyClientFilePath,
+		"identity": strings.Join(identities, " "),
+		"mode":     "http",
+	})
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	if hasReturned {
+		t.Fatalf("The main function has returned and should not returned.")
+	}
+
+	for _, testcase := range []struct {
+		identity string
+		status   int
+		// serial is the one of the certificate the backend has to see
+		serial string
+	}{
+		{identity: "", status: http.StatusOK, serial: serials[""]},
+		{identity: "admin", status: http.StatusOK, serial: serials["admin"]},
+		{identity: "user", status: http.StatusOK, serial: serials["user"]},
+		{identity: "unknown", status: http.StatusBadRequest},
+	} {
+		t.Logf("Running Test `%s`", testcase.identity)
+
+		req, err := http.NewRequest(http.MethodGet, "http://"+addr+"/", nil)
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		if testcase.identity != "" {
+			req.Header.Set("X-Unmtls-Identity", testcase.identity)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+
+		if resp.StatusCode != testcase.status {
+			t.Errorf("Unexpected status: %d", resp.StatusCode)
+			continue
+		}
+		if testcase.status != http.StatusOK {
+			continue
+		}
+		// The identity header is not forwarded
+		if expected := testcase.serial + "|"; string(body) != expected {
+			t.Errorf("The backend saw %q instead of %q", body, expected)
+		}
+	}
+}
+
+func TestHttpAutoTLS(t *testing.T) {
+	mainSupervisor := tests.NewMainSupervisor(t, main)
+	defer mainSupervisor.Close()
+
+	srv, err := tests.NewStartedTlsHttpServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = io.WriteString(w, req.URL.Path)
+	}))
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	defer srv.Close()
+
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	addr, hasReturned, err := mainSupervisor.Run(map[string]string{
+		"backend":          srv.Backend(),
+		"cert":             srv.CertClientFilePath,
+		"cert-key":         srv.KeyClientFilePath,
+		"mode":             "http",
+		"listen-auto-tls":  "true",
+		"listen-ca-export": caPath,
+	})
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	if hasReturned {
+		t.Fatalf("The main function has returned and should not returned.")
+	}
+
+	ca, err := os.ReadFile(caPath)
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca) {
+		t.Fatalf("The exported CA is not a PEM certificate")
+	}
+
+	for _, testcase := range []struct {
+		serverName string
+		// shouldFail is set when no certificate can be issued
+		shouldFail bool
+	}{
+		{serverName: "localhost"},
+		{serverName: "backend.example"},
+		{serverName: "127.0.0.1"},
+		{serverName: "bad name", shouldFail: true},
+		{serverName: "a..b", shouldFail: true},
+	} {
+		t.Logf("Running Test `%s`", testcase.serverName)
+
+		transport := &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: testcase.serverName},
+		}
+		client := &http.Client{Transport: transport}
+		resp, err := client.Get("https://" + addr + "/auto")
+		if testcase.shouldFail {
+			if err == nil {
+				resp.Body.Close()
+				t.Errorf("A certificate has been issued for an invalid name")
+			} else if !strings.Contains(err.Error(), "remote error") {
+				// The proxy, not the client, has to refuse the name
+				t.Errorf(unexpectedError, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf(unexpectedError, err)
+			continue
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf(unexpectedError, err)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK || string(body) != "/auto" {
+			t.Errorf("Unexpected response: %d %q", resp.StatusCode, body)
+		}
+		if name := resp.TLS.PeerCertificates[0].Subject.CommonName; name != testcase.serverName {
+			t.Errorf("Unexpected certificate: %s", name)
+		}
+		transport.CloseIdleConnections()
+	}
+}
+
+func TestHttpAuthentication(t *testing.T) {
+	mainSupervisor := tests.NewMainSupervisor(t, main)
+	defer mainSupervisor.Close()
+
+	// The backend answers the credentials it received
+	srv, err := tests.NewStartedTlsHttpServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = fmt.Fprintf(w, "%s|%s", req.Header.Get("Authorization"), req.Header.Get("Proxy-Authorization"))
+	}))
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	defer srv.Close()
+
+	for _, testcase := range []struct {
+		name        string
+		proxyHeader bool
+		// authorization is for the backend, proxyAuthorization for the proxy
+		authorization      string
+		proxyAuthorization string
+		status             int
+		// backend is what the backend received
+		backend string
+	}{
+		{name: "Without credentials", status: http.StatusUnauthorized},
+		{name: "Invalid credentials", authorization: "Bearer s3cr3", status: http.StatusUnauthorized},
+		{name: "Valid credentials", authorization: "Bearer s3cr3t", status: http.StatusOK, backend: "|"},
+		{name: "Proxy header, without credentials", proxyHeader: true, status: http.StatusProxyAuthRequired},
+		{name: "Proxy header, credentials of the backend only", proxyHeader: true, authorization: "Bearer backend-token", status: http.StatusProxyAuthRequired},
+		{name: "Proxy header, invalid credentials", proxyHeader: true, authorization: "Bearer backend-token", proxyAuthorization: "Bearer s3cr3", status: http.StatusProxyAuthRequired},
+		{name: "Proxy header, valid credentials", proxyHeader: true, proxyAuthorization: "Bearer s3cr3t", status: http.StatusOK, backend: "|"},
+		{name: "Proxy header, valid credentials of both", proxyHeader: true, authorization: "Bearer backend-token", proxyAuthorization: "Bearer s3cr3t", status: http.StatusOK, backend: "Bearer backend-token|"},
+	} {
+		t.Logf("Running Test `%s`", testcase.name)
+
+		addr, hasReturned, err := mainSupervisor.Run(map[string]string{
+			"backend":           srv.Backend(),
+			"cert":              srv.CertClientFilePath,
+			"cert-key":          srv.KeyClientFilePath,
+			"mode":              "http",
+			"auth-bearer":       "s3cr3t",
+			"auth-proxy-header": fmt.Sprint(testcase.proxyHeader),
+		})
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		if hasReturned {
+			t.Fatalf("The main function has returned and should not returned.")
+		}
+
+		req, err := http.NewRequest(http.MethodGet, "http://"+addr+"/", nil)
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		if testcase.authorization != "" {
+			req.Header.Set("Authorization", testcase.authorization)
+		}
+		if testcase.proxyAuthorization != "" {
+			req.Header.Set("Proxy-Authorization", testcase.proxyAuthorization)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+
+		if resp.StatusCode != testcase.status {
+			t.Errorf("Unexpected status: %d", resp.StatusCode)
+			continue
+		}
+		// The credentials of the proxy are not forwarded
+		if testcase.status == http.StatusOK && string(body) != testcase.backend {
+			t.Errorf("The backend saw %q", body)
+		}
+	}
+}
+
+func TestTcpServerVerification(t *testing.T) {
+	mainSupervisor := tests.NewMainSupervisor(t, main)
+	defer mainSupervisor.Close()
+	exampleDir, err := configurationtest.GetExampleDir(0)
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+
+	srv, err := tests.NewStartedTlsHttpServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	defer srv.Close()
+
+	// The certificate of the backend is not issued by this CA
+	addr, hasReturned, err := mainSupervisor.Run(map[string]string{
+		"backend":         srv.Backend(),
+		"cert":            srv.CertClientFilePath,
+		"cert-key":        srv.KeyClientFilePath,
+		"mode":            "tcp",
+		"server-ca":       filepath.Join(exampleDir, testCertClientCertPem),
+		"tcp-error-style": "http",
+	})
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	if hasReturned {
+		t.Fatalf("The main function has returned and should not returned.")
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	resp.Body.Close()
+	conn.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Unexpected status: %d", resp.StatusCode)
+	}
+
+	// The client is only told about the failure: the verification error is
+	// logged
+	mainSupervisor.Close()
+	mainSupervisor.Wait(time.Second)
+	if logs := mainSupervisor.Logs(); !strings.Contains(logs, "tls: failed to verify certificate: x509: certificate signed by unknown authority") {
+		t.Errorf("The verification error has not been logged: %s", logs)
+	}
+}
+
+func TestServerNameVerification(t *testing.T) {
+	mainSupervisor := tests.NewMainSupervisor(t, main)
+	defer mainSupervisor.Close()
+	exampleDir, err := configurationtest.GetExampleDir(0)
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+
+	caFile, err := os.CreateTemp("", "unmtlsproxy_unit_tests_server_name_ca_*")
+	if err != nil {
+		t.Fatalf(unexpectedError, err)
+	}
+	defer os.Remove(caFile.Name())
+	defer caFile.Close()
+
+	// Both backends are trusted, but only the certificate of the matching one
+	// is valid for its IP address
+	newBackend := func(name string, dnsNames []string, ipAddresses []net.IP) string {
+		var certPem, keyPem bytes.Buffer
+		if _, _, err := tests.GenerateServerCertificate(dnsNames, ipAddresses, io.MultiWriter(&certPem, caFile), &keyPem); err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		cert, err := tls.X509KeyPair(certPem.Bytes(), keyPem.Bytes())
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			_, _ = io.WriteString(w, name)
+		}))
+		srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+		srv.StartTLS()
+		t.Cleanup(srv.Close)
+		return strings.TrimPrefix(srv.URL, "https://")
+	}
+	matching := newBackend("matching", nil, []net.IP{net.IPv4(127, 0, 0, 1)})
+	mismatched := newBackend("mismatched", []string{"backend.example"}, nil)
+
+	for _, testcase := range []struct {
+		name    string
+		mode    string
+		backend string
+		// hostname is the value of `verify-hostname`
+		hostname string
+		// body is empty if the server certificate has to be rejected
+		body string
+	}{
+		{"TCP, matching IP address", "tcp", matching, "", "matching"},
+		{"TCP, mismatched IP address", "tcp", mismatched, "", ""},
+		{"TCP, overridden hostname", "tcp", mismatched, "backend.example", "mismatched"},
+		{"HTTP, matching IP address", "http", matching, "", "matching"},
+		{"HTTP, mismatched IP address", "http", mismatched, "", ""},
+		{"HTTP, overridden hostname", "http", mismatched, "backend.example", "mismatched"},
+		{"Forward, matching IP address", "forward", matching, "", "matching"},
+		{"Forward, mismatched IP address", "forward", mismatched, "", ""},
+		{"SOCKS5, matching IP address", "socks5", matching, "", "matching"},
+		{"SOCKS5, mismatched IP address", "socks5", mismatched, "", ""},
+	} {
+		t.Logf("Running Test `%s`", testcase.name)
+
+		config := map[string]string{
+			"cert":      filepath.Join(exampleDir, testCertClientCertPem),
+			"cert-key":  filepath.Join(exampleDir, testCertClientKeyNoEncryptionPem),
+			"mode":      testcase.mode,
+			"server-ca": caFile.Name(),
+		}
+		switch testcase.mode {
+		case "tcp":
+			config["backend"] = testcase.backend
+			config["tcp-error-style"] = "http"
+		case "http":
+			config["backend"] = testcase.backend
+		case "forward", "socks5":
+			config["scope"] = "127.0.0.1"
+		}
+		if testcase.hostname != "" {
+			config["verify-hostname"] = testcase.hostname
+		}
+		addr, hasReturned, err := mainSupervisor.Run(config)
+		if err != nil {
+			t.Fatalf(unexpectedError, err)
+		}
+		if hasReturned {
+			t.Fatalf("The main function has returned and should not returned.")
+		}
+
+		transport := &http.Transport{}
+		target := "http://" + addr + "/"
+		switch testcase.mode {
+		case "forward":
+			transport.Proxy = http.ProxyURL(&url.URL{Scheme: "http", Host: addr})
+			target = "http://" + testcase.backend + "/"
+		case "socks5":
+			dialer, err := proxy.SOCKS5("tcp", addr, nil, proxy.Direct)
+			if err != nil {
+				t.Fatalf(unexpectedError, err)
+			}
+			transport.Dial = dialer.Dial
+			target = "http://" + testcase.backend + "/"
+		}
+		client := &http.Client{Transport: transport, Timeout: 5 * time.Second}
+
+		resp, err := client.Get(target)
+		if err != nil {
+			// The SOCKS5 proxy refuses the connection
+			if testcase.body != "" || testcase.mode != "socks5" {
+				t.Errorf(unexpectedError, err)
+			}
+			continue
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		transport.CloseIdleConnections()
+		if err != nil {
+			t.Errorf(unexpectedError, err)
+			continue
+		}
+		switch {
+		case testcase.body == "" && resp.StatusCode != http.StatusBadGateway && resp.StatusCode != http.StatusServiceUnavailable:
+			t.Errorf("The server certificate has not been rejected: %d %q", resp.StatusCode, body)
+		case testcase.body != "" && string(body) != testcase.body:
+			t.Errorf("Unexpected response: %d %q", resp.StatusCode, body)
+		}
+	}
+}